@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/g8os/fs/config"
+	"github.com/g8os/fs/files"
+	"github.com/g8os/fs/utils"
+)
+
+// mounts are the filesystems served, by mount path, for the admin API
+var mounts = struct {
+	sync.RWMutex
+	m map[string]*mounted
+}{m: make(map[string]*mounted)}
+
+type mounted struct {
+	cfg config.Mount
+	fs  *files.FS
+}
+
+func registerMount(cfg config.Mount, fs *files.FS) {
+	mounts.Lock()
+	defer mounts.Unlock()
+	mounts.m[cfg.Path] = &mounted{cfg: cfg, fs: fs}
+}
+
+func getMount(path string) (*mounted, bool) {
+	mounts.RLock()
+	defer mounts.RUnlock()
+	m, ok := mounts.m[path]
+	return m, ok
+}
+
+// anyOffline returns true if a mount is offline
+func anyOffline() bool {
+	mounts.RLock()
+	defer mounts.RUnlock()
+	for _, m := range mounts.m {
+		if m.fs.Offline().On() {
+			return true
+		}
+	}
+	return false
+}
+
+type pinsStatus struct {
+	Path      string         `json:"path"`
+	Config    []string       `json:"config"`
+	Runtime   []string       `json:"runtime"`
+	Prefetch  files.Progress `json:"prefetch"`
+	Recording bool           `json:"recording"`
+}
+
+// adminHandler serves the admin API. GET /pins returns the pins and prefetch
+// progress of the mounts, POST /pins?mount=M&pin=P pins P in the mount M and
+// prefetches it, and DELETE /pins?mount=M&pin=P removes a pin added at
+// runtime. POST /record?mount=M&seconds=N records the files opened in M
+// during N seconds as the prefetch profile of its flist, with the byte
+// ranges read if ranges=1.
+//
+// GET /offline returns the offline mode of the mounts, and POST
+// /offline?mount=M&on=1 (or 0) switches M offline (or back). GET
+// /cached?mount=M lists the files of M, one per line prefixed by "cached" or
+// "missing", under path=P only, and only the missing ones with missing=1.
+//
+// Every request requires the basic auth user:password, unless user is empty.
+func adminHandler(user, password string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pins", pinsHandler)
+	mux.HandleFunc("/record", recordHandler)
+	mux.HandleFunc("/offline", offlineHandler)
+	mux.HandleFunc("/cached", cachedHandler)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !utils.Authorized(r, user, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// splitAuth returns the user and the password of a USER:PASSWORD auth
+func splitAuth(auth string) (string, string, error) {
+	i := strings.Index(auth, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("invalid auth, expected USER:PASSWORD")
+	}
+	return auth[:i], auth[i+1:], nil
+}
+
+func pinsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		writePinsStatus(w)
+		return
+	}
+
+	m, ok := getMount(r.FormValue("mount"))
+	if !ok {
+		http.Error(w, "unknown mount", http.StatusNotFound)
+		return
+	}
+	fs := m.fs
+	pin := r.FormValue("pin")
+
+	switch r.Method {
+	case "POST":
+		if err := fs.Pins().Add(pin); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Infof("Pinned '%s' in %s", pin, r.FormValue("mount"))
+		go fs.Prefetch()
+	case "DELETE":
+		if err := fs.Pins().Remove(pin); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Infof("Unpinned '%s' in %s", pin, r.FormValue("mount"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func recordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m, ok := getMount(r.FormValue("mount"))
+	if !ok {
+		http.Error(w, "unknown mount", http.StatusNotFound)
+		return
+	}
+
+	seconds, err := strconv.Atoi(r.FormValue("seconds"))
+	if err != nil || seconds <= 0 {
+		http.Error(w, "invalid seconds", http.StatusBadRequest)
+		return
+	}
+
+	ranges := r.FormValue("ranges") == "1"
+	if err := recordProfile(m.fs, m.cfg, time.Duration(seconds)*time.Second, ranges); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writePinsStatus(w http.ResponseWriter) {
+	mounts.RLock()
+	var status []pinsStatus
+	for path, m := range mounts.m {
+		status = append(status, pinsStatus{
+			Path:      path,
+			Config:    m.fs.Pins().Config(),
+			Runtime:   m.fs.Pins().Runtime(),
+			Prefetch:  m.fs.PrefetchProgress(),
+			Recording: m.fs.Recording(),
+		})
+	}
+	mounts.RUnlock()
+
+	sort.Sort(byMountPath(status))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Errorf("Failed to write the pins status: %s", err)
+	}
+}
+
+type offlineStatus struct {
+	Path string `json:"path"`
+	// Offline is true if the mount is offline, Forced if it was switched
+	// offline rather than its store being unhealthy
+	Offline bool `json:"offline"`
+	Forced  bool `json:"forced"`
+}
+
+func offlineHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeOfflineStatus(w)
+		return
+	case "POST":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m, ok := getMount(r.FormValue("mount"))
+	if !ok {
+		http.Error(w, "unknown mount", http.StatusNotFound)
+		return
+	}
+
+	on, err := strconv.ParseBool(r.FormValue("on"))
+	if err != nil {
+		http.Error(w, "invalid on", http.StatusBadRequest)
+		return
+	}
+
+	m.fs.Offline().Set(on)
+	log.Infof("Switched %s offline: %v", r.FormValue("mount"), on)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeOfflineStatus(w http.ResponseWriter) {
+	mounts.RLock()
+	var status []offlineStatus
+	for path, m := range mounts.m {
+		status = append(status, offlineStatus{
+			Path:    path,
+			Offline: m.fs.Offline().On(),
+			Forced:  m.fs.Offline().Forced(),
+		})
+	}
+	mounts.RUnlock()
+
+	sort.Sort(byOfflinePath(status))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Errorf("Failed to write the offline status: %s", err)
+	}
+}
+
+func cachedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m, ok := getMount(r.FormValue("mount"))
+	if !ok {
+		http.Error(w, "unknown mount", http.StatusNotFound)
+		return
+	}
+
+	missing := r.FormValue("missing") == "1"
+	w.Header().Set("Content-Type", "text/plain")
+	err := m.fs.ListCached(r.FormValue("path"), func(f files.CachedFile) error {
+		if f.Cached && missing {
+			return nil
+		}
+
+		state := "missing"
+		if f.Cached {
+			state = "cached"
+		}
+		_, err := fmt.Fprintf(w, "%s %s\n", state, f.Name)
+		return err
+	})
+	if err == files.ErrNotFound {
+		http.Error(w, "unknown path", http.StatusNotFound)
+	} else if err != nil {
+		log.Errorf("Failed to list the cached files of %s: %s", r.FormValue("mount"), err)
+	}
+}
+
+type byOfflinePath []offlineStatus
+
+func (s byOfflinePath) Len() int           { return len(s) }
+func (s byOfflinePath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+func (s byOfflinePath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type byMountPath []pinsStatus
+
+func (s byMountPath) Len() int           { return len(s) }
+func (s byMountPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+func (s byMountPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAuth(t *testing.T) {
+	server := httptest.NewServer(adminHandler("admin", "secret"))
+	defer server.Close()
+
+	authorized := strings.Replace(server.URL, "://", "://admin:secret@", 1)
+	for u, code := range map[string]int{
+		server.URL: http.StatusUnauthorized,
+		strings.Replace(server.URL, "://", "://admin:other@", 1): http.StatusUnauthorized,
+		authorized: http.StatusOK,
+	} {
+		response, err := http.Get(u + "/offline")
+		if assert.NoError(t, err) {
+			response.Body.Close()
+			assert.Equal(t, code, response.StatusCode, u)
+		}
+	}
+
+	var out bytes.Buffer
+	err := listCached(server.URL, "/opt", "", false, &out)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "401")
+	}
+	err = listCached(authorized, "/opt", "/usr", true, &out)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown mount")
+	}
+	assert.Empty(t, out.String())
+}
+
+func TestListCached(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/cached", r.URL.Path)
+		assert.Equal(t, "/opt", r.FormValue("mount"))
+		assert.Equal(t, "/usr", r.FormValue("path"))
+		assert.Equal(t, "1", r.FormValue("missing"))
+		w.Write([]byte("missing /usr/lib/libc.so\n"))
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+	assert.NoError(t, listCached(server.URL+"/", "/opt", "/usr", true, &out))
+	assert.Equal(t, "missing /usr/lib/libc.so\n", out.String())
+}
+
+func TestSplitAuth(t *testing.T) {
+	user, password, err := splitAuth("user:pass:word")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", user)
+	assert.Equal(t, "pass:word", password)
+
+	_, _, err = splitAuth("user")
+	assert.Error(t, err)
+}
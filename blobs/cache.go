@@ -0,0 +1,327 @@
+package blobs
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+var (
+	log = logging.MustGetLogger("blobs")
+)
+
+// Cache is a node-wide content addressed cache of the blobs, decoded, shared
+// by all the mounts: a blob is downloaded once per node, and the cached files
+// of the mounts are hard links to it. A blob no file links to anymore is
+// unreferenced and can be evicted. The mounts may get their blobs from
+// different stores, so a blob is only cached if the md5 of its content is its
+// hash.
+type Cache struct {
+	dir string
+
+	lock     sync.Mutex
+	fetching map[string]*fetch
+}
+
+// fetch is a download of a blob, shared by the concurrent Gets of its hash
+type fetch struct {
+	done chan struct{}
+	err  error
+}
+
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Cache{
+		dir:      dir,
+		fetching: make(map[string]*fetch),
+	}, nil
+}
+
+// Path returns the path of the blob hash, cached or not
+func (c *Cache) Path(hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(c.dir, "_", hash)
+	}
+	return filepath.Join(c.dir, hash[:2], hash)
+}
+
+func validHash(hash string) error {
+	if hash == "" || strings.ContainsAny(hash, "/\x00") || hash[0] == '.' {
+		return fmt.Errorf("invalid blob hash '%s'", hash)
+	}
+	return nil
+}
+
+// Cached returns true if the blob hash is in the cache
+func (c *Cache) Cached(hash string) bool {
+	if c == nil || validHash(hash) != nil {
+		return false
+	}
+	_, err := os.Stat(c.Path(hash))
+	return err == nil
+}
+
+// Get returns the path of the blob hash, calling download to write it if
+// it's not cached. Concurrent Gets of a hash download it once.
+func (c *Cache) Get(hash string, download func(w io.Writer) error) (string, error) {
+	if err := validHash(hash); err != nil {
+		return "", err
+	}
+
+	name := c.Path(hash)
+	if _, err := os.Stat(name); err == nil {
+		return name, nil
+	}
+
+	c.lock.Lock()
+	f, ok := c.fetching[hash]
+	if !ok {
+		f = &fetch{done: make(chan struct{})}
+		c.fetching[hash] = f
+	}
+	c.lock.Unlock()
+
+	if ok {
+		<-f.done
+		return name, f.err
+	}
+
+	f.err = c.write(hash, name, download)
+
+	c.lock.Lock()
+	delete(c.fetching, hash)
+	c.lock.Unlock()
+	close(f.done)
+
+	return name, f.err
+}
+
+// write writes a blob atomically, so a partial or corrupted blob is never
+// linked
+func (c *Cache) write(hash, name string, download func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".download")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+
+	sum := md5.New()
+	err = download(io.MultiWriter(file, sum))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if content := fmt.Sprintf("%x", sum.Sum(nil)); err == nil && content != strings.ToLower(hash) {
+		err = fmt.Errorf("blob %s has the content of %s", hash, content)
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// Fetch links name to the blob hash, see Get and Link
+func (c *Cache) Fetch(hash, name string, download func(w io.Writer) error) error {
+	for retry := true; ; retry = false {
+		if _, err := c.Get(hash, download); err != nil {
+			return err
+		}
+
+		// the blob can be cleaned between the two when nothing links
+		// to it yet
+		err := c.Link(hash, name)
+		if os.IsNotExist(err) && retry {
+			continue
+		}
+		return err
+	}
+}
+
+// Link makes name a link to the cached blob hash. If the cache and name are
+// on different filesystems the blob is copied instead.
+func (c *Cache) Link(hash, name string) error {
+	blob := c.Path(hash)
+	err := os.Link(blob, name)
+	if err == nil || os.IsExist(err) {
+		return nil
+	}
+
+	if lerr, ok := err.(*os.LinkError); !ok || lerr.Err != syscall.EXDEV {
+		return err
+	}
+
+	log.Debugf("Can't link blob %s to '%s', copying it", hash, name)
+	return copyFile(blob, name)
+}
+
+// Linked returns true if name is a link to the cached blob hash, a nil cache
+// has no blobs
+func (c *Cache) Linked(hash, name string) bool {
+	if c == nil || validHash(hash) != nil {
+		return false
+	}
+
+	blob, err := os.Stat(c.Path(hash))
+	if err != nil {
+		return false
+	}
+
+	file, err := os.Lstat(name)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(blob, file)
+}
+
+// Unlink replaces name, a link to a blob, with a copy of its own so it can be
+// changed without changing the blob
+func (c *Cache) Unlink(name string) error {
+	file, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".copy")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	file.Close()
+
+	if err := copyFile(name, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// Drop removes the blob hash if no file links to it anymore, and returns
+// true if it did
+func (c *Cache) Drop(hash string) bool {
+	if c == nil || validHash(hash) != nil {
+		return false
+	}
+
+	name := c.Path(hash)
+	info, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+
+	if sys, ok := info.Sys().(*syscall.Stat_t); !ok || sys.Nlink > 1 {
+		return false
+	}
+
+	if err := os.Remove(name); err != nil {
+		log.Warningf("Failed to remove blob '%s': %s", name, err)
+		return false
+	}
+	return true
+}
+
+// copyFile copies the content of src to dst, with its mode
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type blobFile struct {
+	name     string
+	size     int64
+	accessed time.Time
+}
+
+type byAccess []blobFile
+
+func (b byAccess) Len() int           { return len(b) }
+func (b byAccess) Less(i, j int) bool { return b[i].accessed.After(b[j].accessed) }
+func (b byAccess) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Clean evicts the blobs no file links to anymore, keeping the most recently
+// used ones up to keep bytes
+func (c *Cache) Clean(keep int64) {
+	var unreferenced []blobFile
+	err := filepath.Walk(c.dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+
+		sys, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || sys.Nlink > 1 {
+			return nil
+		}
+
+		unreferenced = append(unreferenced, blobFile{
+			name:     name,
+			size:     sys.Blocks * 512,
+			accessed: time.Unix(sys.Atim.Unix()),
+		})
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to walk the blob cache '%s': %s", c.dir, err)
+		return
+	}
+
+	sort.Sort(byAccess(unreferenced))
+	var kept int64
+	removed := 0
+	for _, blob := range unreferenced {
+		if kept+blob.size <= keep {
+			kept += blob.size
+			continue
+		}
+
+		if err := os.Remove(blob.name); err != nil {
+			log.Warningf("Failed to remove blob '%s': %s", blob.name, err)
+			continue
+		}
+		removed++
+	}
+
+	log.Debugf("Removed %d unreferenced blobs from '%s'", removed, c.dir)
+}
+
+// Cleaner returns a job cleaning the cache, see Clean
+func (c *Cache) Cleaner(keep int64) func() {
+	return func() {
+		c.Clean(keep)
+	}
+}
@@ -0,0 +1,157 @@
+package blobs
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCache(t *testing.T) (*Cache, string, func()) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewCache(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache, dir, func() { os.RemoveAll(dir) }
+}
+
+// hashOf returns the blob hash of data
+func hashOf(data string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(data)))
+}
+
+func content(data string) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := io.WriteString(w, data)
+		return err
+	}
+}
+
+func TestGet(t *testing.T) {
+	cache, _, cleanup := testCache(t)
+	defer cleanup()
+
+	// concurrent gets download once
+	var downloads int32
+	release := make(chan struct{})
+	download := func(w io.Writer) error {
+		atomic.AddInt32(&downloads, 1)
+		<-release
+		return content("hello")(w)
+	}
+
+	hello := hashOf("hello")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name, err := cache.Get(hello, download)
+			if assert.NoError(t, err) {
+				data, _ := ioutil.ReadFile(name)
+				assert.Equal(t, "hello", string(data))
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), downloads)
+
+	// a cached blob isn't downloaded again
+	_, err := cache.Get(hello, content("other"))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), downloads)
+
+	// nor is a blob that is not its hash
+	other := hashOf("other")
+	_, err = cache.Get(other, content("not other"))
+	assert.Error(t, err)
+	assert.False(t, cache.Cached(other))
+
+	// a failed download leaves nothing behind
+	_, err = cache.Get("ef01", func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return fmt.Errorf("broken")
+	})
+	assert.Error(t, err)
+	entries, _ := ioutil.ReadDir(filepath.Dir(cache.Path("ef01")))
+	assert.Len(t, entries, 0)
+
+	for _, hash := range []string{"", "../x", ".hidden"} {
+		_, err := cache.Get(hash, content("x"))
+		assert.Error(t, err, hash)
+	}
+}
+
+func TestLink(t *testing.T) {
+	cache, dir, cleanup := testCache(t)
+	defer cleanup()
+
+	hello := hashOf("hello")
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	assert.NoError(t, cache.Fetch(hello, a, content("hello")))
+	assert.NoError(t, cache.Fetch(hello, b, content("hello")))
+	assert.True(t, cache.Linked(hello, a))
+	assert.True(t, cache.Linked(hello, b))
+
+	// a linked blob isn't removed
+	assert.False(t, cache.Drop(hello))
+
+	assert.NoError(t, cache.Unlink(a))
+	assert.False(t, cache.Linked(hello, a))
+	data, _ := ioutil.ReadFile(a)
+	assert.Equal(t, "hello", string(data))
+
+	var nilCache *Cache
+	assert.False(t, nilCache.Linked(hello, b))
+	assert.False(t, nilCache.Drop(hello))
+
+	os.Remove(b)
+	assert.True(t, cache.Drop(hello))
+	_, err := os.Stat(cache.Path(hello))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestClean(t *testing.T) {
+	cache, dir, cleanup := testCache(t)
+	defer cleanup()
+
+	linked := filepath.Join(dir, "linked")
+	assert.NoError(t, cache.Fetch(hashOf("linked"), linked, content("linked")))
+
+	// the unlinked blobs used last are kept
+	now := time.Now()
+	for i, data := range []string{"b", "c", "d"} {
+		name, err := cache.Get(hashOf(data), content(data))
+		if !assert.NoError(t, err) {
+			return
+		}
+		atime := now.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(name, atime, atime)
+	}
+
+	// room for one blob
+	var st syscall.Stat_t
+	syscall.Stat(cache.Path(hashOf("d")), &st)
+	cache.Clean(st.Blocks * 512)
+
+	for data, cached := range map[string]bool{"linked": true, "b": false, "c": false, "d": true} {
+		_, err := os.Stat(cache.Path(hashOf(data)))
+		assert.Equal(t, cached, err == nil, data)
+	}
+}
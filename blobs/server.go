@@ -0,0 +1,74 @@
+package blobs
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/g8os/fs/codec"
+	"github.com/g8os/fs/utils"
+)
+
+// Server serves the blobs of a cache to the peer nodes, like a store:
+// GET /<hash> returns the blob brotli encoded. The cache holds the blobs of
+// all the stores, so a server without User gives anyone reaching it the blobs
+// of the stores requiring an auth too.
+type Server struct {
+	Cache *Cache
+	// User and Password are required to download, when User is set
+	User     string
+	Password string
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !utils.Authorized(r, s.User, s.Password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="blobs"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	hash := strings.TrimPrefix(r.URL.Path, "/")
+	if validHash(hash) != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := os.Open(s.Cache.Path(hash))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Errorf("Failed to serve blob %s: %s", hash, err)
+		http.Error(w, "can't read blob", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", codec.Brotli.ContentType())
+	if r.Method == "HEAD" {
+		return
+	}
+
+	log.Debugf("Serving blob %s to %s", hash, r.RemoteAddr)
+	if err := encode(w, file); err != nil {
+		log.Warningf("Failed to serve blob %s to %s: %s", hash, r.RemoteAddr, err)
+	}
+}
+
+// encode writes the blob r brotli encoded to w, like the stores serve it
+func encode(w io.Writer, r io.Reader) error {
+	bw, err := codec.Brotli.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(bw, r); err != nil {
+		return err
+	}
+	return bw.Close()
+}
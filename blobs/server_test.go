@@ -0,0 +1,71 @@
+package blobs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dsnet/compress/brotli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeHTTP(t *testing.T) {
+	cache, _, cleanup := testCache(t)
+	defer cleanup()
+
+	hello := hashOf("hello")
+	_, err := cache.Get(hello, content("hello"))
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(&Server{Cache: cache})
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/" + hello)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "application/brotli", response.Header.Get("Content-Type"))
+
+	r, err := brotli.NewReader(response.Body, nil)
+	if assert.NoError(t, err) {
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+	}
+
+	for _, path := range []string{"/missing", "/", "/.hidden"} {
+		response, err := http.Get(server.URL + path)
+		if assert.NoError(t, err) {
+			response.Body.Close()
+			assert.Equal(t, http.StatusNotFound, response.StatusCode, path)
+		}
+	}
+}
+
+func TestServeHTTPAuth(t *testing.T) {
+	cache, _, cleanup := testCache(t)
+	defer cleanup()
+
+	hello := hashOf("hello")
+	_, err := cache.Get(hello, content("hello"))
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(&Server{Cache: cache, User: "peer", Password: "secret"})
+	defer server.Close()
+
+	for auth, code := range map[string]int{
+		"":             http.StatusUnauthorized,
+		"peer:other@":  http.StatusUnauthorized,
+		"peer:secret@": http.StatusOK,
+	} {
+		response, err := http.Get(strings.Replace(server.URL, "://", "://"+auth, 1) + "/" + hello)
+		if assert.NoError(t, err) {
+			response.Body.Close()
+			assert.Equal(t, code, response.StatusCode, auth)
+		}
+	}
+}
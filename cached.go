@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+func cachedUsage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s cached:\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s cached -admin URL [-path PATH] [-missing] MOUNT\n", progName)
+}
+
+// cachedCommand lists the cached and missing files of a mount from the admin
+// API of the daemon, and returns the process exit code
+func cachedCommand(args []string) int {
+	flags := flag.NewFlagSet("cached", flag.ExitOnError)
+	admin := flags.String("admin", "", "URL of the admin API, with the -admin-auth of the daemon in its user info")
+	path := flags.String("path", "", "list the files under this path only")
+	missing := flags.Bool("missing", false, "list the missing files only")
+	flags.Parse(args)
+
+	if *admin == "" || flags.NArg() != 1 {
+		cachedUsage()
+		return 2
+	}
+
+	if err := listCached(*admin, flags.Arg(0), *path, *missing, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// listCached writes the cached and missing files of mount under path, as the
+// admin API at admin lists them, to out
+func listCached(admin, mount, path string, missing bool, out io.Writer) error {
+	u, err := url.Parse(strings.TrimRight(admin, "/") + "/cached")
+	if err != nil {
+		return fmt.Errorf("invalid admin URL: %s", err)
+	}
+	query := url.Values{"mount": {mount}}
+	if path != "" {
+		query.Set("path", path)
+	}
+	if missing {
+		query.Set("missing", "1")
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("can't list the cached files of %s (%d): %s", mount, response.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	_, err = io.Copy(out, response.Body)
+	return err
+}
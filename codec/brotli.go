@@ -0,0 +1,544 @@
+package codec
+
+import (
+	"container/heap"
+	"errors"
+	"io"
+)
+
+var errClosed = errors.New("brotli: writer is closed")
+
+const (
+	// maxBlock is the most data of a meta-block with a 4 nibbles length
+	maxBlock = 1 << 16
+	// maxDistance is the window of a stream with WBITS=16
+	maxDistance = 1<<16 - 16
+
+	minMatch  = 4
+	hashBits  = 15
+	maxChain  = 32
+	noPos     = -1
+	litBits   = 8  // bits of a literal in a simple prefix code
+	cmdBits   = 10 // bits of an insert and copy length code
+	distBits  = 6  // bits of a distance code
+	numCmds   = 704
+	numDists  = 64
+	maxLength = 15 // longest code of a symbol
+	maxCLen   = 5  // longest code of a code length
+)
+
+// insertRanges and copyRanges are the base and extra bits of the insert and
+// copy length codes (RFC 7932 section 5)
+var (
+	insertRanges = [24]struct{ base, bits uint32 }{
+		{0, 0}, {1, 0}, {2, 0}, {3, 0}, {4, 0}, {5, 0}, {6, 1}, {8, 1},
+		{10, 2}, {14, 2}, {18, 3}, {26, 3}, {34, 4}, {50, 4}, {66, 5}, {98, 5},
+		{130, 6}, {194, 7}, {322, 8}, {578, 9}, {1090, 10}, {2114, 12}, {6210, 14}, {22594, 24},
+	}
+	copyRanges = [24]struct{ base, bits uint32 }{
+		{2, 0}, {3, 0}, {4, 0}, {5, 0}, {6, 0}, {7, 0}, {8, 0}, {9, 0},
+		{10, 1}, {12, 1}, {14, 2}, {18, 2}, {22, 3}, {30, 3}, {38, 4}, {54, 4},
+		{70, 5}, {102, 5}, {134, 6}, {198, 7}, {326, 8}, {582, 9}, {1094, 10}, {2118, 24},
+	}
+	// cmdBases is the first insert and copy length code of the cells with an
+	// explicit distance, by insert code / 8 and copy code / 8
+	cmdBases = [3][3]int{
+		{128, 192, 384},
+		{256, 320, 512},
+		{448, 576, 640},
+	}
+	// cLenOrder is the order of the code lengths of a complex prefix code
+	cLenOrder = [18]int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	// cLenCodes are the bits and lengths of the fixed code of the code lengths
+	cLenCodes = [6]struct{ bits, n uint }{{0, 2}, {7, 4}, {3, 3}, {2, 2}, {1, 2}, {15, 4}}
+)
+
+// bitWriter packs bits starting from the least significant one, like brotli
+type bitWriter struct {
+	buf []byte
+	acc uint64
+	n   uint
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	w.acc |= v << w.n
+	w.n += n
+	for w.n >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.n -= 8
+	}
+}
+
+// align pads with zeros to the next byte boundary
+func (w *bitWriter) align() {
+	if w.n > 0 {
+		w.writeBits(0, 8-w.n)
+	}
+}
+
+func (w *bitWriter) append(o *bitWriter) {
+	for _, b := range o.buf {
+		w.writeBits(uint64(b), 8)
+	}
+	w.writeBits(o.acc, o.n)
+}
+
+// command inserts literals then copies from a distance back, the last command
+// of a block may only insert
+type command struct {
+	start, insert int
+	copy, dist    int
+}
+
+// brotliWriter writes a brotli stream with a 64KB window. Each meta-block is
+// compressed with LZ77 matches inside the block and its own prefix codes, or
+// stored uncompressed if that is smaller.
+type brotliWriter struct {
+	w     io.Writer
+	bits  bitWriter
+	buf   []byte
+	first bool
+	err   error
+}
+
+func (b *brotliWriter) Write(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		if len(b.buf) == maxBlock {
+			if b.err = b.flush(); b.err != nil {
+				return 0, b.err
+			}
+		}
+
+		room := maxBlock - len(b.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		b.buf = append(b.buf, p[:room]...)
+		p = p[room:]
+	}
+	return n, nil
+}
+
+// Close writes the last meta-block, it doesn't close the underlying writer
+func (b *brotliWriter) Close() error {
+	if b.err == nil && len(b.buf) > 0 {
+		b.err = b.flush()
+	}
+	if b.err != nil {
+		return b.err
+	}
+
+	b.header()
+	// ISLAST=1 and ISLASTEMPTY=1
+	b.bits.writeBits(3, 2)
+	b.bits.align()
+	err := b.output()
+	b.err = errClosed
+	return err
+}
+
+// header writes the stream header before the first meta-block
+func (b *brotliWriter) header() {
+	if b.first {
+		// WBITS=16
+		b.bits.writeBits(0, 1)
+		b.first = false
+	}
+}
+
+// output writes the complete bytes to the underlying writer
+func (b *brotliWriter) output() error {
+	_, err := b.w.Write(b.bits.buf)
+	b.bits.buf = b.bits.buf[:0]
+	return err
+}
+
+// flush writes the buffer as a meta-block, compressed unless it doesn't get
+// smaller
+func (b *brotliWriter) flush() error {
+	b.header()
+
+	compressed := compressBlock(b.buf)
+	if len(compressed.buf) < len(b.buf) {
+		b.bits.append(compressed)
+	} else {
+		// ISLAST=0, MNIBBLES=4, MLEN-1, ISUNCOMPRESSED=1, then padding to
+		// the byte boundary
+		b.bits.writeBits(0, 3)
+		b.bits.writeBits(uint64(len(b.buf)-1), 16)
+		b.bits.writeBits(1, 1)
+		b.bits.align()
+		b.bits.buf = append(b.bits.buf, b.buf...)
+	}
+
+	b.buf = b.buf[:0]
+	return b.output()
+}
+
+// compressBlock returns the bits of a compressed meta-block of data, which
+// holds at most maxBlock bytes
+func compressBlock(data []byte) *bitWriter {
+	commands := findMatches(data)
+
+	litCounts := make([]int, 256)
+	cmdCounts := make([]int, numCmds)
+	distCounts := make([]int, numDists)
+	type coded struct {
+		cmd, dist                  int
+		insExtra, cpyExtra, dExtra uint64
+		insBits, cpyBits, dBits    uint
+	}
+	codes := make([]coded, len(commands))
+
+	for i, c := range commands {
+		for _, l := range data[c.start : c.start+c.insert] {
+			litCounts[l]++
+		}
+
+		insCode := rangeCode(insertRanges[:], c.insert)
+		cpyCode := 0
+		if c.copy != 0 {
+			cpyCode = rangeCode(copyRanges[:], c.copy)
+		}
+		code := &codes[i]
+		code.cmd = cmdBases[insCode>>3][cpyCode>>3] + (insCode&7)<<3 + cpyCode&7
+		code.insExtra = uint64(uint32(c.insert) - insertRanges[insCode].base)
+		code.insBits = uint(insertRanges[insCode].bits)
+		cmdCounts[code.cmd]++
+
+		if c.copy == 0 {
+			continue
+		}
+		code.cpyExtra = uint64(uint32(c.copy) - copyRanges[cpyCode].base)
+		code.cpyBits = uint(copyRanges[cpyCode].bits)
+		code.dist, code.dExtra, code.dBits = distanceCode(c.dist)
+		distCounts[code.dist]++
+	}
+
+	litLens := huffmanLengths(litCounts, maxLength)
+	cmdLens := huffmanLengths(cmdCounts, maxLength)
+	distLens := huffmanLengths(distCounts, maxLength)
+
+	w := &bitWriter{}
+	// ISLAST=0, MNIBBLES=4, MLEN-1, ISUNCOMPRESSED=0
+	w.writeBits(0, 3)
+	w.writeBits(uint64(len(data)-1), 16)
+	w.writeBits(0, 1)
+	// a single block type for the literals, the commands and the distances
+	w.writeBits(0, 3)
+	// NPOSTFIX=0, NDIRECT=0, the context mode of the literals
+	w.writeBits(0, 2+4+2)
+	// a single prefix code for the literals and the distances
+	w.writeBits(0, 2)
+
+	writePrefixCode(w, litCounts, litLens, litBits)
+	writePrefixCode(w, cmdCounts, cmdLens, cmdBits)
+	writePrefixCode(w, distCounts, distLens, distBits)
+
+	litCodes := canonicalCodes(litLens)
+	cmdCodes := canonicalCodes(cmdLens)
+	distCodes := canonicalCodes(distLens)
+
+	for i, c := range commands {
+		code := codes[i]
+		w.writeBits(cmdCodes[code.cmd], uint(cmdLens[code.cmd]))
+		w.writeBits(code.insExtra, code.insBits)
+		w.writeBits(code.cpyExtra, code.cpyBits)
+		for _, l := range data[c.start : c.start+c.insert] {
+			w.writeBits(litCodes[l], uint(litLens[l]))
+		}
+		if c.copy != 0 {
+			w.writeBits(distCodes[code.dist], uint(distLens[code.dist]))
+			w.writeBits(code.dExtra, code.dBits)
+		}
+	}
+
+	return w
+}
+
+// findMatches splits data in commands, with a hash chain of the positions of
+// each 4 bytes sequence
+func findMatches(data []byte) []command {
+	var head [1 << hashBits]int32
+	for i := range head {
+		head[i] = noPos
+	}
+	prev := make([]int32, len(data))
+
+	hash := func(i int) uint32 {
+		v := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		return (v * 0x1e35a7bd) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		h := hash(i)
+		prev[i] = head[h]
+		head[h] = int32(i)
+	}
+
+	var commands []command
+	start := 0
+	for i := 0; i+minMatch <= len(data); {
+		best, dist := 0, 0
+		for j, chain := head[hash(i)], 0; j != noPos && chain < maxChain; j, chain = prev[j], chain+1 {
+			if i-int(j) > maxDistance {
+				break
+			}
+			n := 0
+			for i+n < len(data) && data[int(j)+n] == data[i+n] {
+				n++
+			}
+			if n > best {
+				best, dist = n, i-int(j)
+			}
+		}
+
+		if best < minMatch {
+			insert(i)
+			i++
+			continue
+		}
+
+		commands = append(commands, command{start: start, insert: i - start, copy: best, dist: dist})
+		for end := i + best; i < end; i++ {
+			if i+minMatch <= len(data) {
+				insert(i)
+			}
+		}
+		start = i
+	}
+
+	if start < len(data) {
+		commands = append(commands, command{start: start, insert: len(data) - start})
+	}
+	return commands
+}
+
+// rangeCode returns the code of the range holding n
+func rangeCode(ranges []struct{ base, bits uint32 }, n int) int {
+	code := len(ranges) - 1
+	for code > 0 && ranges[code].base > uint32(n) {
+		code--
+	}
+	return code
+}
+
+// distanceCode returns the code and extra bits of a distance, with no direct
+// distance codes and no postfix bits
+func distanceCode(dist int) (int, uint64, uint) {
+	x := uint(dist + 3)
+	top := uint(0)
+	for x>>(top+1) != 0 {
+		top++
+	}
+	n := top - 1
+	h := (x >> n) & 1
+	return 16 + 2*int(n-1) + int(h), uint64(x & (1<<n - 1)), n
+}
+
+// huffNode is a leaf (a symbol) or the join of two nodes of a prefix code
+type huffNode struct {
+	count       int
+	symbol      int
+	left, right *huffNode
+}
+
+type huffHeap []*huffNode
+
+func (h huffHeap) Len() int { return len(h) }
+func (h huffHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].symbol < h[j].symbol
+}
+func (h huffHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *huffHeap) Push(x interface{}) { *h = append(*h, x.(*huffNode)) }
+func (h *huffHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// huffmanLengths returns the code length of each symbol, no longer than limit.
+// The counts are raised to a floor until the code fits. A single used symbol
+// gets a length of 0, and no used symbol gives all 0.
+func huffmanLengths(counts []int, limit uint8) []uint8 {
+	lengths := make([]uint8, len(counts))
+	for floor := 1; ; floor *= 2 {
+		h := &huffHeap{}
+		for symbol, count := range counts {
+			if count == 0 {
+				continue
+			}
+			if count < floor {
+				count = floor
+			}
+			*h = append(*h, &huffNode{count: count, symbol: symbol})
+		}
+		if h.Len() < 2 {
+			return lengths
+		}
+
+		heap.Init(h)
+		for h.Len() > 1 {
+			left := heap.Pop(h).(*huffNode)
+			right := heap.Pop(h).(*huffNode)
+			heap.Push(h, &huffNode{count: left.count + right.count, symbol: len(counts), left: left, right: right})
+		}
+
+		if depths(heap.Pop(h).(*huffNode), 0, lengths) <= limit {
+			return lengths
+		}
+	}
+}
+
+// depths sets the lengths of the symbols under node and returns the longest
+func depths(node *huffNode, depth uint8, lengths []uint8) uint8 {
+	if node.left == nil {
+		lengths[node.symbol] = depth
+		return depth
+	}
+	left := depths(node.left, depth+1, lengths)
+	if right := depths(node.right, depth+1, lengths); right > left {
+		return right
+	}
+	return left
+}
+
+// canonicalCodes returns the canonical code of each symbol, with the bits
+// reversed to be written from the least significant one
+func canonicalCodes(lengths []uint8) []uint64 {
+	var count [maxLength + 1]uint64
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+
+	var next [maxLength + 1]uint64
+	code := uint64(0)
+	for l := 1; l <= maxLength; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	codes := make([]uint64, len(lengths))
+	for symbol, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		for i := uint8(0); i < l; i++ {
+			codes[symbol] = codes[symbol]<<1 | (c>>i)&1
+		}
+	}
+	return codes
+}
+
+// writePrefixCode writes the code lengths of an alphabet: a simple prefix
+// code for one or two used symbols, otherwise a complex prefix code
+func writePrefixCode(w *bitWriter, counts []int, lengths []uint8, alphabetBits uint) {
+	var used []int
+	for symbol, count := range counts {
+		if count != 0 {
+			used = append(used, symbol)
+		}
+	}
+
+	if len(used) < 3 {
+		if len(used) == 0 {
+			// nothing is coded with it, any single symbol will do
+			used = []int{0}
+		}
+		// HSKIP=1, NSYM-1
+		w.writeBits(1, 2)
+		w.writeBits(uint64(len(used)-1), 2)
+		for _, symbol := range used {
+			w.writeBits(uint64(symbol), alphabetBits)
+		}
+		return
+	}
+
+	// the code lengths, up to the last used symbol, with the runs of zeros
+	// coded with 17 and 3 extra bits
+	type clen struct {
+		symbol int
+		extra  uint64
+	}
+	var clens []clen
+	last := used[len(used)-1]
+	for i := 0; i <= last; {
+		if lengths[i] != 0 {
+			clens = append(clens, clen{symbol: int(lengths[i])})
+			i++
+			continue
+		}
+
+		run := 0
+		for i+run <= last && lengths[i+run] == 0 {
+			run++
+		}
+		i += run
+		if run < 3 {
+			for ; run > 0; run-- {
+				clens = append(clens, clen{})
+			}
+			continue
+		}
+
+		// a repeated 17 multiplies the previous repeat count by 8, so the
+		// run is written from its most significant 3 bits
+		var reps []clen
+		for run -= 3; ; run-- {
+			reps = append(reps, clen{symbol: 17, extra: uint64(run & 7)})
+			if run >>= 3; run == 0 {
+				break
+			}
+		}
+		for j := len(reps) - 1; j >= 0; j-- {
+			clens = append(clens, reps[j])
+		}
+	}
+
+	cCounts := make([]int, len(cLenOrder))
+	for _, c := range clens {
+		cCounts[c.symbol]++
+	}
+	cLens := huffmanLengths(cCounts, maxCLen)
+	if cLens[clens[0].symbol] == 0 {
+		// a single code length: make a complete code of 2 symbols
+		other := 0
+		if clens[0].symbol == 0 {
+			other = 1
+		}
+		cLens[clens[0].symbol], cLens[other] = 1, 1
+	}
+
+	// HSKIP=0, then the code lengths in their order, up to the last used
+	w.writeBits(0, 2)
+	end := 0
+	for i, symbol := range cLenOrder {
+		if cLens[symbol] != 0 {
+			end = i + 1
+		}
+	}
+	for _, symbol := range cLenOrder[:end] {
+		code := cLenCodes[cLens[symbol]]
+		w.writeBits(uint64(code.bits), code.n)
+	}
+
+	cCodes := canonicalCodes(cLens)
+	for _, c := range clens {
+		w.writeBits(cCodes[c.symbol], uint(cLens[c.symbol]))
+		if c.symbol == 17 {
+			w.writeBits(c.extra, 3)
+		}
+	}
+}
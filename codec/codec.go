@@ -0,0 +1,130 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// Codec compresses the blobs of the stores
+type Codec interface {
+	// Name is the name of the codec in the config
+	Name() string
+	// ContentType is the media type of the blobs encoded with the codec
+	ContentType() string
+	NewReader(r io.Reader) (io.ReadCloser, error)
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+var (
+	Brotli Codec = brotliCodec{}
+	Zstd   Codec = zstdCodec{}
+	Gzip   Codec = gzipCodec{}
+	// None leaves the blobs as they are, for the content that's already
+	// compressed
+	None Codec = noneCodec{}
+
+	codecs = []Codec{Brotli, Zstd, Gzip, None}
+)
+
+// magics are the headers of the blobs of the codecs that have one
+var magics = map[Codec][]byte{
+	Zstd: {0x28, 0xb5, 0x2f, 0xfd},
+	Gzip: {0x1f, 0x8b},
+}
+
+const magicSize = 4
+
+// Get returns the codec name
+func Get(name string) (Codec, error) {
+	for _, c := range codecs {
+		if strings.EqualFold(c.Name(), name) {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec '%s', expected brotli, zstd, gzip or none", name)
+}
+
+// ForContentType returns the codec of a content type. The stores serving
+// brotli blobs as application/octet-stream predate the codecs, so it's not
+// taken for None.
+func ForContentType(contentType string) (Codec, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+
+	switch mediaType {
+	case "application/brotli", "application/x-brotli":
+		return Brotli, true
+	case "application/zstd":
+		return Zstd, true
+	case "application/gzip", "application/x-gzip":
+		return Gzip, true
+	}
+	return nil, false
+}
+
+// Sniff returns the codec of a blob from its first bytes, brotli has no
+// header so it's never found
+func Sniff(header []byte) (Codec, bool) {
+	for c, magic := range magics {
+		if bytes.HasPrefix(header, magic) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Detect returns the codec of the blob r, from its content type or else its
+// header, brotli if none tells. The blob is then read from the returned
+// reader.
+func Detect(r io.Reader, contentType string) (Codec, io.Reader) {
+	if c, ok := ForContentType(contentType); ok {
+		return c, r
+	}
+
+	buf := bufio.NewReader(r)
+	header, _ := buf.Peek(magicSize)
+	if c, ok := Sniff(header); ok {
+		return c, buf
+	}
+	return Brotli, buf
+}
+
+// NewReader decodes the blob r, see Detect
+func NewReader(r io.Reader, contentType string) (io.ReadCloser, error) {
+	c, r := Detect(r, contentType)
+	return c.NewReader(r)
+}
+
+// Encoded is a blob being encoded, read it to get the blob
+type Encoded struct {
+	*io.PipeReader
+	codec Codec
+}
+
+// ContentType returns the content type of the blob
+func (e *Encoded) ContentType() string {
+	return e.codec.ContentType()
+}
+
+// Encode returns the content of r encoded with c
+func Encode(c Codec, r io.Reader) *Encoded {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := c.NewWriter(pw)
+		if err == nil {
+			_, err = io.Copy(w, r)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return &Encoded{PipeReader: pr, codec: c}
+}
@@ -0,0 +1,126 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encode(t *testing.T, c Codec, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := c.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decode(t *testing.T, r io.ReadCloser, err error) []byte {
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestCodecs(t *testing.T) {
+	for _, size := range []int{0, 1, maxBlock, 2*maxBlock + 10} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+
+		for _, c := range codecs {
+			blob := encode(t, c, data)
+			r, err := c.NewReader(bytes.NewReader(blob))
+			assert.Equal(t, data, decode(t, r, err), "%s %d bytes", c.Name(), size)
+		}
+	}
+}
+
+func TestBrotli(t *testing.T) {
+	var text bytes.Buffer
+	for i := 0; text.Len() < 3*maxBlock; i++ {
+		fmt.Fprintf(&text, "/opt/jumpscale/lib/file%d.py|%d|root|root|644\n", i, i*i%1000)
+	}
+
+	// the compressible data shrinks
+	for _, data := range [][]byte{text.Bytes(), bytes.Repeat([]byte("ab"), 1000), make([]byte, 3*maxBlock)} {
+		blob := encode(t, Brotli, data)
+		r, err := Brotli.NewReader(bytes.NewReader(blob))
+		assert.Equal(t, data, decode(t, r, err), "%d bytes", len(data))
+		assert.True(t, len(blob) < len(data)/3, "%d bytes to %d", len(data), len(blob))
+	}
+
+	// any data round trips, the incompressible blocks are stored
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		data := make([]byte, random.Intn(2*maxBlock))
+		symbols := 1 + random.Intn(256)
+		for j := range data {
+			data[j] = byte(random.Intn(symbols))
+		}
+
+		blob := encode(t, Brotli, data)
+		r, err := Brotli.NewReader(bytes.NewReader(blob))
+		assert.Equal(t, data, decode(t, r, err), "%d bytes of %d symbols", len(data), symbols)
+		assert.True(t, len(blob) <= len(data)+len(data)/maxBlock*4+8, "%d bytes to %d", len(data), len(blob))
+	}
+}
+
+func TestDetect(t *testing.T) {
+	data := []byte("hello world")
+
+	// the header tells zstd and gzip, brotli is the default
+	for _, c := range []Codec{Brotli, Zstd, Gzip} {
+		r, err := NewReader(bytes.NewReader(encode(t, c, data)), "")
+		assert.Equal(t, data, decode(t, r, err), c.Name())
+	}
+
+	// the content type wins
+	r, err := NewReader(bytes.NewReader(encode(t, Brotli, data)), "application/brotli; q=1")
+	assert.Equal(t, data, decode(t, r, err))
+	c, _ := Detect(bytes.NewReader(encode(t, Gzip, data)), "application/zstd")
+	assert.Equal(t, Zstd, c)
+
+	// application/octet-stream isn't taken for none
+	c, _ = Detect(bytes.NewReader(data), "application/octet-stream")
+	assert.Equal(t, Brotli, c)
+}
+
+func TestGet(t *testing.T) {
+	for _, c := range codecs {
+		got, err := Get(c.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, c, got)
+	}
+
+	c, err := Get("ZSTD")
+	assert.NoError(t, err)
+	assert.Equal(t, Zstd, c)
+
+	_, err = Get("lzma")
+	assert.Error(t, err)
+}
+
+func TestEncode(t *testing.T) {
+	blob := Encode(Zstd, bytes.NewReader([]byte("hello")))
+	assert.Equal(t, "application/zstd", blob.ContentType())
+
+	r, err := NewReader(blob, blob.ContentType())
+	assert.Equal(t, "hello", string(decode(t, r, err)))
+}
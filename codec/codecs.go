@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/dsnet/compress/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+type brotliCodec struct{}
+
+func (brotliCodec) Name() string        { return "brotli" }
+func (brotliCodec) ContentType() string { return "application/brotli" }
+
+func (brotliCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return brotli.NewReader(r, nil)
+}
+
+// NewWriter returns our own encoder, the brotli library only decodes
+func (brotliCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return &brotliWriter{w: w, first: true}, nil
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string        { return "zstd" }
+func (zstdCodec) ContentType() string { return "application/zstd" }
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string        { return "gzip" }
+func (gzipCodec) ContentType() string { return "application/gzip" }
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string        { return "none" }
+func (noneCodec) ContentType() string { return "application/octet-stream" }
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
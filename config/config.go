@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
+	"github.com/g8os/fs/codec"
 	"github.com/g8os/fs/crypto"
 	"github.com/g8os/fs/storage"
 	"github.com/naoina/toml"
@@ -22,20 +24,157 @@ const (
 	OL = "OL"
 )
 
+// What to do when the populate of a mount fails
+const (
+	// PopulateErrorServe keeps serving whatever was populated
+	PopulateErrorServe = "serve"
+	// PopulateErrorFail refuses the mount, or unmounts it if it's lazy
+	PopulateErrorFail = "fail"
+)
+
+// Ownership policies of the flist entries
+const (
+	// OwnersHost looks the owner names up in the host passwd and group databases
+	OwnersHost = "host"
+	// OwnersNumeric uses the owner columns of the flist as numeric ids
+	OwnersNumeric = "numeric"
+	// OwnersFlist maps the owner names through the passwd and group files of the flist
+	OwnersFlist = "flist"
+	// OwnersMap maps the owner names with the UidMap and GidMap tables
+	OwnersMap = "map"
+	// OwnersSquash owns everything by SquashUid and SquashGid
+	OwnersSquash = "squash"
+)
+
+// Cache eviction policies of a backend
+const (
+	// CacheLRU evicts the least recently used files first
+	CacheLRU = "lru"
+	// CacheLFU evicts the least frequently used files first
+	CacheLFU = "lfu"
+	// CacheTTL evicts the files fetched the longest time ago first
+	CacheTTL = "ttl"
+)
+
 type Config struct {
+	// Bandwidth limits the downloads from all the stores, in kilobytes per
+	// second, 0 is unlimited
+	Bandwidth int `toml:",omitempty"`
+
+	// BlobCache is the directory of the blob cache shared by the mounts, the
+	// cached files of the backends on its filesystem are links to its
+	// blobs. No blob cache is used when it's empty.
+	BlobCache string `toml:",omitempty"`
+	// BlobCacheKeep is the space kept for the blobs no cached file links to
+	// anymore, in megabytes
+	BlobCacheKeep int `toml:",omitempty"`
+	// BlobCacheCron is when the unlinked blobs are cleaned, every hour by
+	// default
+	BlobCacheCron string `toml:",omitempty"`
+	// ServeBlobs is the address the blob cache is served on to the peer
+	// nodes, it's not served when empty
+	ServeBlobs string `toml:",omitempty"`
+	// ServeBlobsAuth is the USER:PASSWORD basic auth the peer nodes need to
+	// get the blobs, required when a store has an auth
+	ServeBlobsAuth string `toml:",omitempty"`
+
 	Mount   []Mount
 	Backend map[string]Backend
 	Stor    map[string]StorConfig
 }
 
 type Mount struct {
-	Path     string
-	Flist    string
+	Path  string
+	Flist string
+	// Layers are extra flists stacked on top of Flist, in order. Later
+	// layers override the earlier ones.
+	Layers   []string `toml:",omitempty"`
 	Backend  string
 	Mode     string
 	Stor     string `toml:",omitempty"`
 	TrimBase bool
 	Trim     string
+	// Lenient skips malformed flist lines instead of failing the populate
+	Lenient bool `toml:",omitempty"`
+	// Lazy mounts at once and populates the meta in the background, paths
+	// are resolved on demand until the populate is over
+	Lazy bool `toml:",omitempty"`
+	// OnPopulateError is serve (default) or fail
+	OnPopulateError string `toml:",omitempty"`
+	// PopulateWorkers is the number of goroutines parsing the flists and
+	// writing the meta, defaults to the number of CPUs
+	PopulateWorkers int `toml:",omitempty"`
+	// Include only mounts the flist paths matching one of these globs, and
+	// Exclude hides the flist paths matching one of them ("**" matches any
+	// number of directories).
+	Include []string `toml:",omitempty"`
+	Exclude []string `toml:",omitempty"`
+	// Rewrite maps flist path prefixes to mount path prefixes
+	Rewrite map[string]string `toml:",omitempty"`
+
+	// Pin are globs of mount paths prefetched once the mount is populated
+	// and never evicted from the cache, PinFile is a file listing more of
+	// them, one per line
+	Pin     []string `toml:",omitempty"`
+	PinFile string   `toml:",omitempty"`
+
+	// Record records the files opened during the first that many seconds
+	// of the mount, and writes them as the prefetch profile of the flist.
+	// RecordRanges also records the byte ranges read, the replay then skips
+	// the files opened but never read.
+	Record       int  `toml:",omitempty"`
+	RecordRanges bool `toml:",omitempty"`
+	// ReplayWorkers is the number of files downloaded at once when the
+	// prefetch profile of the flist is replayed, defaults to 4
+	ReplayWorkers int `toml:",omitempty"`
+
+	// Offline starts the mount offline: only the cached files can be
+	// opened, see the admin API to switch it at runtime
+	Offline bool `toml:",omitempty"`
+
+	// DefaultPermissions is deprecated: the mounts are shared by all the
+	// users, so the kernel always enforces the file permissions on every
+	// operation. It's kept for the configs that set it.
+	DefaultPermissions bool `toml:",omitempty"`
+
+	// Owners is the ownership policy (host, numeric, flist, map or squash),
+	// defaults to host
+	Owners string `toml:",omitempty"`
+	// Passwd and Group are the paths of the passwd and group files in the
+	// flists used by the flist policy, before the filters of the mount
+	Passwd string `toml:",omitempty"`
+	Group  string `toml:",omitempty"`
+	// UidMap and GidMap are the name to id tables of the map policy
+	UidMap map[string]uint32 `toml:",omitempty"`
+	GidMap map[string]uint32 `toml:",omitempty"`
+	// SquashUid and SquashGid own all entries with the squash policy
+	SquashUid uint32 `toml:",omitempty"`
+	SquashGid uint32 `toml:",omitempty"`
+}
+
+// FailOnPopulateError returns true if the mount must not be served when its
+// populate fails
+func (m *Mount) FailOnPopulateError() bool {
+	return strings.EqualFold(m.OnPopulateError, PopulateErrorFail)
+}
+
+// FlistLayers returns all the flists of the mount, base layer first
+func (m *Mount) FlistLayers() []string {
+	var layers []string
+	if m.Flist != "" {
+		layers = append(layers, m.Flist)
+	}
+	return append(layers, m.Layers...)
+}
+
+// ProfilePath returns the path of the prefetch profile of the mount, next to
+// its top flist layer. It's empty if the mount has no flist.
+func (m *Mount) ProfilePath() string {
+	layers := m.FlistLayers()
+	if len(layers) == 0 {
+		return ""
+	}
+	return layers[len(layers)-1] + ".prefetch"
 }
 
 type Backend struct {
@@ -47,6 +186,20 @@ type Backend struct {
 	CleanupCron      string `toml:",omitempty"`
 	CleanupOlderThan int    `toml:",omitempty"`
 
+	// CacheSize is the maximum size of the cached files in megabytes, 0 is
+	// unlimited
+	CacheSize int `toml:",omitempty"`
+	// CacheHighWatermark and CacheLowWatermark are percents of CacheSize:
+	// files are evicted when the cache grows over the high watermark (90 by
+	// default) until it's under the low one (70 by default)
+	CacheHighWatermark int `toml:",omitempty"`
+	CacheLowWatermark  int `toml:",omitempty"`
+	// CachePolicy is the eviction order, lru (default), lfu or ttl
+	CachePolicy string `toml:",omitempty"`
+	// CacheCheckInterval runs the cleanup continuously, every that many
+	// seconds, instead of on CleanupCron
+	CacheCheckInterval int `toml:",omitempty"`
+
 	Log string
 
 	Encrypted bool   `toml:",omitempty"`
@@ -59,12 +212,55 @@ type Backend struct {
 
 type StorConfig struct {
 	Name string `toml:"-"`
+	// SpoolDir is the directory of the blobs spooled by the client, the
+	// backend directory of its mount
+	SpoolDir string `toml:"-"`
 
 	URL string
+	// Concurrency is the maximum of downloads at once from the store,
+	// defaults to 8
+	Concurrency int `toml:",omitempty"`
+	// Peers are the URLs of the blob caches of peer nodes, tried in order
+	// before URL
+	Peers []string `toml:",omitempty"`
+	// Codec is the codec of all the blobs of the store: brotli, zstd, gzip
+	// or none. When it's empty the codec of a blob is found from its
+	// content type or its header, or is brotli.
+	Codec string `toml:",omitempty"`
 }
 
 func (c *StorConfig) GetStorClient() (storage.Storage, error) {
-	u, err := url.Parse(c.URL)
+	stor, err := storClient(c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Codec != "" {
+		blobCodec, err := codec.Get(c.Codec)
+		if err != nil {
+			return nil, err
+		}
+		stor = storage.WithCodec(stor, blobCodec)
+	}
+
+	if len(c.Peers) == 0 {
+		return stor, nil
+	}
+
+	var peers []storage.Peer
+	for _, peer := range c.Peers {
+		client, err := storClient(peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer '%s': %s", peer, err)
+		}
+		peers = append(peers, storage.Peer{Name: peer, Stor: client})
+	}
+
+	return storage.NewPeerStorage(stor, peers, c.SpoolDir), nil
+}
+
+func storClient(rawurl string) (storage.Storage, error) {
+	u, err := url.Parse(rawurl)
 	if err != nil {
 		return nil, err
 	}
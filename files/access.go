@@ -0,0 +1,158 @@
+package files
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/g8os/fs/meta"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// access(2) mode bits
+const (
+	accessExec  = 1
+	accessWrite = 2
+	accessRead  = 4
+)
+
+// caller is the identity an access is checked against
+type caller struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
+}
+
+// newCaller returns the identity of the process of a fuse request, with its
+// supplementary groups
+func newCaller(context *fuse.Context) *caller {
+	c := &caller{
+		uid: context.Uid,
+		gid: context.Gid,
+	}
+
+	groups, err := processGroups(context.Pid)
+	if err != nil {
+		log.Debugf("Can't get the groups of process %d: %s", context.Pid, err)
+	}
+	c.groups = groups
+
+	return c
+}
+
+// processGroups reads the supplementary groups of a process from
+// /proc/PID/status
+func processGroups(pid uint32) ([]uint32, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+
+		var groups []uint32
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			gid, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid group '%s'", field)
+			}
+			groups = append(groups, uint32(gid))
+		}
+		return groups, nil
+	}
+
+	return nil, scanner.Err()
+}
+
+func (c *caller) inGroup(gid uint32) bool {
+	if c.gid == gid {
+		return true
+	}
+	for _, g := range c.groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed checks the access mode (a combination of the access(2) R, W and X
+// bits) to a file against its owner and permission bits.
+func (c *caller) allowed(md *meta.MetaData, mode uint32) bool {
+	mode &= accessRead | accessWrite | accessExec
+	if mode == 0 {
+		return true
+	}
+
+	perms := md.Permissions & 0777
+	if c.uid == 0 {
+		// root can read and write anything, and execute what can be
+		// executed by anyone
+		if mode&accessExec == 0 || md.Filetype == syscall.S_IFDIR {
+			return true
+		}
+		return perms&0111 != 0
+	}
+
+	var granted uint32
+	switch {
+	case c.uid == md.Uid:
+		granted = perms >> 6
+	case c.inGroup(md.Gid):
+		granted = perms >> 3
+	default:
+		granted = perms
+	}
+
+	return granted&mode == mode
+}
+
+// checkAccess checks that the caller can search all the parent directories
+// of name, and has the access mode to name itself
+func (fs *fileSystem) checkAccess(c *caller, name string, mode uint32) fuse.Status {
+	name = strings.Trim(path.Clean("/"+name), "/")
+
+	dir := ""
+	if name != "" {
+		for _, part := range strings.Split(path.Dir(name), "/") {
+			if part == "." {
+				break
+			}
+			dir = path.Join(dir, part)
+			_, md, st := fs.Meta(dir)
+			if st != fuse.OK {
+				return st
+			}
+			if !c.allowed(md, accessExec) {
+				return fuse.EACCES
+			}
+		}
+	}
+
+	_, md, st := fs.Meta(name)
+	if st != fuse.OK {
+		return st
+	}
+
+	if !c.allowed(md, mode) {
+		return fuse.EACCES
+	}
+
+	return fuse.OK
+}
+
+// Access checks the permissions of the caller against the meta data
+func (fs *fileSystem) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	log.Debugf("Access %v %o", name, mode)
+	return fs.checkAccess(newCaller(context), name, mode)
+}
@@ -0,0 +1,63 @@
+package files
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/g8os/fs/meta"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallerAllowed(t *testing.T) {
+	file := &meta.MetaData{Filetype: syscall.S_IFREG, Permissions: 0640, Uid: 1000, Gid: 100}
+
+	owner := &caller{uid: 1000, gid: 1000}
+	assert.True(t, owner.allowed(file, accessRead|accessWrite))
+	assert.False(t, owner.allowed(file, accessExec))
+
+	member := &caller{uid: 1001, gid: 1001, groups: []uint32{50, 100}}
+	assert.True(t, member.allowed(file, accessRead))
+	assert.False(t, member.allowed(file, accessWrite))
+
+	other := &caller{uid: 1002, gid: 1002}
+	assert.False(t, other.allowed(file, accessRead))
+	assert.True(t, other.allowed(file, 0))
+
+	root := &caller{}
+	assert.True(t, root.allowed(file, accessRead|accessWrite))
+	assert.False(t, root.allowed(file, accessExec))
+	assert.True(t, root.allowed(&meta.MetaData{Filetype: syscall.S_IFREG, Permissions: 0001}, accessExec))
+}
+
+func TestProcessGroups(t *testing.T) {
+	groups, err := processGroups(uint32(os.Getpid()))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	expected, err := os.Getgroups()
+	if assert.NoError(t, err) {
+		assert.Len(t, groups, len(expected))
+	}
+}
+
+func TestAccess(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	private, _ := fs.meta.CreateDir("private")
+	private.Save(&meta.MetaData{Filetype: syscall.S_IFDIR, Permissions: 0700, Uid: 1000})
+	secret, _ := fs.meta.CreateFile("private/secret")
+	secret.Save(&meta.MetaData{Filetype: syscall.S_IFREG, Permissions: 0644, Uid: 1000})
+
+	owner := &caller{uid: 1000, gid: 1000}
+	other := &caller{uid: 1001, gid: 1001}
+
+	assert.Equal(t, fuse.OK, fs.checkAccess(owner, "private/secret", accessRead|accessWrite))
+	// the file is world readable, but its directory can't be searched
+	assert.Equal(t, fuse.EACCES, fs.checkAccess(other, "private/secret", accessRead))
+	assert.Equal(t, fuse.EACCES, fs.checkAccess(other, "private", accessExec))
+	assert.Equal(t, fuse.ENOENT, fs.checkAccess(owner, "private/missing", 0))
+}
@@ -0,0 +1,95 @@
+package files
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/g8os/fs/blobs"
+	"github.com/g8os/fs/meta"
+	"github.com/g8os/fs/storage"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingStorage struct {
+	storage.Storage
+	gets int
+}
+
+func (s *countingStorage) Get(key string) (io.ReadCloser, error) {
+	s.gets++
+	return s.Storage.Get(key)
+}
+
+// hashOf returns the blob hash of data
+func hashOf(data string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(data)))
+}
+
+func TestBlobCache(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	cache, err := blobs.NewCache(filepath.Join(fs.Root, ".blobs"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	hello := hashOf("hello world")
+	stor := &countingStorage{Storage: memStorage{hello: brotliStored([]byte("hello world"))}}
+	fs.stor, fs.blobs = stor, cache
+
+	// the same content under two paths is downloaded once
+	flistFile(t, fs, "a", hello, 11)
+	m := flistFile(t, fs, "b", hello, 11)
+	for _, name := range []string{"a", "b"} {
+		_, _, st := fs.fetch(name)
+		assert.Equal(t, fuse.OK, st)
+		assert.True(t, cache.Linked(hello, fs.GetPath(name)), name)
+	}
+	assert.Equal(t, 1, stor.gets)
+
+	// the attributes come from the meta, not the shared blob
+	attr, st := fs.GetAttr("b", &fuse.Context{})
+	if assert.Equal(t, fuse.OK, st) {
+		assert.Equal(t, uint32(0644), attr.Mode&07777)
+		assert.Equal(t, uint64(11), attr.Size)
+	}
+
+	// a change applies to a copy
+	_, _, st = fs.copyUp("b")
+	assert.Equal(t, fuse.OK, st)
+	assert.True(t, m.Stat().Modified())
+	assert.False(t, cache.Linked(hello, fs.GetPath("b")))
+	assert.NoError(t, ioutil.WriteFile(fs.GetPath("b"), []byte("changed"), 0644))
+
+	data, _ := ioutil.ReadFile(fs.GetPath("a"))
+	assert.Equal(t, "hello world", string(data))
+
+	// encrypted backends don't share the blobs
+	assert.True(t, fs.linkBlobs(&meta.MetaData{Hash: "aa"}))
+	fs.backend.Encrypted = true
+	assert.False(t, fs.linkBlobs(&meta.MetaData{Hash: "aa"}))
+}
+
+func TestBlobCacheCorrupted(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	cache, err := blobs.NewCache(filepath.Join(fs.Root, ".blobs"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	hello := hashOf("hello world")
+	fs.stor = memStorage{hello: brotliStored([]byte("not hello"))}
+	fs.blobs = cache
+
+	// the content of a store is not shared if it's not the blob
+	flistFile(t, fs, "a", hello, 11)
+	_, _, st := fs.fetch("a")
+	assert.Equal(t, fuse.EIO, st)
+	assert.False(t, cache.Cached(hello))
+}
@@ -0,0 +1,123 @@
+package files
+
+import (
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/g8os/fs/meta"
+	"github.com/g8os/fs/storage"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// fetch makes sure the content of name is in the backend, downloading it
+// (and creating its parent directories) if needed.
+func (fs *fileSystem) fetch(name string) (meta.Meta, *meta.MetaData, fuse.Status) {
+	return fs.fetchFrom(name, fs.stor)
+}
+
+// fetchFrom is fetch downloading from stor, which sets the priority of the
+// download
+func (fs *fileSystem) fetchFrom(name string, stor storage.Storage) (meta.Meta, *meta.MetaData, fuse.Status) {
+	m, md, st := fs.Meta(name)
+	if st != fuse.OK {
+		return nil, nil, st
+	}
+
+	if metaOnly(md.Filetype) || fs.checkExist(fs.GetPath(name)) {
+		return m, md, fuse.OK
+	}
+
+	if st := fs.populateDirFile(path.Dir(name)); st != fuse.OK {
+		return nil, nil, st
+	}
+
+	switch md.Filetype {
+	case syscall.S_IFDIR:
+		if st := fs.populateDirFile(name); st != fuse.OK {
+			return nil, nil, st
+		}
+	case syscall.S_IFREG:
+		if fs.offline.On() && !fs.blobCached(md) {
+			log.Debugf("Offline, not downloading '%s'", name)
+			return nil, nil, ErrOffline
+		}
+		if err := fs.download(stor, m, fs.GetPath(name)); err != nil {
+			log.Errorf("Error getting file '%s' from stor: %s", name, err)
+			return nil, nil, fuse.EIO
+		}
+	}
+
+	return m, md, fuse.OK
+}
+
+// blobCached returns true if the content of md is in the blob cache, so it
+// can be fetched offline
+func (fs *fileSystem) blobCached(md *meta.MetaData) bool {
+	return fs.linkBlobs(md) && fs.blobs.Cached(md.Hash)
+}
+
+// copyUp prepares name to be changed: a flist file is first fetched with all
+// its content, then marked modified so it's never replaced by the flist
+// version again. It fails rather than letting a change apply to a partial
+// file. A file linked to a blob gets a copy of its own, so the change doesn't
+// apply to the blob.
+func (fs *fileSystem) copyUp(name string) (meta.Meta, *meta.MetaData, fuse.Status) {
+	m, md, st := fs.fetch(name)
+	if st != fuse.OK {
+		return nil, nil, st
+	}
+
+	if !m.Stat().Modified() {
+		log.Debugf("Copy up '%s'", name)
+		if st := fs.unlinkBlob(md, fs.GetPath(name)); st != fuse.OK {
+			return nil, nil, st
+		}
+		m.SetStat(m.Stat().SetModified(true))
+	}
+
+	return m, md, fuse.OK
+}
+
+// unlinkBlob replaces the cached file path by a copy if it's a link to the
+// blob of md
+func (fs *fileSystem) unlinkBlob(md *meta.MetaData, path string) fuse.Status {
+	if md.Filetype != syscall.S_IFREG || !fs.blobs.Linked(md.Hash, path) {
+		return fuse.OK
+	}
+
+	log.Debugf("Unlink '%s' from blob %s", path, md.Hash)
+	if err := fs.blobs.Unlink(path); err != nil {
+		log.Errorf("Failed to copy blob %s to '%s': %s", md.Hash, path, err)
+		return fuse.EIO
+	}
+
+	setLocalAttr(path, md)
+	return fuse.OK
+}
+
+// saveNew saves the meta of a new entry created by the caller, with all its
+// times set to now
+func (fs *fileSystem) saveNew(m meta.Meta, filetype uint32, mode uint32, context *fuse.Context) fuse.Status {
+	data, err := m.Load()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+
+	md := &meta.MetaData{
+		Inode:       data.Inode,
+		Filetype:    filetype,
+		Permissions: mode & 07777,
+		Uid:         context.Uid,
+		Gid:         context.Gid,
+	}
+	md.SetTimes(time.Now())
+
+	m.SetStat(m.Stat().SetModified(true))
+	return saveMeta(m, md)
+}
+
+// saveMeta saves the attributes changed on a copied up entry
+func saveMeta(m meta.Meta, md *meta.MetaData) fuse.Status {
+	return fuse.ToStatus(m.Save(md))
+}
@@ -0,0 +1,92 @@
+package files
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/g8os/fs/meta"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+// brotliStored encodes data (at most 64KiB) as a brotli stream made of a
+// single uncompressed meta-block
+func brotliStored(data []byte) []byte {
+	// WBITS=16 (1 bit), ISLAST=0, MNIBBLES=4 (2 bits), MLEN-1 (16 bits),
+	// ISUNCOMPRESSED=1, then padding to the byte boundary
+	header := uint32(len(data)-1)<<4 | 1<<20
+	out := []byte{byte(header), byte(header >> 8), byte(header >> 16)}
+	out = append(out, data...)
+	// ISLAST=1, ISLASTEMPTY=1
+	return append(out, 0x03)
+}
+
+type memStorage map[string][]byte
+
+func (s memStorage) Get(key string) (io.ReadCloser, error) {
+	data, ok := s[key]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", key)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func flistFile(t *testing.T, fs *fileSystem, name, hash string, size uint64) meta.Meta {
+	m, err := fs.meta.CreateFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Save(&meta.MetaData{Filetype: syscall.S_IFREG, Permissions: 0644, Hash: hash, Size: size})
+	return m
+}
+
+func TestCopyUp(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	fs.stor = memStorage{"aa": brotliStored([]byte("hello world"))}
+	context := &fuse.Context{}
+
+	// read only opens fetch the file without changing it
+	m := flistFile(t, fs, "read", "aa", 11)
+	file, st := fs.Open("read", uint32(os.O_RDONLY), context)
+	if assert.Equal(t, fuse.OK, st) {
+		file.Release()
+	}
+	assert.False(t, m.Stat().Modified())
+
+	m = flistFile(t, fs, "write", "aa", 11)
+	file, st = fs.Open("write", uint32(os.O_WRONLY), context)
+	if assert.Equal(t, fuse.OK, st) {
+		file.Release()
+	}
+	assert.True(t, m.Stat().Modified())
+	content, _ := ioutil.ReadFile(fs.GetPath("write"))
+	assert.Equal(t, "hello world", string(content))
+
+	m = flistFile(t, fs, "truncate", "aa", 11)
+	assert.Equal(t, fuse.OK, fs.Truncate("truncate", 5, context))
+	assert.True(t, m.Stat().Modified())
+	content, _ = ioutil.ReadFile(fs.GetPath("truncate"))
+	assert.Equal(t, "hello", string(content))
+
+	m = flistFile(t, fs, "chmod", "aa", 11)
+	assert.Equal(t, fuse.OK, fs.Chmod("chmod", 0600, context))
+	assert.True(t, m.Stat().Modified())
+	content, _ = ioutil.ReadFile(fs.GetPath("chmod"))
+	assert.Equal(t, "hello world", string(content))
+	data, _ := m.Load()
+	assert.Equal(t, uint32(0600), data.Permissions)
+
+	// a failed fetch doesn't leave an empty file behind
+	m = flistFile(t, fs, "missing", "bb", 11)
+	_, st = fs.Open("missing", uint32(os.O_RDWR), context)
+	assert.Equal(t, fuse.EIO, st)
+	assert.False(t, m.Stat().Modified())
+	assert.False(t, fs.checkExist(fs.GetPath("missing")))
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/hanwen/go-fuse/fuse"
 )
@@ -16,11 +17,21 @@ func (fs *fileSystem) Mkdir(path string, mode uint32, context *fuse.Context) fus
 		return fuse.ToStatus(os.Mkdir(fullPath, os.FileMode(mode)))
 	}
 
-	metaFn := func() { fs.meta.CreateDir(path) }
+	metaFn := func() fuse.Status {
+		m, err := fs.meta.CreateDir(path)
+		if err != nil {
+			return fuse.ToStatus(err)
+		}
+		return fs.saveNew(m, syscall.S_IFDIR, mode, context)
+	}
 
 	if st := backendFn(); st != fuse.ENOENT {
-		metaFn()
-		return st
+		if st != fuse.OK {
+			// the meta may miss a directory that exists in the backend
+			fs.meta.CreateDir(path)
+			return st
+		}
+		return metaFn()
 	}
 
 	// only populate directories above it.
@@ -30,10 +41,9 @@ func (fs *fileSystem) Mkdir(path string, mode uint32, context *fuse.Context) fus
 		return st
 	}
 
-	metaFn()
 	// This line break mkdir on OL
 	// fs.tracker.Touch(fullPath)
-	return fuse.OK
+	return metaFn()
 }
 
 // Rmdir deletes a directory
@@ -5,6 +5,7 @@ import (
 	"os"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/g8os/fs/meta"
 	"github.com/hanwen/go-fuse/fuse"
@@ -28,6 +29,41 @@ type loopbackFile struct {
 	// with another close, they may lead to confusion as which
 	// file gets written in the end.
 	lock sync.Mutex
+	// written is set when the content changed since the meta was last
+	// updated, at mtime
+	written bool
+	mtime   time.Time
+}
+
+// changed records a change of the content, called with the lock held
+func (f *loopbackFile) changed() {
+	f.written = true
+	f.mtime = time.Now()
+}
+
+// syncMeta updates the size and times of the meta after the content
+// changed, called with the lock held
+func (f *loopbackFile) syncMeta() {
+	if !f.written {
+		return
+	}
+	f.written = false
+
+	md, err := f.m.Load()
+	if err != nil {
+		log.Errorf("Failed to load meta of %v: %s", f.File.Name(), err)
+		return
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.File.Fd()), &st); err == nil {
+		md.Size = uint64(st.Size)
+	}
+
+	md.Touch(f.mtime)
+	if err := f.m.Save(md); err != nil {
+		log.Errorf("Failed to save meta of %v: %s", f.File.Name(), err)
+	}
 }
 
 func (f *loopbackFile) InnerFile() nodefs.File {
@@ -54,6 +90,7 @@ func (f *loopbackFile) Write(data []byte, off int64) (uint32, fuse.Status) {
 	f.lock.Lock()
 	defer f.lock.Unlock()
 	f.m.SetStat(f.m.Stat().SetModified(true))
+	f.changed()
 	n, err := f.File.WriteAt(data, off)
 	return uint32(n), fuse.ToStatus(err)
 }
@@ -62,11 +99,13 @@ func (f *loopbackFile) Release() {
 	log.Debugf("Release file %v", f.File.Name())
 	f.lock.Lock()
 	defer f.lock.Unlock()
+	f.syncMeta()
 	f.File.Close()
 }
 
 func (f *loopbackFile) Flush() fuse.Status {
 	f.lock.Lock()
+	f.syncMeta()
 
 	// Since Flush() may be called for each dup'd fd, we don't
 	// want to really close the file, we just want to flush. This
@@ -84,6 +123,7 @@ func (f *loopbackFile) Flush() fuse.Status {
 func (f *loopbackFile) Fsync(flags int) (code fuse.Status) {
 	f.lock.Lock()
 	defer f.lock.Unlock()
+	f.syncMeta()
 	r := fuse.ToStatus(syscall.Fsync(int(f.File.Fd())))
 
 	return r
@@ -92,26 +132,24 @@ func (f *loopbackFile) Fsync(flags int) (code fuse.Status) {
 func (f *loopbackFile) Truncate(size uint64) fuse.Status {
 	f.lock.Lock()
 	defer f.lock.Unlock()
+	f.changed()
 	r := fuse.ToStatus(syscall.Ftruncate(int(f.File.Fd()), int64(size)))
 
 	return r
 }
 
-func (f *loopbackFile) Chmod(mode uint32) fuse.Status {
-	f.lock.Lock()
-	defer f.lock.Unlock()
-	r := fuse.ToStatus(f.File.Chmod(os.FileMode(mode)))
+// Attribute changes are done by the filesystem, which also updates the meta
 
-	return r
+func (f *loopbackFile) Chmod(mode uint32) fuse.Status {
+	return fuse.ENOSYS
 }
 
 func (f *loopbackFile) Chown(uid uint32, gid uint32) fuse.Status {
-	f.lock.Lock()
-	defer f.lock.Unlock()
-
-	r := fuse.ToStatus(f.File.Chown(int(uid), int(gid)))
+	return fuse.ENOSYS
+}
 
-	return r
+func (f *loopbackFile) Utimens(a *time.Time, m *time.Time) fuse.Status {
+	return fuse.ENOSYS
 }
 
 func (f *loopbackFile) GetAttr(a *fuse.Attr) fuse.Status {
@@ -119,6 +157,7 @@ func (f *loopbackFile) GetAttr(a *fuse.Attr) fuse.Status {
 
 	st := syscall.Stat_t{}
 	f.lock.Lock()
+	f.syncMeta()
 	err := syscall.Fstat(int(f.File.Fd()), &st)
 	f.lock.Unlock()
 	if err != nil {
@@ -126,5 +165,37 @@ func (f *loopbackFile) GetAttr(a *fuse.Attr) fuse.Status {
 	}
 	a.FromStat(&st)
 
+	// times, inode and links come from the meta, like the filesystem GetAttr
+	if md, err := f.m.Load(); err == nil {
+		setAttrMeta(a, md)
+	}
+
 	return fuse.OK
 }
+
+// trackedFile reports the reads of an open file to the recording of the
+// mount, and its release to the usage of the mount
+type trackedFile struct {
+	nodefs.File
+	fs   *fileSystem
+	name string
+}
+
+func (fs *fileSystem) trackFile(name string, file nodefs.File) nodefs.File {
+	fs.recordOpen(name)
+	return &trackedFile{
+		File: file,
+		fs:   fs,
+		name: name,
+	}
+}
+
+func (f *trackedFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.fs.recordRead(f.name, off, len(buf))
+	return f.File.Read(buf, off)
+}
+
+func (f *trackedFile) Release() {
+	f.File.Release()
+	f.fs.usage.Close(f.name)
+}
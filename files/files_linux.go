@@ -9,6 +9,7 @@ import (
 
 func (f *loopbackFile) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 	f.lock.Lock()
+	f.changed()
 	err := syscall.Fallocate(int(f.File.Fd()), mode, int64(off), int64(sz))
 	f.lock.Unlock()
 	if err != nil {
@@ -17,29 +18,18 @@ func (f *loopbackFile) Allocate(off uint64, sz uint64, mode uint32) fuse.Status
 	return fuse.OK
 }
 
-const _UTIME_NOW = ((1 << 30) - 1)
 const _UTIME_OMIT = ((1 << 30) - 2)
 
-// Utimens - file handle based version of loopbackFileSystem.Utimens()
-func (f *loopbackFile) Utimens(a *time.Time, m *time.Time) fuse.Status {
-	var ts [2]syscall.Timespec
-
-	if a == nil {
-		ts[0].Nsec = _UTIME_OMIT
-	} else {
-		ts[0] = syscall.NsecToTimespec(a.UnixNano())
-		ts[0].Nsec = 0
-	}
-
-	if m == nil {
-		ts[1].Nsec = _UTIME_OMIT
-	} else {
-		ts[1] = syscall.NsecToTimespec(a.UnixNano())
-		ts[1].Nsec = 0
+// utimes returns the utimensat(2) times of an atime and mtime, a nil time
+// is left unchanged
+func utimes(a *time.Time, m *time.Time) []syscall.Timespec {
+	ts := make([]syscall.Timespec, 2)
+	for i, t := range []*time.Time{a, m} {
+		if t == nil {
+			ts[i].Nsec = _UTIME_OMIT
+		} else {
+			ts[i] = syscall.NsecToTimespec(t.UnixNano())
+		}
 	}
-
-	f.lock.Lock()
-	err := futimens(int(f.File.Fd()), &ts)
-	f.lock.Unlock()
-	return fuse.ToStatus(err)
+	return ts
 }
@@ -4,15 +4,17 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/dsnet/compress/brotli"
+	"github.com/g8os/fs/config"
 	"github.com/g8os/fs/crypto"
 	"github.com/g8os/fs/meta"
+	"github.com/g8os/fs/storage"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
@@ -64,153 +66,149 @@ func (fs *fileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, f
 	}
 
 	var st syscall.Stat_t
-	err = syscall.Stat(fs.GetPath(name), &st)
+	if metaOnly(metadata.Filetype) {
+		err = syscall.ENOENT
+	} else {
+		err = syscall.Stat(fs.GetPath(name), &st)
+	}
 	if err == nil {
 		log.Debugf("GetAttr %v: metadata, forwarding from backend", fs.GetPath(name))
 		attr.FromStat(&st)
-		attr.Ino = metadata.Inode
+		setAttrMeta(attr, metadata)
 		return attr, fuse.OK
 	}
 
 	attr.Size = metadata.Size
 	attr.Mode = metadata.Filetype | metadata.Permissions
+	attr.Uid = metadata.Uid
+	attr.Gid = metadata.Gid
 
 	if metadata.Filetype == syscall.S_IFLNK {
+		// the size of a symlink is the length of its target
 		attr.Mode = metadata.Filetype | 0777
-		if err := syscall.Lstat(metadata.Extended, &st); err == nil {
-			attr.Uid = st.Uid
-			attr.Gid = st.Gid
-			attr.Ctime = uint64(st.Ctim.Sec)
-			attr.Mtime = uint64(st.Mtim.Sec)
-		}
-	} else {
-		attr.Ctime = metadata.Ctime
-		attr.Mtime = metadata.Mtime
-		attr.Uid = metadata.Uid
-		attr.Gid = metadata.Gid
+		attr.Size = uint64(len(metadata.Extended))
 	}
 
-	attr.Ino = metadata.Inode
+	setAttrMeta(attr, metadata)
+	attr.Nlink = metadata.Links()
 
 	// block and character devices
 	if metadata.Filetype == syscall.S_IFCHR || metadata.Filetype == syscall.S_IFBLK {
-		attr.Rdev = uint32((metadata.DevMajor * 256) + metadata.DevMinor)
+		attr.Rdev = mkdev(metadata.DevMajor, metadata.DevMinor)
 	}
 
 	return attr, fuse.OK
 }
 
-// Open opens a file.
-// Download it from stor if file not exist
-func (fs *fileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
-	var st syscall.Stat_t
-
-	log.Debugf("Open %v", name)
-
-	m, exists := fs.meta.Get(name)
-	if flags&uint32(os.O_RDONLY) > 0 && !exists {
-		return nil, fuse.ENOENT
+// setAttrMeta sets the attributes kept by the meta over the ones of the
+// backend: the inode, the links of files, the times, and the mode and owners
+// of regular files and directories, so they are the same whether or not they
+// are cached.
+func setAttrMeta(attr *fuse.Attr, md *meta.MetaData) {
+	attr.Ino = md.Inode
+	if md.Filetype != syscall.S_IFDIR {
+		attr.Nlink = md.Links()
 	}
 
-	err := syscall.Lstat(fs.GetPath(name), &st)
-
-	_, exists = fs.meta.Get(path.Dir(name))
-	if !exists {
-		return nil, fuse.ENOENT
+	// a cached file linked to a blob has the mode and owners of the blob,
+	// and the backend directories are created with the ones of the daemon
+	if md.Filetype == syscall.S_IFREG || md.Filetype == syscall.S_IFDIR {
+		attr.Mode = md.Filetype | md.Permissions
+		attr.Uid, attr.Gid = md.Uid, md.Gid
 	}
 
-	dir := path.Dir(name)
-	if _, ok := fs.meta.Get(dir); ok {
-		os.MkdirAll(fs.GetPath(dir), 0755)
-	} else {
-		return nil, fuse.ENOENT
-	}
+	atime, mtime, ctime := md.AccessTime(), md.ModTime(), md.ChangeTime()
+	attr.SetTimes(&atime, &mtime, &ctime)
+}
 
-	if exists && os.IsNotExist(err) {
-		if err := fs.download(m, fs.GetPath(name)); err != nil {
-			log.Errorf("Error getting file from stor: %s", err)
-			return nil, fuse.EIO
-		}
+// Open opens a file.
+// Download it from stor if file not exist
+func (fs *fileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	log.Debugf("Open %v", name)
 
-		return fs.Open(name, flags, context)
+	// write intents copy the file up first, so a change never applies to
+	// a file that isn't completely fetched
+	fetch := fs.fetch
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		fetch = fs.copyUp
 	}
 
-	//we can reach here only if we are in create mode.
-	//we need to create a meta file to associate with this file.
-	m, err = fs.meta.CreateFile(name)
-	if err != nil {
-		return nil, fuse.ToStatus(err)
-	}
+	// the file is open from now on, so it can't be evicted once fetched
+	fs.usage.Open(name)
 
-	data, err := m.Load()
-	if err != nil {
-		return nil, fuse.ToStatus(err)
+	m, md, st := fetch(name)
+	if st != fuse.OK {
+		fs.usage.Close(name)
+		return nil, st
 	}
 
-	file, err := os.OpenFile(fs.GetPath(name), int(flags), 0)
-	if err != nil {
-		return nil, fuse.ToStatus(err)
+	if md.Filetype == syscall.S_IFDIR {
+		fs.usage.Close(name)
+		return nil, fuse.Status(syscall.EISDIR)
 	}
 
-	if err := syscall.Stat(fs.GetPath(name), &st); err != nil {
+	file, err := os.OpenFile(fs.GetPath(name), int(flags)&^(os.O_CREATE|os.O_EXCL), 0)
+	if err != nil {
+		fs.usage.Close(name)
 		return nil, fuse.ToStatus(err)
 	}
 
-	m.Save(&meta.MetaData{
-		Inode:       data.Inode,
-		Size:        uint64(st.Size),
-		Filetype:    syscall.S_IFREG,
-		Uid:         st.Uid,
-		Gid:         st.Gid,
-		Permissions: st.Mode | uint32(os.ModePerm),
-		Ctime:       uint64(st.Ctim.Sec),
-		Mtime:       uint64(st.Mtim.Sec),
-	})
-
-	return NewLoopbackFile(m, file), fuse.OK
+	return fs.trackFile(name, NewLoopbackFile(m, file)), fuse.OK
 }
 
 func (fs *fileSystem) Truncate(path string, offset uint64, context *fuse.Context) (code fuse.Status) {
-	m, err := fs.meta.CreateFile(path)
-	if err != nil {
+	m, md, st := fs.copyUp(path)
+	if st != fuse.OK {
+		return st
+	}
+
+	if err := os.Truncate(fs.GetPath(path), int64(offset)); err != nil {
 		return fuse.ToStatus(err)
 	}
-	m.SetStat(m.Stat().SetModified(true))
-	return fuse.ToStatus(os.Truncate(fs.GetPath(path), int64(offset)))
+
+	md.Size = offset
+	md.Touch(time.Now())
+	return saveMeta(m, md)
 }
 
 func (fs *fileSystem) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	fullPath := fs.GetPath(name)
-
-	f := func() fuse.Status {
-		return fuse.ToStatus(os.Chmod(fullPath, os.FileMode(mode)))
+	m, md, st := fs.copyUp(name)
+	if st != fuse.OK {
+		return st
 	}
 
-	if status := f(); status != fuse.ENOENT {
-		return status
+	if !metaOnly(md.Filetype) {
+		if err := os.Chmod(fs.GetPath(name), os.FileMode(mode&07777)); err != nil {
+			return fuse.ToStatus(err)
+		}
 	}
 
-	if status := fs.populateDirFile(name); status != fuse.OK {
-		return status
-	}
-	return f()
+	md.Permissions = mode & 07777
+	md.SetChangeTime(time.Now())
+	return saveMeta(m, md)
 }
 
 func (fs *fileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
-	fullPath := fs.GetPath(name)
-
-	f := func() fuse.Status {
-		return fuse.ToStatus(os.Chown(fullPath, int(uid), int(gid)))
+	m, md, st := fs.copyUp(name)
+	if st != fuse.OK {
+		return st
 	}
 
-	if status := f(); status != fuse.ENOENT {
-		return status
+	if !metaOnly(md.Filetype) {
+		if err := os.Lchown(fs.GetPath(name), int(uid), int(gid)); err != nil {
+			return fuse.ToStatus(err)
+		}
 	}
 
-	if status := fs.populateDirFile(name); status != fuse.OK {
-		return status
+	// -1 leaves the id unchanged, like chown(2)
+	if uid != ^uint32(0) {
+		md.Uid = uid
+	}
+	if gid != ^uint32(0) {
+		md.Gid = gid
 	}
-	return f()
+	md.SetChangeTime(time.Now())
+	return saveMeta(m, md)
 }
 
 func (fs *fileSystem) Readlink(name string, context *fuse.Context) (out string, code fuse.Status) {
@@ -243,27 +241,53 @@ func (fs *fileSystem) Unlink(name string, context *fuse.Context) (code fuse.Stat
 		return fuse.ENOENT
 	}
 
-	if err := syscall.Unlink(fullPath); err != nil {
-		log.Warning("data file '%s' doesn't exist", fullPath)
+	if md, err := m.Load(); err != nil || !metaOnly(md.Filetype) {
+		if err := syscall.Unlink(fullPath); err != nil {
+			log.Warning("data file '%s' doesn't exist", fullPath)
+		}
 	}
 
 	fs.meta.Delete(m)
+	fs.usage.Remove(name)
 
 	return fuse.OK
 }
 
+// Symlink creates a symlink in the meta store, owned by the caller
 func (fs *fileSystem) Symlink(pointedTo string, linkName string, context *fuse.Context) (code fuse.Status) {
-	log.Errorf("Symlink %v -> %v", pointedTo, linkName)
+	log.Debugf("Symlink %v -> %v", pointedTo, linkName)
+
+	if _, exists := fs.meta.Get(path.Dir(linkName)); !exists {
+		return fuse.ENOENT
+	}
+
+	if _, exists := fs.meta.Get(linkName); exists {
+		return fuse.Status(syscall.EEXIST)
+	}
+
 	m, err := fs.meta.CreateFile(linkName)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 
-	return fuse.ToStatus(m.Save(&meta.MetaData{
+	data, err := m.Load()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+
+	md := &meta.MetaData{
+		Inode:       data.Inode,
 		Filetype:    syscall.S_IFLNK,
 		Extended:    pointedTo,
+		Size:        uint64(len(pointedTo)),
 		Permissions: 0777,
-	}))
+		Uid:         context.Uid,
+		Gid:         context.Gid,
+	}
+	md.SetTimes(time.Now())
+
+	m.SetStat(m.Stat().SetModified(true))
+	return fuse.ToStatus(m.Save(md))
 }
 
 // Rename handles dir & file rename operation
@@ -273,41 +297,109 @@ func (fs *fileSystem) Rename(oldPath string, newPath string, context *fuse.Conte
 
 	log.Debugf("Rename (%v) -> (%v)", oldPath, newPath)
 
-	m, exists := fs.meta.Get(oldPath)
-	if !exists {
+	if _, exists := fs.meta.Get(oldPath); !exists {
 		return fuse.ENOENT
 	}
 
-	// rename file
-	if err := os.Rename(fullOldPath, fullNewPath); err != nil {
-		log.Warning("data file doesn't exist")
+	// a directory can only replace an empty directory
+	if target, data, st := fs.Meta(newPath); st == fuse.OK && data.Filetype == syscall.S_IFDIR {
+		children := 0
+		if ch := target.Children(); ch != nil {
+			for range ch {
+				children++
+			}
+		}
+		if children != 0 {
+			return fuse.Status(syscall.ENOTEMPTY)
+		}
 	}
 
-	// adjust metadata
-	info, err := m.Load()
-	if err != nil {
-		return fuse.ToStatus(err)
+	// the new parent may only be in the meta yet
+	if st := fs.populateDirFile(filepath.Dir(strings.TrimSuffix(newPath, "/"))); st != fuse.OK {
+		return st
 	}
 
-	fs.meta.Delete(m)
+	// rename the cached data, if any. The meta is only moved with its data,
+	// or else a changed file would lose its content.
+	if err := os.Rename(fullOldPath, fullNewPath); err != nil {
+		if _, serr := os.Lstat(fullOldPath); !os.IsNotExist(serr) {
+			log.Errorf("failed to rename '%s' to '%s': %s", fullOldPath, fullNewPath, err)
+			return fuse.ToStatus(err)
+		}
 
-	nm, err := fs.meta.CreateFile(newPath)
-	if err != nil {
-		return fuse.ToStatus(err)
+		log.Debugf("data of '%s' not cached", oldPath)
+		// stale data at the new path must not shadow the moved entries,
+		// they are downloaded on demand instead
+		if err := os.RemoveAll(fullNewPath); err != nil {
+			log.Errorf("failed to remove '%s': %s", fullNewPath, err)
+			return fuse.ToStatus(err)
+		}
 	}
 
-	return fuse.ToStatus(nm.Save(info))
+	// move the meta of the whole subtree
+	switch err := fs.meta.Rename(oldPath, newPath); err {
+	case nil:
+		fs.usage.Rename(oldPath, newPath)
+		return fuse.OK
+	case meta.ErrNotFound:
+		return fuse.ENOENT
+	case meta.ErrInvalidRename:
+		return fuse.EINVAL
+	default:
+		return fuse.ToStatus(err)
+	}
 }
 
+// Link adds a hard link to orig. The names share the meta data, and the
+// content of regular files is cached once and hard linked in the backend.
 func (fs *fileSystem) Link(orig string, newName string, context *fuse.Context) (code fuse.Status) {
-	log.Errorf("Link `%v` -> `%v`", orig, newName)
-	return fuse.ToStatus(syscall.Link(fs.GetPath(orig), fs.GetPath(newName)))
-}
+	log.Debugf("Link `%v` -> `%v`", orig, newName)
 
-func (fs *fileSystem) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	log.Debugf("Access %v", fs.GetPath(name))
-	return fuse.OK
-	//return fuse.ToStatus(syscall.Access(fs.GetPath(name), mode))
+	_, data, st := fs.Meta(orig)
+	if st != fuse.OK {
+		return st
+	}
+
+	if data.Filetype == syscall.S_IFDIR {
+		return fuse.EPERM
+	}
+
+	if _, exists := fs.meta.Get(newName); exists {
+		return fuse.Status(syscall.EEXIST)
+	}
+
+	fullNewPath := fs.GetPath(newName)
+	if data.Filetype == syscall.S_IFREG {
+		if st := fs.populateDirFile(orig); st != fuse.OK {
+			return st
+		}
+		if st := fs.populateDirFile(filepath.Dir(strings.TrimSuffix(newName, "/"))); st != fuse.OK {
+			return st
+		}
+
+		if err := syscall.Link(fs.GetPath(orig), fullNewPath); err != nil {
+			return fuse.ToStatus(err)
+		}
+	}
+
+	switch _, err := fs.meta.Link(orig, newName); err {
+	case nil:
+		return fuse.OK
+	case meta.ErrNotFound:
+		code = fuse.ENOENT
+	case meta.ErrExists:
+		code = fuse.Status(syscall.EEXIST)
+	case meta.ErrIsDir:
+		code = fuse.EPERM
+	default:
+		code = fuse.ToStatus(err)
+	}
+
+	if data.Filetype == syscall.S_IFREG {
+		syscall.Unlink(fullNewPath)
+	}
+
+	return code
 }
 
 func (fs *fileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, code fuse.Status) {
@@ -326,89 +418,136 @@ func (fs *fileSystem) Create(name string, flags uint32, mode uint32, context *fu
 
 	m, err := fs.meta.CreateFile(name)
 	if err != nil {
+		f.Close()
 		return nil, fuse.ToStatus(err)
 	}
 
-	return NewLoopbackFile(m, f), fuse.OK
-}
-
-// download file from stor
-func (fs *fileSystem) download(meta meta.Meta, path string) error {
-	log.Infof("Downloading file '%s'", path)
-
-	data, err := meta.Load()
-	if err != nil {
-		return err
+	if st := fs.saveNew(m, syscall.S_IFREG, mode, context); st != fuse.OK {
+		f.Close()
+		return nil, st
 	}
 
-	body, err := fs.stor.Get(data.Hash)
+	fs.usage.Open(name)
+	return fs.trackFile(name, NewLoopbackFile(m, f)), fuse.OK
+}
+
+// Fetch downloads the blob of a file from the stor and writes its content,
+// decompressed and decrypted if the backend is encrypted, to out.
+func Fetch(stor storage.Storage, backend *config.Backend, data *meta.MetaData, out io.Writer) error {
+	body, err := stor.Get(data.Hash)
 	if err != nil {
 		return err
 	}
 
 	defer body.Close()
 
-	broReader, err := brotli.NewReader(body, nil)
-	if err != nil {
-		return err
-	}
-
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, os.ModePerm)
+	reader, err := storage.NewReader(body)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer reader.Close()
 
-	if fs.backend.Encrypted {
+	if backend.Encrypted {
 		if data.UserKey == "" {
-			return fmt.Errorf("encryption key is empty, can't decrypt file %v", path)
+			return fmt.Errorf("encryption key is empty, can't decrypt file")
 		}
 
 		r := bytes.NewBuffer([]byte(data.UserKey))
 		bKey := []byte{}
 		fmt.Fscanf(r, "%x", &bKey)
 
-		sessionKey, err := crypto.DecryptAsym(fs.backend.ClientKey, bKey)
+		sessionKey, err := crypto.DecryptAsym(backend.ClientKey, bKey)
 		if err != nil {
 			log.Errorf("Error decrypting session key: %v", err)
 			return err
 		}
 
-		if err := crypto.DecryptSym(sessionKey, broReader, file); err != nil {
+		if err := crypto.DecryptSym(sessionKey, reader, out); err != nil {
 			log.Errorf("Error decrypting data: %v", err)
 			return err
 		}
 	} else {
-		if _, err = io.Copy(file, broReader); err != nil {
+		if _, err = io.Copy(out, reader); err != nil {
 			log.Errorf("Error downloading data: %v", err)
-			_ = os.Remove(path)
 			return err
 		}
 	}
 
-	// setting locally file permission
-	err = os.Chown(path, int(data.Uid), int(data.Gid))
+	return nil
+}
+
+// download fetches the content of a file into the backend. The content is
+// written to a temporary file renamed once complete, so a partial download
+// is never visible at path.
+func (fs *fileSystem) download(stor storage.Storage, meta meta.Meta, path string) error {
+	log.Infof("Downloading file '%s'", path)
+
+	data, err := meta.Load()
 	if err != nil {
-		log.Errorf("Cannot chown %v to (%d, %d): %v", path, data.Uid, data.Gid, err)
+		return err
 	}
 
-	// err = syscall.Chmod(path, 04755)
-	err = syscall.Chmod(path, data.Permissions)
-	if err != nil {
-		log.Errorf("Cannot chmod %v to %d: %v", path, data.Permissions, err)
+	if fs.linkBlobs(data) {
+		return fs.downloadBlob(stor, data, path)
 	}
 
-	utbuf := &syscall.Utimbuf{
-		Actime:  int64(data.Ctime),
-		Modtime: int64(data.Mtime),
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".download")
+	if err != nil {
+		return err
 	}
+	tmp := file.Name()
 
-	err = syscall.Utime(path, utbuf)
+	err = Fetch(stor, fs.backend, data, file)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
-		log.Errorf("Cannot utime %v: %v", path, err)
+		os.Remove(tmp)
+		return err
+	}
+
+	setLocalAttr(tmp, data)
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// linkBlobs returns true if the cached file of data is a link to the blob
+// cache. The blobs are decoded but not decrypted, so the files of encrypted
+// backends are never shared.
+func (fs *fileSystem) linkBlobs(data *meta.MetaData) bool {
+	return fs.blobs != nil && !fs.backend.Encrypted && data.Hash != ""
+}
+
+// downloadBlob links path to the blob of data, downloading the blob if no
+// mount of the node did yet. The attributes of the blob are shared by all
+// its links, the attributes of the file come from its meta.
+func (fs *fileSystem) downloadBlob(stor storage.Storage, data *meta.MetaData, path string) error {
+	return fs.blobs.Fetch(data.Hash, path, func(w io.Writer) error {
+		return Fetch(stor, fs.backend, data, w)
+	})
+}
+
+// setLocalAttr sets the attributes of the cached file name from its meta
+func setLocalAttr(name string, data *meta.MetaData) {
+	if err := os.Chown(name, int(data.Uid), int(data.Gid)); err != nil {
+		log.Errorf("Cannot chown %v to (%d, %d): %v", name, data.Uid, data.Gid, err)
+	}
+
+	if err := syscall.Chmod(name, data.Permissions); err != nil {
+		log.Errorf("Cannot chmod %v to %d: %v", name, data.Permissions, err)
 	}
 
-	return err
+	// the access time of the cached file is the one of its last use, for
+	// the cache manager
+	now, mtime := time.Now(), data.ModTime()
+	if err := syscall.UtimesNano(name, utimes(&now, &mtime)); err != nil {
+		log.Errorf("Cannot utime %v: %v", name, err)
+	}
 }
 
 func (fs *fileSystem) Meta(path string) (meta.Meta, *meta.MetaData, fuse.Status) {
@@ -426,25 +565,31 @@ func (fs *fileSystem) Meta(path string) (meta.Meta, *meta.MetaData, fuse.Status)
 
 // Utimens changes the access and modification times of the inode specified by filename to the actime and modtime fields of times respectively.
 func (fs *fileSystem) Utimens(name string, aTime *time.Time, mTime *time.Time, context *fuse.Context) (code fuse.Status) {
-	// check if exist
+	// UTIME_NOW arrives as the current time and UTIME_OMIT as nil
 	m, md, st := fs.Meta(name)
 	if st != fuse.OK {
 		return st
 	}
 
-	// modify backend
-	ts := []syscall.Timespec{
-		syscall.Timespec{Sec: int64(aTime.Second()), Nsec: int64(aTime.Nanosecond())},
-		syscall.Timespec{Sec: int64(mTime.Second()), Nsec: int64(mTime.Nanosecond())},
+	// the times are kept in the meta, the content doesn't change so the
+	// file is not copied up. A cached file gets the same times, unless it's
+	// a link to a blob shared with other files.
+	fullPath := fs.GetPath(name)
+	if !metaOnly(md.Filetype) && fs.checkExist(fullPath) && !fs.blobs.Linked(md.Hash, fullPath) {
+		if err := syscall.UtimesNano(fullPath, utimes(aTime, mTime)); err != nil {
+			return fuse.ToStatus(err)
+		}
 	}
 
-	if err := syscall.UtimesNano(fs.GetPath(name), ts); err != nil {
-		return fuse.ToStatus(err)
+	if aTime != nil {
+		md.SetAccessTime(*aTime)
+	}
+	if mTime != nil {
+		md.SetModTime(*mTime)
 	}
+	md.SetChangeTime(time.Now())
 
-	// modify metadata
-	md.Mtime = uint64(mTime.Second())
-	return fuse.ToStatus(m.Save(md))
+	return saveMeta(m, md)
 }
 
 // StatFs get filesystem statistics
@@ -461,55 +606,83 @@ func (fs *fileSystem) StatFs(name string) *fuse.StatfsOut {
 	return out
 }
 
+// setxattr(2) flags
+const (
+	xattrCreate  = 1
+	xattrReplace = 2
+)
+
+// Extended attributes are kept in the meta data, so they don't depend on the
+// backend file being cached.
+
 func (fs *fileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
-	log.Debugf("SetXAttr:%v", name)
-	if err := syscall.Setxattr(fs.GetPath(name), attr, data, flags); err != syscall.ENOENT {
-		return fuse.ToStatus(err)
+	log.Debugf("SetXAttr:%v %v", name, attr)
+	m, md, st := fs.copyUp(name)
+	if st != fuse.OK {
+		return st
+	}
+
+	_, exists := md.Xattr(attr)
+	if flags&xattrCreate != 0 && exists {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if flags&xattrReplace != 0 && !exists {
+		return fuse.ENOATTR
+	}
+
+	md.SetXattr(attr, data)
+	md.SetChangeTime(time.Now())
+	if err := m.Save(md); err != nil {
+		log.Errorf("SetXAttr %v: failed to save meta: %s", name, err)
+		return fuse.Status(syscall.ENOTSUP)
 	}
-	fs.populateDirFile(name)
 
-	return fuse.ToStatus(syscall.Setxattr(fs.GetPath(name), attr, data, flags))
+	return fuse.OK
 }
 
 func (fs *fileSystem) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
-	log.Debugf("GetXAttr:%v", name)
+	log.Debugf("GetXAttr:%v %v", name, attr)
+	_, md, st := fs.Meta(name)
+	if st != fuse.OK {
+		return nil, st
+	}
 
-	dest := []byte{}
-	if _, err := syscall.Getxattr(fs.GetPath(name), attr, dest); err != syscall.ENOENT {
-		return nil, fuse.ToStatus(err)
+	data, ok := md.Xattr(attr)
+	if !ok {
+		return nil, fuse.ENOATTR
 	}
-	fs.populateDirFile(name)
-	_, err := syscall.Getxattr(fs.GetPath(name), attr, dest)
-	return dest, fuse.ToStatus(err)
-}
 
-func (fs *fileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
-	log.Error("RemoveXAttr")
-	return fuse.ENOSYS
+	return data, fuse.OK
 }
 
-func (fs *fileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
-	log.Errorf("ListXAttr:%v", name)
-	dest := []byte{}
+func (fs *fileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	log.Debugf("RemoveXAttr:%v %v", name, attr)
+	m, md, st := fs.copyUp(name)
+	if st != fuse.OK {
+		return st
+	}
 
-	if _, err := syscall.Listxattr(fs.GetPath(name), dest); err != nil {
-		return []string{}, fuse.ToStatus(err)
+	if !md.RemoveXattr(attr) {
+		return fuse.ENOATTR
 	}
-	blines := bytes.Split(dest, []byte{0})
+	md.SetChangeTime(time.Now())
 
-	lines := make([]string, 0, len(blines))
-	for _, bl := range blines {
-		lines = append(lines, string(bl))
+	if err := m.Save(md); err != nil {
+		log.Errorf("RemoveXAttr %v: failed to save meta: %s", name, err)
+		return fuse.Status(syscall.ENOTSUP)
 	}
-	return lines, fuse.ToStatus(nil)
+
+	return fuse.OK
 }
 
-func (fs *fileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
-	log.Errorf("Mknod:%v", name)
-	if err := syscall.Mknod(fs.GetPath(name), mode, int(dev)); err != nil {
-		return fuse.ToStatus(err)
+func (fs *fileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	log.Debugf("ListXAttr:%v", name)
+	_, md, st := fs.Meta(name)
+	if st != fuse.OK {
+		return nil, st
 	}
-	return fuse.OK
+
+	return md.XattrNames(), fuse.OK
 }
 
 // populate dir/file when needed
@@ -550,14 +723,17 @@ func (fs *fileSystem) populateDirFile(name string) fuse.Status {
 		// populate dir/file
 		switch md.Filetype {
 		case syscall.S_IFDIR: // it is a directory
-			if err := os.Mkdir(fullPath, os.FileMode(md.Permissions)); err != nil {
+			// another request may have created it meanwhile
+			if err := os.Mkdir(fullPath, os.FileMode(md.Permissions)); err != nil && !os.IsExist(err) {
 				return fuse.ToStatus(err)
 			}
 
 		case syscall.S_IFREG:
-			if err := fs.download(m, fs.GetPath(path)); err != nil {
+			if err := fs.download(fs.stor, m, fs.GetPath(path)); err != nil {
 				return fuse.EIO
 			}
+		case syscall.S_IFCHR, syscall.S_IFBLK, syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFLNK:
+			// nothing to materialize, see metaOnly
 		default:
 			log.Errorf("[fuse] populateDirFile : unsupported filetype:%v", md.Filetype)
 		}
@@ -0,0 +1,198 @@
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/g8os/fs/config"
+	"github.com/g8os/fs/meta"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/stretchr/testify/assert"
+)
+
+// testFileSystem returns a fileSystem over a memory meta store, without
+// mounting it
+func testFileSystem(t *testing.T) (*fileSystem, func()) {
+	dir, err := ioutil.TempDir("", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := newFileSystem(&FS{
+		backend: &config.Backend{Path: dir},
+		meta:    meta.NewMemoryMetaStore(),
+	}).(*fileSystem)
+
+	return fs, func() { os.RemoveAll(dir) }
+}
+
+func TestSymlink(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	context := &fuse.Context{Owner: fuse.Owner{Uid: 1000, Gid: 100}}
+	assert.Equal(t, fuse.OK, fs.Symlink("../lib/libc.so.6", "libc.so", context))
+	assert.Equal(t, fuse.Status(syscall.EEXIST), fs.Symlink("x", "libc.so", context))
+	assert.Equal(t, fuse.ENOENT, fs.Symlink("x", "missing/link", context))
+
+	target, st := fs.Readlink("libc.so", context)
+	assert.Equal(t, fuse.OK, st)
+	assert.Equal(t, "../lib/libc.so.6", target)
+
+	attr, st := fs.GetAttr("libc.so", context)
+	if !assert.Equal(t, fuse.OK, st) {
+		return
+	}
+	assert.Equal(t, uint32(syscall.S_IFLNK|0777), attr.Mode)
+	assert.Equal(t, uint64(len("../lib/libc.so.6")), attr.Size)
+	assert.Equal(t, uint32(1000), attr.Uid)
+	assert.Equal(t, uint32(100), attr.Gid)
+
+	// lchown and utimens change the link itself
+	assert.Equal(t, fuse.OK, fs.Chown("libc.so", 0, 0, context))
+	mtime := time.Unix(1470000000, 0)
+	assert.Equal(t, fuse.OK, fs.Utimens("libc.so", nil, &mtime, context))
+
+	attr, _ = fs.GetAttr("libc.so", context)
+	assert.Equal(t, uint32(0), attr.Uid)
+	assert.Equal(t, uint64(1470000000), attr.Mtime)
+}
+
+func TestMknod(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	context := &fuse.Context{}
+	assert.Equal(t, fuse.OK, fs.Mknod("null", syscall.S_IFCHR|0666, mkdev(1, 3), context))
+	assert.Equal(t, fuse.OK, fs.Mknod("fifo", syscall.S_IFIFO|0600, 0, context))
+	assert.Equal(t, fuse.Status(syscall.EEXIST), fs.Mknod("fifo", syscall.S_IFIFO|0600, 0, context))
+
+	attr, st := fs.GetAttr("null", context)
+	if assert.Equal(t, fuse.OK, st) {
+		assert.Equal(t, uint32(syscall.S_IFCHR|0666), attr.Mode)
+		assert.Equal(t, mkdev(1, 3), attr.Rdev)
+	}
+
+	assert.Equal(t, fuse.OK, fs.Chmod("fifo", 0644, context))
+	attr, _ = fs.GetAttr("fifo", context)
+	assert.Equal(t, uint32(syscall.S_IFIFO|0644), attr.Mode)
+
+	entries, st := fs.OpenDir("", context)
+	assert.Equal(t, fuse.OK, st)
+	assert.Len(t, entries, 2)
+
+	assert.Equal(t, fuse.OK, fs.Unlink("fifo", context))
+	_, st = fs.GetAttr("fifo", context)
+	assert.Equal(t, fuse.ENOENT, st)
+}
+
+func TestFileMetaDirs(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs.meta = meta.NewFileMetaStore(dir)
+
+	// the attributes of a directory are kept in the file meta store too
+	context := &fuse.Context{Owner: fuse.Owner{Uid: 1000, Gid: 100}}
+	assert.Equal(t, fuse.OK, fs.Mkdir("dir", 0750, context))
+	assert.Equal(t, fuse.OK, fs.Chmod("dir", 0700, context))
+	mtime := time.Unix(1470000000, 5)
+	assert.Equal(t, fuse.OK, fs.Utimens("dir", nil, &mtime, context))
+
+	attr, st := fs.GetAttr("dir", context)
+	if !assert.Equal(t, fuse.OK, st) {
+		return
+	}
+	assert.Equal(t, uint32(syscall.S_IFDIR|0700), attr.Mode)
+	assert.Equal(t, uint32(1000), attr.Uid)
+	assert.Equal(t, uint32(100), attr.Gid)
+	assert.Equal(t, uint64(1470000000), attr.Mtime)
+	assert.Equal(t, uint32(5), attr.Mtimensec)
+
+	entries, st := fs.OpenDir("dir", context)
+	assert.Equal(t, fuse.OK, st)
+	assert.Empty(t, entries)
+	assert.Equal(t, fuse.OK, fs.Rmdir("dir", context))
+}
+
+func TestRename(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	context := &fuse.Context{}
+	file, st := fs.Create("file", uint32(os.O_WRONLY), 0644, context)
+	if !assert.Equal(t, fuse.OK, st) {
+		return
+	}
+	file.Write([]byte("hello"), 0)
+	file.Release()
+
+	// a directory of the flist, not in the backend yet
+	_, err := fs.meta.CreateDir("dir")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, fuse.OK, fs.Rename("file", "dir/file", context))
+	data, err := ioutil.ReadFile(fs.GetPath("dir/file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	_, exists := fs.meta.Get("dir/file")
+	assert.True(t, exists)
+
+	// the meta doesn't move without the data
+	_, err = fs.meta.CreateDir("other")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, os.MkdirAll(fs.GetPath("other/file"), 0755))
+	ioutil.WriteFile(fs.GetPath("other/file/x"), nil, 0644)
+	assert.NotEqual(t, fuse.OK, fs.Rename("dir/file", "other/file", context))
+	_, exists = fs.meta.Get("dir/file")
+	assert.True(t, exists)
+}
+
+// TestLinkNode links a file through the nodes of a mount
+func TestLinkNode(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	context := &fuse.Context{}
+	file, st := fs.Create("file", uint32(os.O_WRONLY), 0644, context)
+	if !assert.Equal(t, fuse.OK, st) {
+		return
+	}
+	file.Write([]byte("hello"), 0)
+	file.Release()
+
+	pathFs := newPathNodeFs(fs)
+	nodefs.NewFileSystemConnector(pathFs.Root(), nil)
+	root := pathFs.Root()
+
+	var attr fuse.Attr
+	node, st := root.Lookup(&attr, "file", context)
+	if !assert.Equal(t, fuse.OK, st) {
+		return
+	}
+	link, st := root.Link("link", node.Node(), context)
+	if !assert.Equal(t, fuse.OK, st) {
+		return
+	}
+	// both names are the same inode
+	assert.True(t, node == link, "%p %p", node, link)
+
+	data, err := ioutil.ReadFile(fs.GetPath("link"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	_, exists := fs.meta.Get("link")
+	assert.True(t, exists)
+}
@@ -1,12 +1,15 @@
 package files
 
 import (
+	"sync"
 	"time"
 
+	"github.com/g8os/fs/blobs"
 	"github.com/g8os/fs/config"
 
 	"github.com/g8os/fs/meta"
 	"github.com/g8os/fs/storage"
+	"github.com/g8os/fs/watcher"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
@@ -26,19 +29,54 @@ type FS struct {
 	pathFs     *pathfs.PathNodeFs
 	server     *fuse.Server
 	meta       meta.MetaStore
+	usage      *watcher.Usage
+	pins       *watcher.Pins
+	blobs      *blobs.Cache
+	offline    *watcher.Offline
+	filesys    *fileSystem
+
+	// one prefetch at a time
+	prefetchLock sync.Mutex
+	progressLock sync.Mutex
+	progress     Progress
+
+	recordLock sync.Mutex
+	recording  *recording
+	// recordMode is what is recorded, read without the lock on every access
+	recordMode int32
+}
+
+// Options are the mount options of a filesystem
+type Options struct {
+	ReadOnly bool
+	// Usage is told about the files opened, for the cache manager
+	Usage *watcher.Usage
+	// Pins are the paths prefetched by Prefetch
+	Pins *watcher.Pins
+	// Blobs is the blob cache shared by the mounts of the node, the cached
+	// files are links to its blobs
+	Blobs *blobs.Cache
+	// Offline is the offline mode of the mount, shared with the cache
+	// manager
+	Offline *watcher.Offline
 }
 
 // NewFS creates new fuse filesystem using hanwen/go-fuse lib
-func NewFS(mountpoint string, backend *config.Backend, storage storage.Storage, meta meta.MetaStore, readOnly bool) (*FS, error) {
+func NewFS(mountpoint string, backend *config.Backend, storage storage.Storage, meta meta.MetaStore, options Options) (*FS, error) {
 	fs := &FS{
 		mountpoint: mountpoint,
 		backend:    backend,
 		stor:       storage,
 		meta:       meta,
+		usage:      options.Usage,
+		pins:       options.Pins,
+		blobs:      options.Blobs,
+		offline:    options.Offline,
 	}
 
 	filesys := newFileSystem(fs)
-	if readOnly {
+	fs.filesys = filesys.(*fileSystem)
+	if options.ReadOnly {
 		filesys = pathfs.NewReadonlyFileSystem(filesys)
 	}
 
@@ -49,7 +87,7 @@ func NewFS(mountpoint string, backend *config.Backend, storage storage.Storage,
 		AttrTimeout:     time.Second,
 		EntryTimeout:    time.Second,
 	}
-	fs.pathFs = pathfs.NewPathNodeFs(filesys, nil)
+	fs.pathFs = newPathNodeFs(filesys)
 	fs.conn = nodefs.NewFileSystemConnector(fs.pathFs.Root(), opts)
 
 	mOpts := &fuse.MountOptions{
@@ -57,6 +95,11 @@ func NewFS(mountpoint string, backend *config.Backend, storage storage.Storage,
 		Name:       "g8osfs",
 		FsName:     fs.backend.Path,
 	}
+	// the mount is shared by all the users, so the kernel checks their
+	// permissions on every operation against the file attributes
+	if mOpts.AllowOther {
+		mOpts.Options = append(mOpts.Options, "default_permissions")
+	}
 	state, err := fuse.NewServer(fs.conn.RawFS(), mountpoint, mOpts)
 	if err != nil {
 		return fs, err
@@ -67,6 +110,12 @@ func NewFS(mountpoint string, backend *config.Backend, storage storage.Storage,
 	return fs, nil
 }
 
+// newPathNodeFs returns the node file system of filesys, the nodes of the
+// paths with the same inode are shared so hard links work
+func newPathNodeFs(filesys pathfs.FileSystem) *pathfs.PathNodeFs {
+	return pathfs.NewPathNodeFs(filesys, &pathfs.PathNodeFsOptions{ClientInodes: true})
+}
+
 func (fs *FS) Serve() {
 	fs.server.Serve()
 }
@@ -0,0 +1,85 @@
+package files
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/g8os/fs/meta"
+	"github.com/g8os/fs/watcher"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// ErrNotFound is the error of ListCached when its directory doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// ErrOffline is the error of the files that are not cached while the mount is
+// offline, so the applications can tell it from a failed download
+var ErrOffline = fuse.Status(syscall.ENETDOWN)
+
+// Offline returns the offline mode of the mount
+func (fs *FS) Offline() *watcher.Offline {
+	return fs.offline
+}
+
+// CachedFile is a file of the mount, Cached if it can be read offline
+type CachedFile struct {
+	// Name is the mount path of the file, starting with /
+	Name   string
+	Size   uint64
+	Cached bool
+}
+
+// ListCached calls fn with the files under dir, a mount path, in the order of
+// their names. It stops at the first error of fn.
+func (fs *FS) ListCached(dir string, fn func(f CachedFile) error) error {
+	return fs.listCached(strings.Trim(path.Clean("/"+dir), "/"), fn)
+}
+
+func (fs *FS) listCached(dir string, fn func(f CachedFile) error) error {
+	m, exists := fs.meta.Get(dir)
+	if !exists {
+		return ErrNotFound
+	}
+
+	var children []meta.Meta
+	for child := range m.Children() {
+		children = append(children, child)
+	}
+	sort.Sort(byName(children))
+
+	for _, child := range children {
+		name := path.Join(dir, child.Name())
+		md, err := child.Load()
+		if err != nil {
+			log.Warningf("Can't list '%s': %s", name, err)
+			continue
+		}
+
+		switch md.Filetype {
+		case syscall.S_IFDIR:
+			if err := fs.listCached(name, fn); err != nil {
+				return err
+			}
+		case syscall.S_IFREG:
+			f := CachedFile{
+				Name:   "/" + name,
+				Size:   md.Size,
+				Cached: fs.filesys.checkExist(fs.filesys.GetPath(name)) || fs.filesys.blobCached(md),
+			}
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type byName []meta.Meta
+
+func (m byName) Len() int           { return len(m) }
+func (m byName) Less(i, j int) bool { return m[i].Name() < m[j].Name() }
+func (m byName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
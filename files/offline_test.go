@@ -0,0 +1,64 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/g8os/fs/blobs"
+	"github.com/g8os/fs/watcher"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffline(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	cache, err := blobs.NewCache(filepath.Join(fs.Root, ".blobs"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	fs.blobs = cache
+	fs.filesys = fs
+	hello, bye := hashOf("hello world"), hashOf("bye")
+	fs.stor = memStorage{hello: brotliStored([]byte("hello world")), bye: brotliStored([]byte("bye"))}
+	fs.offline = watcher.NewOffline(fs.stor, false)
+
+	fs.meta.CreateDir("dir")
+	flistFile(t, fs, "dir/cached", hello, 11)
+	flistFile(t, fs, "dir/missing", bye, 3)
+	flistFile(t, fs, "blob", hello, 11)
+	_, _, st := fs.fetch("dir/cached")
+	assert.Equal(t, fuse.OK, st)
+
+	fs.offline.Set(true)
+	context := &fuse.Context{}
+	_, st = fs.Open("dir/missing", uint32(os.O_RDONLY), context)
+	assert.Equal(t, ErrOffline, st)
+
+	// the files in the blob cache are still there
+	file, st := fs.Open("blob", uint32(os.O_RDONLY), context)
+	if assert.Equal(t, fuse.OK, st) {
+		file.Release()
+	}
+
+	var list []CachedFile
+	err = fs.ListCached("/", func(f CachedFile) error {
+		list = append(list, f)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []CachedFile{
+		{Name: "/blob", Size: 11, Cached: true},
+		{Name: "/dir/cached", Size: 11, Cached: true},
+		{Name: "/dir/missing", Size: 3, Cached: false},
+	}, list)
+	assert.Equal(t, ErrNotFound, fs.ListCached("/nothing", nil))
+
+	fs.offline.Set(false)
+	file, st = fs.Open("dir/missing", uint32(os.O_RDONLY), context)
+	if assert.Equal(t, fuse.OK, st) {
+		file.Release()
+	}
+}
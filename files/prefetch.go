@@ -0,0 +1,146 @@
+package files
+
+import (
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/g8os/fs/storage"
+	"github.com/g8os/fs/watcher"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// prefetchWorkers is the number of pinned files downloaded at once, and the
+// default for the replay of a profile
+const prefetchWorkers = 4
+
+// Progress is the state of a prefetch of a mount
+type Progress struct {
+	// Kind is what's prefetched: the pinned files (pins) or the files of
+	// a prefetch profile (profile)
+	Kind    string `json:"kind"`
+	Running bool   `json:"running"`
+	// Files is the number of files to prefetch found so far, Fetched the
+	// ones in the cache and Failed the ones that couldn't be downloaded
+	Files   int64 `json:"files"`
+	Fetched int64 `json:"fetched"`
+	Failed  int64 `json:"failed"`
+	// Bytes is the size of the fetched files
+	Bytes    uint64    `json:"bytes"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// Pins returns the pins of the mount
+func (fs *FS) Pins() *watcher.Pins {
+	return fs.pins
+}
+
+// PrefetchProgress returns the state of the last prefetch
+func (fs *FS) PrefetchProgress() Progress {
+	fs.progressLock.Lock()
+	defer fs.progressLock.Unlock()
+	return fs.progress
+}
+
+func (fs *FS) updateProgress(update func(p *Progress)) {
+	fs.progressLock.Lock()
+	defer fs.progressLock.Unlock()
+	update(&fs.progress)
+}
+
+// Prefetch downloads the pinned files that are not cached yet
+func (fs *FS) Prefetch() {
+	fs.prefetch("pins", prefetchWorkers, func(names chan<- string) {
+		fs.walkPinned("", names)
+	})
+}
+
+// prefetch downloads the files sent by walk with workers downloads at once,
+// in about the order they are sent. One prefetch runs at a time, another one
+// waits for the running one to be over.
+func (fs *FS) prefetch(kind string, workers int, walk func(names chan<- string)) {
+	fs.prefetchLock.Lock()
+	defer fs.prefetchLock.Unlock()
+
+	log.Infof("Prefetching the %s of %s", kind, fs.mountpoint)
+	fs.updateProgress(func(p *Progress) {
+		*p = Progress{Kind: kind, Running: true, Started: time.Now()}
+	})
+
+	names := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				fs.prefetchFile(name)
+			}
+		}()
+	}
+
+	walk(names)
+	close(names)
+	wg.Wait()
+
+	fs.updateProgress(func(p *Progress) {
+		p.Running = false
+		p.Finished = time.Now()
+		log.Infof("Prefetched %d files of the %s of %s (%d bytes), %d failed", p.Fetched, kind, fs.mountpoint, p.Bytes, p.Failed)
+	})
+}
+
+// walkPinned sends the pinned files under dir to names, skipping the
+// directories where nothing can be pinned
+func (fs *FS) walkPinned(dir string, names chan<- string) {
+	m, exists := fs.meta.Get(dir)
+	if !exists {
+		return
+	}
+
+	// the children are all read before going down, the stores don't
+	// have to serve several listings at once
+	var dirs []string
+	for child := range m.Children() {
+		name := path.Join(dir, child.Name())
+		md, err := child.Load()
+		if err != nil {
+			log.Warningf("Can't prefetch '%s': %s", name, err)
+			continue
+		}
+
+		switch md.Filetype {
+		case syscall.S_IFDIR:
+			if fs.pins.MatchUnder(name) {
+				dirs = append(dirs, name)
+			}
+		case syscall.S_IFREG:
+			if fs.pins.Match(name) {
+				fs.updateProgress(func(p *Progress) { p.Files++ })
+				names <- name
+			}
+		}
+	}
+
+	for _, name := range dirs {
+		fs.walkPinned(name, names)
+	}
+}
+
+// prefetchFile fetches name, after the files the applications are waiting
+// for
+func (fs *FS) prefetchFile(name string) {
+	_, md, st := fs.filesys.fetchFrom(name, storage.WithPriority(fs.stor, storage.Background))
+	if st != fuse.OK {
+		log.Warningf("Failed to prefetch '%s': %s", name, st)
+		fs.updateProgress(func(p *Progress) { p.Failed++ })
+		return
+	}
+
+	fs.updateProgress(func(p *Progress) {
+		p.Fetched++
+		p.Bytes += md.Size
+	})
+}
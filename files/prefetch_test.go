@@ -0,0 +1,44 @@
+package files
+
+import (
+	"testing"
+
+	"github.com/g8os/fs/watcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetch(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	pins, err := watcher.NewPins([]string{"/lib/**/*.so", "/etc"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fs.pins = pins
+	fs.filesys = fs
+	fs.stor = memStorage{"aa": brotliStored([]byte("hello world"))}
+
+	for _, dir := range []string{"lib", "lib/x", "etc", "bin"} {
+		fs.meta.CreateDir(dir)
+	}
+	flistFile(t, fs, "lib/x/libc.so", "aa", 11)
+	flistFile(t, fs, "lib/x/libc.a", "aa", 11)
+	flistFile(t, fs, "etc/hosts", "aa", 11)
+	flistFile(t, fs, "etc/broken", "missing", 11)
+	flistFile(t, fs, "bin/sh", "aa", 11)
+
+	fs.Prefetch()
+
+	assert.True(t, fs.checkExist(fs.GetPath("lib/x/libc.so")))
+	assert.True(t, fs.checkExist(fs.GetPath("etc/hosts")))
+	assert.False(t, fs.checkExist(fs.GetPath("lib/x/libc.a")))
+	assert.False(t, fs.checkExist(fs.GetPath("bin/sh")))
+
+	progress := fs.PrefetchProgress()
+	assert.False(t, progress.Running)
+	assert.Equal(t, int64(3), progress.Files)
+	assert.Equal(t, int64(2), progress.Fetched)
+	assert.Equal(t, int64(1), progress.Failed)
+	assert.Equal(t, uint64(22), progress.Bytes)
+}
@@ -0,0 +1,198 @@
+package files
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A prefetch profile is the ordered list of the files an application opens,
+// replayed by later mounts of the same flist to warm the cache before the
+// application asks for the files. It's a text file with one file per line,
+// in the order of the first open:
+//
+//	/usr/bin/python2.7
+//	/usr/lib/libpython2.7.so.1.0|0+4096,1048576+65536
+//
+// The optional ranges after | are the byte ranges read, as offset+length.
+
+// Range is a range of bytes read from a file
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+func (r Range) end() int64 {
+	return r.Offset + r.Length
+}
+
+// ProfileEntry is a file of a prefetch profile
+type ProfileEntry struct {
+	// Name is the mount path of the file, starting with /
+	Name   string
+	Ranges []Range
+}
+
+type Profile []ProfileEntry
+
+// hasRanges tells if the profile was recorded with the byte ranges read
+func (p Profile) hasRanges() bool {
+	for _, entry := range p {
+		if len(entry.Ranges) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type byOffset []Range
+
+func (r byOffset) Len() int           { return len(r) }
+func (r byOffset) Less(i, j int) bool { return r[i].Offset < r[j].Offset }
+func (r byOffset) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// addRange adds r to the sorted ranges, merging the ranges that overlap or
+// touch
+func addRange(ranges []Range, r Range) []Range {
+	if r.Length <= 0 {
+		return ranges
+	}
+
+	ranges = append(ranges, r)
+	sort.Sort(byOffset(ranges))
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.Offset <= last.end() {
+			if r.end() > last.end() {
+				last.Length = r.end() - last.Offset
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// ReadProfile parses a prefetch profile
+func ReadProfile(r io.Reader) (Profile, error) {
+	var profile Profile
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry, err := parseProfileLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		profile = append(profile, entry)
+	}
+
+	return profile, scanner.Err()
+}
+
+func parseProfileLine(line string) (ProfileEntry, error) {
+	parts := strings.SplitN(line, "|", 2)
+	entry := ProfileEntry{Name: parts[0]}
+	if !strings.HasPrefix(entry.Name, "/") {
+		return entry, fmt.Errorf("invalid path '%s', not an absolute path", entry.Name)
+	}
+	for _, part := range strings.Split(entry.Name, "/") {
+		if part == ".." {
+			return entry, fmt.Errorf("invalid path '%s', out of the mount", entry.Name)
+		}
+	}
+	entry.Name = path.Clean(entry.Name)
+
+	if len(parts) == 1 || parts[1] == "" {
+		return entry, nil
+	}
+
+	for _, field := range strings.Split(parts[1], ",") {
+		i := strings.Index(field, "+")
+		if i < 0 {
+			return entry, fmt.Errorf("invalid range '%s', expected offset+length", field)
+		}
+
+		offset, err := strconv.ParseInt(field[:i], 10, 64)
+		if err != nil || offset < 0 {
+			return entry, fmt.Errorf("invalid range offset '%s'", field[:i])
+		}
+		length, err := strconv.ParseInt(field[i+1:], 10, 64)
+		if err != nil || length <= 0 {
+			return entry, fmt.Errorf("invalid range length '%s'", field[i+1:])
+		}
+
+		entry.Ranges = append(entry.Ranges, Range{Offset: offset, Length: length})
+	}
+
+	return entry, nil
+}
+
+// Write writes the profile in its text format
+func (p Profile) Write(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	for _, entry := range p {
+		buf.WriteString(entry.Name)
+		for i, r := range entry.Ranges {
+			if i == 0 {
+				buf.WriteString("|")
+			} else {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(buf, "%d+%d", r.Offset, r.Length)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Flush()
+}
+
+// ReadProfileFile reads the prefetch profile name
+func ReadProfileFile(name string) (Profile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadProfile(file)
+}
+
+// WriteProfileFile replaces the prefetch profile name, atomically so a mount
+// never replays a partial profile
+func WriteProfileFile(name string, p Profile) error {
+	file, err := ioutil.TempFile(filepath.Dir(name), "."+path.Base(name))
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+
+	err = p.Write(file)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
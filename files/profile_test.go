@@ -0,0 +1,128 @@
+package files
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddRange(t *testing.T) {
+	var ranges []Range
+	ranges = addRange(ranges, Range{Offset: 100, Length: 10})
+	ranges = addRange(ranges, Range{Offset: 0, Length: 10})
+	ranges = addRange(ranges, Range{Offset: 10, Length: 5})
+	ranges = addRange(ranges, Range{Offset: 105, Length: 20})
+	ranges = addRange(ranges, Range{Offset: 50, Length: 0})
+
+	assert.Equal(t, []Range{{0, 15}, {100, 25}}, ranges)
+}
+
+func TestProfileFormat(t *testing.T) {
+	profile := Profile{
+		{Name: "/usr/bin/python2.7"},
+		{Name: "/usr/lib/libpython2.7.so.1.0", Ranges: []Range{{0, 4096}, {1048576, 65536}}},
+	}
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, profile.Write(&buf)) {
+		return
+	}
+	assert.Equal(t, "/usr/bin/python2.7\n/usr/lib/libpython2.7.so.1.0|0+4096,1048576+65536\n", buf.String())
+
+	parsed, err := ReadProfile(strings.NewReader("# recorded\n\n" + buf.String()))
+	if assert.NoError(t, err) {
+		assert.Equal(t, profile, parsed)
+	}
+
+	dir, err := ioutil.TempDir("", "profile")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "app.flist.prefetch")
+	assert.NoError(t, WriteProfileFile(name, profile))
+	parsed, err = ReadProfileFile(name)
+	if assert.NoError(t, err) {
+		assert.Equal(t, profile, parsed)
+	}
+
+	for _, bad := range []string{"usr/bin/python", "/a|0", "/a|x+1", "/a|0+0", "/a|-1+10", "/../etc/passwd", "/a/../../b"} {
+		_, err := ReadProfile(strings.NewReader(bad))
+		assert.Error(t, err, bad)
+	}
+
+	parsed, err = ReadProfile(strings.NewReader("//usr/./bin/\n"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/usr/bin", parsed[0].Name)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	fs.filesys = fs
+	fs.stor = memStorage{"aa": brotliStored([]byte("hello world"))}
+	for _, name := range []string{"b", "a", "c"} {
+		flistFile(t, fs, name, "aa", 11)
+	}
+
+	context := &fuse.Context{}
+	open := func(name string) {
+		file, st := fs.Open(name, uint32(os.O_RDONLY), context)
+		if assert.Equal(t, fuse.OK, st) {
+			file.Read(make([]byte, 4), 2)
+			file.Read(make([]byte, 4), 6)
+			file.Release()
+		}
+	}
+
+	open("c")
+	assert.NoError(t, fs.StartRecording(true))
+	assert.Error(t, fs.StartRecording(false))
+	assert.True(t, fs.Recording())
+	open("b")
+	open("a")
+	open("b")
+
+	profile, err := fs.StopRecording()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, fs.Recording())
+	_, err = fs.StopRecording()
+	assert.Error(t, err)
+
+	assert.Equal(t, Profile{
+		{Name: "/b", Ranges: []Range{{2, 8}}},
+		{Name: "/a", Ranges: []Range{{2, 8}}},
+	}, profile)
+
+	// a fresh cache is warmed by the replay
+	for _, name := range []string{"a", "b", "c"} {
+		os.Remove(fs.GetPath(name))
+	}
+	// c is opened but not read, it's not prefetched
+	fs.Replay(append(profile, ProfileEntry{Name: "/missing", Ranges: []Range{{0, 1}}}, ProfileEntry{Name: "/c"}), 2)
+
+	assert.True(t, fs.checkExist(fs.GetPath("a")))
+	assert.True(t, fs.checkExist(fs.GetPath("b")))
+	assert.False(t, fs.checkExist(fs.GetPath("c")))
+
+	progress := fs.PrefetchProgress()
+	assert.Equal(t, "profile", progress.Kind)
+	assert.Equal(t, int64(3), progress.Files)
+	assert.Equal(t, int64(2), progress.Fetched)
+	assert.Equal(t, int64(1), progress.Failed)
+
+	// without the ranges, every file opened is prefetched
+	fs.Replay(Profile{{Name: "/c"}}, 2)
+	assert.True(t, fs.checkExist(fs.GetPath("c")))
+}
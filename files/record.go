@@ -0,0 +1,136 @@
+package files
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// modes of a recording
+const (
+	recordOff int32 = iota
+	recordOpens
+	recordRanges
+)
+
+// recording is the trace of the files opened through a mount
+type recording struct {
+	ranges  bool
+	index   map[string]int
+	profile Profile
+}
+
+// StartRecording starts recording the files opened through the mount, and
+// the byte ranges read from them if ranges is set
+func (fs *FS) StartRecording(ranges bool) error {
+	fs.recordLock.Lock()
+	defer fs.recordLock.Unlock()
+
+	if fs.recording != nil {
+		return fmt.Errorf("%s is already recording", fs.mountpoint)
+	}
+
+	log.Infof("Recording the accesses to %s", fs.mountpoint)
+	fs.recording = &recording{
+		ranges: ranges,
+		index:  make(map[string]int),
+	}
+
+	mode := recordOpens
+	if ranges {
+		mode = recordRanges
+	}
+	atomic.StoreInt32(&fs.recordMode, mode)
+	return nil
+}
+
+// StopRecording stops the recording and returns the profile of the files
+// opened, in the order of their first open
+func (fs *FS) StopRecording() (Profile, error) {
+	fs.recordLock.Lock()
+	defer fs.recordLock.Unlock()
+
+	if fs.recording == nil {
+		return nil, fmt.Errorf("%s is not recording", fs.mountpoint)
+	}
+
+	profile := fs.recording.profile
+	fs.recording = nil
+	atomic.StoreInt32(&fs.recordMode, recordOff)
+	log.Infof("Recorded %d files opened in %s", len(profile), fs.mountpoint)
+	return profile, nil
+}
+
+// Recording returns true if the accesses to the mount are recorded
+func (fs *FS) Recording() bool {
+	fs.recordLock.Lock()
+	defer fs.recordLock.Unlock()
+	return fs.recording != nil
+}
+
+// entry returns the profile entry of name, added at the end of the profile
+// the first time
+func (r *recording) entry(name string) *ProfileEntry {
+	name = path.Clean("/" + name)
+	i, ok := r.index[name]
+	if !ok {
+		r.profile = append(r.profile, ProfileEntry{Name: name})
+		i = len(r.profile) - 1
+		r.index[name] = i
+	}
+	return &r.profile[i]
+}
+
+func (fs *FS) recordOpen(name string) {
+	if atomic.LoadInt32(&fs.recordMode) == recordOff {
+		return
+	}
+
+	fs.recordLock.Lock()
+	defer fs.recordLock.Unlock()
+
+	if fs.recording != nil {
+		fs.recording.entry(name)
+	}
+}
+
+// recordRead is called on every read, it doesn't lock unless the ranges are
+// recorded
+func (fs *FS) recordRead(name string, off int64, size int) {
+	if atomic.LoadInt32(&fs.recordMode) != recordRanges {
+		return
+	}
+
+	fs.recordLock.Lock()
+	defer fs.recordLock.Unlock()
+
+	if fs.recording == nil || !fs.recording.ranges {
+		return
+	}
+
+	// a file open before the recording started is recorded at its first read
+	entry := fs.recording.entry(name)
+	entry.Ranges = addRange(entry.Ranges, Range{Offset: off, Length: int64(size)})
+}
+
+// Replay prefetches the files of a profile in their order, with workers
+// downloads at once. The files are fetched whole, so the ranges only limit
+// the prefetch: when the profile was recorded with the ranges, the files
+// opened but never read are skipped.
+func (fs *FS) Replay(profile Profile, workers int) {
+	if workers <= 0 {
+		workers = prefetchWorkers
+	}
+
+	ranges := profile.hasRanges()
+	fs.prefetch("profile", workers, func(names chan<- string) {
+		for _, entry := range profile {
+			if ranges && len(entry.Ranges) == 0 {
+				continue
+			}
+			fs.updateProgress(func(p *Progress) { p.Files++ })
+			names <- strings.TrimPrefix(entry.Name, "/")
+		}
+	})
+}
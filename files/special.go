@@ -0,0 +1,92 @@
+package files
+
+import (
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/g8os/fs/meta"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// metaOnly returns true for the file types that only live in the meta store.
+// Device nodes, fifos and sockets have no content: the kernel serves them
+// from the attributes returned by GetAttr, and symlinks are just their
+// target. Nothing is created in the backend for them.
+func metaOnly(filetype uint32) bool {
+	switch filetype {
+	case syscall.S_IFCHR, syscall.S_IFBLK, syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFLNK:
+		return true
+	}
+	return false
+}
+
+// mkdev encodes a device number the way the kernel expects it in the fuse
+// attributes (new_encode_dev)
+func mkdev(major, minor int64) uint32 {
+	return uint32((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12))
+}
+
+// splitdev decodes a device number received from the kernel
+func splitdev(dev uint32) (int64, int64) {
+	major := int64((dev >> 8) & 0xfff)
+	minor := int64((dev & 0xff) | ((dev >> 12) & 0xfff00))
+	return major, minor
+}
+
+// Mknod creates a device node, a fifo or a socket in the meta store. Regular
+// files are also created in the backend.
+func (fs *fileSystem) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	log.Debugf("Mknod:%v %o", name, mode)
+
+	filetype := mode & syscall.S_IFMT
+	if filetype != syscall.S_IFREG && !metaOnly(filetype) {
+		return fuse.EINVAL
+	}
+
+	if _, exists := fs.meta.Get(path.Dir(name)); !exists {
+		return fuse.ENOENT
+	}
+
+	if _, exists := fs.meta.Get(name); exists {
+		return fuse.Status(syscall.EEXIST)
+	}
+
+	if filetype == syscall.S_IFREG {
+		if st := fs.populateDirFile(path.Dir(name)); st != fuse.OK {
+			return st
+		}
+		f, err := os.OpenFile(fs.GetPath(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(mode&07777))
+		if err != nil {
+			return fuse.ToStatus(err)
+		}
+		f.Close()
+	}
+
+	m, err := fs.meta.CreateFile(name)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+
+	data, err := m.Load()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+
+	md := &meta.MetaData{
+		Inode:       data.Inode,
+		Filetype:    filetype,
+		Permissions: mode & 07777,
+		Uid:         context.Uid,
+		Gid:         context.Gid,
+	}
+	md.SetTimes(time.Now())
+
+	if filetype == syscall.S_IFCHR || filetype == syscall.S_IFBLK {
+		md.DevMajor, md.DevMinor = splitdev(dev)
+	}
+
+	m.SetStat(m.Stat().SetModified(true))
+	return fuse.ToStatus(m.Save(md))
+}
@@ -0,0 +1,18 @@
+package files
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceNumbers(t *testing.T) {
+	// /dev/null
+	assert.Equal(t, uint32(0x103), mkdev(1, 3))
+
+	for _, dev := range [][2]int64{{1, 3}, {8, 0}, {259, 1}, {10, 300}, {4095, 1048575}} {
+		major, minor := splitdev(mkdev(dev[0], dev[1]))
+		assert.Equal(t, dev[0], major)
+		assert.Equal(t, dev[1], minor)
+	}
+}
@@ -0,0 +1,68 @@
+package files
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/g8os/fs/codec"
+	"github.com/g8os/fs/storage"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestStorServer reads a file downloaded from a stor server
+func TestStorServer(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	dir := fs.GetPath(".stor")
+	server := httptest.NewServer(&storage.Server{Dir: dir})
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/ns")
+	stor, err := storage.NewAydoStorage(u)
+	if !assert.NoError(t, err) {
+		return
+	}
+	hello, zstd := hashOf("hello world"), hashOf("zstd blob")
+	err = stor.(storage.Uploader).Put(hello, bytes.NewReader(brotliStored([]byte("hello world"))))
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = stor.(storage.Uploader).Put(zstd, codec.Encode(codec.Zstd, strings.NewReader("zstd blob")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	fs.stor = stor
+
+	flistFile(t, fs, "zstd", zstd, 9)
+	_, _, st := fs.fetch("zstd")
+	if assert.Equal(t, fuse.OK, st) {
+		data, _ := ioutil.ReadFile(fs.GetPath("zstd"))
+		assert.Equal(t, "zstd blob", string(data))
+	}
+
+	flistFile(t, fs, "file", hello, 11)
+	flistFile(t, fs, "missing", "bb", 11)
+
+	file, st := fs.Open("file", uint32(os.O_RDONLY), &fuse.Context{})
+	if !assert.Equal(t, fuse.OK, st) {
+		return
+	}
+	defer file.Release()
+
+	buf := make([]byte, 5)
+	result, st := file.Read(buf, 6)
+	if assert.Equal(t, fuse.OK, st) {
+		data, _ := result.Bytes(buf)
+		assert.Equal(t, "world", string(data))
+	}
+
+	_, st = fs.Open("missing", uint32(os.O_RDONLY), &fuse.Context{})
+	assert.Equal(t, fuse.EIO, st)
+}
@@ -1,16 +0,0 @@
-package files
-
-import (
-	"syscall"
-	"unsafe"
-)
-
-// futimens - futimens(3) calls utimensat(2) with "pathname" set to null and
-// "flags" set to zero
-func futimens(fd int, times *[2]syscall.Timespec) (err error) {
-	_, _, e1 := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(fd), 0, uintptr(unsafe.Pointer(times)), uintptr(0), 0, 0)
-	if e1 != 0 {
-		err = syscall.Errno(e1)
-	}
-	return
-}
@@ -0,0 +1,136 @@
+package files
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func attrTimes(attr *fuse.Attr) (time.Time, time.Time, time.Time) {
+	return time.Unix(int64(attr.Atime), int64(attr.Atimensec)),
+		time.Unix(int64(attr.Mtime), int64(attr.Mtimensec)),
+		time.Unix(int64(attr.Ctime), int64(attr.Ctimensec))
+}
+
+func TestUtimens(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	context := &fuse.Context{}
+	file, st := fs.Create("file", uint32(os.O_WRONLY), 0644, context)
+	if !assert.Equal(t, fuse.OK, st) {
+		return
+	}
+	file.Release()
+
+	atime := time.Unix(1470000000, 123456789)
+	mtime := time.Unix(1460000000, 987654321)
+	assert.Equal(t, fuse.OK, fs.Utimens("file", &atime, &mtime, context))
+
+	attr, st := fs.GetAttr("file", context)
+	if !assert.Equal(t, fuse.OK, st) {
+		return
+	}
+	a, m, c := attrTimes(attr)
+	assert.Equal(t, atime, a)
+	assert.Equal(t, mtime, m)
+	assert.True(t, c.After(mtime))
+
+	// the backend file has the same times
+	info, err := os.Stat(fs.GetPath("file"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, mtime, info.ModTime())
+	}
+
+	// a nil time (UTIME_OMIT) is left unchanged
+	other := time.Unix(1450000000, 1)
+	assert.Equal(t, fuse.OK, fs.Utimens("file", nil, &other, context))
+	attr, _ = fs.GetAttr("file", context)
+	a, m, _ = attrTimes(attr)
+	assert.Equal(t, atime, a)
+	assert.Equal(t, other, m)
+
+	assert.Equal(t, fuse.OK, fs.Utimens("file", &other, nil, context))
+	attr, _ = fs.GetAttr("file", context)
+	a, m, _ = attrTimes(attr)
+	assert.Equal(t, other, a)
+	assert.Equal(t, other, m)
+}
+
+func TestTimesChange(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	context := &fuse.Context{}
+	file, st := fs.Create("file", uint32(os.O_WRONLY), 0644, context)
+	if !assert.Equal(t, fuse.OK, st) {
+		return
+	}
+	file.Release()
+
+	old := time.Unix(1470000000, 0)
+	assert.Equal(t, fuse.OK, fs.Utimens("file", &old, &old, context))
+
+	// a write changes the mtime and ctime once flushed
+	file, st = fs.Open("file", uint32(os.O_WRONLY), context)
+	if !assert.Equal(t, fuse.OK, st) {
+		return
+	}
+	_, st = file.Write([]byte("hello"), 0)
+	assert.Equal(t, fuse.OK, st)
+	assert.Equal(t, fuse.OK, file.Flush())
+	file.Release()
+
+	attr, _ := fs.GetAttr("file", context)
+	a, m, c := attrTimes(attr)
+	assert.Equal(t, old, a)
+	assert.True(t, m.After(old))
+	assert.Equal(t, m, c)
+	assert.Equal(t, uint64(5), attr.Size)
+
+	// a metadata change only changes the ctime
+	assert.Equal(t, fuse.OK, fs.Utimens("file", &old, &old, context))
+	assert.Equal(t, fuse.OK, fs.Chmod("file", 0600, context))
+	attr, _ = fs.GetAttr("file", context)
+	_, m, c = attrTimes(attr)
+	assert.Equal(t, old, m)
+	assert.True(t, c.After(old))
+}
+
+func TestUtimensFlistFile(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	stor := &countingStorage{Storage: memStorage{"aa": brotliStored([]byte("hello"))}}
+	fs.stor = stor
+	m := flistFile(t, fs, "file", "aa", 5)
+
+	// a time change doesn't download nor copy up the file
+	context := &fuse.Context{}
+	mtime := time.Unix(1470000000, 0)
+	assert.Equal(t, fuse.OK, fs.Utimens("file", nil, &mtime, context))
+	assert.Equal(t, 0, stor.gets)
+	assert.False(t, m.Stat().Modified())
+	_, err := os.Stat(fs.GetPath("file"))
+	assert.True(t, os.IsNotExist(err))
+
+	attr, _ := fs.GetAttr("file", context)
+	_, modTime, _ := attrTimes(attr)
+	assert.Equal(t, mtime, modTime)
+
+	// nor does it once cached, the cached file gets the times
+	_, _, st := fs.fetch("file")
+	if !assert.Equal(t, fuse.OK, st) {
+		return
+	}
+	other := time.Unix(1460000000, 0)
+	assert.Equal(t, fuse.OK, fs.Utimens("file", nil, &other, context))
+	assert.False(t, m.Stat().Modified())
+	info, err := os.Stat(fs.GetPath("file"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, other, info.ModTime())
+	}
+}
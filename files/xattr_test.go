@@ -0,0 +1,68 @@
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/g8os/fs/meta"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXAttr(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	context := &fuse.Context{}
+	file, st := fs.Create("file", uint32(os.O_WRONLY), 0644, context)
+	if !assert.Equal(t, fuse.OK, st) {
+		return
+	}
+	file.Release()
+
+	_, st = fs.GetXAttr("file", "user.a", context)
+	assert.Equal(t, fuse.ENOATTR, st)
+	assert.Equal(t, fuse.ENOATTR, fs.SetXAttr("file", "user.a", []byte("x"), xattrReplace, context))
+
+	assert.Equal(t, fuse.OK, fs.SetXAttr("file", "user.a", []byte("x"), xattrCreate, context))
+	assert.Equal(t, fuse.Status(syscall.EEXIST), fs.SetXAttr("file", "user.a", []byte("y"), xattrCreate, context))
+	assert.Equal(t, fuse.OK, fs.SetXAttr("file", "user.a", []byte("y"), xattrReplace, context))
+	assert.Equal(t, fuse.OK, fs.SetXAttr("file", "user.b", []byte{0, 0xff}, 0, context))
+
+	value, st := fs.GetXAttr("file", "user.a", context)
+	assert.Equal(t, fuse.OK, st)
+	assert.Equal(t, []byte("y"), value)
+	names, st := fs.ListXAttr("file", context)
+	assert.Equal(t, fuse.OK, st)
+	assert.Equal(t, []string{"user.a", "user.b"}, names)
+
+	assert.Equal(t, fuse.OK, fs.RemoveXAttr("file", "user.a", context))
+	assert.Equal(t, fuse.ENOATTR, fs.RemoveXAttr("file", "user.a", context))
+	names, _ = fs.ListXAttr("file", context)
+	assert.Equal(t, []string{"user.b"}, names)
+
+	_, st = fs.ListXAttr("missing", context)
+	assert.Equal(t, fuse.ENOENT, st)
+}
+
+func TestXAttrDir(t *testing.T) {
+	fs, cleanup := testFileSystem(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs.meta = meta.NewFileMetaStore(dir)
+
+	context := &fuse.Context{}
+	assert.Equal(t, fuse.OK, fs.Mkdir("dir", 0755, context))
+	assert.Equal(t, fuse.OK, fs.SetXAttr("dir", "user.a", []byte("x"), 0, context))
+
+	value, st := fs.GetXAttr("dir", "user.a", context)
+	assert.Equal(t, fuse.OK, st)
+	assert.Equal(t, []byte("x"), value)
+}
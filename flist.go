@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/g8os/fs/meta"
+)
+
+func flistUsage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s flist:\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s flist lint [-trim PREFIX] FLIST\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s flist diff [-trim PREFIX] [-lenient] OLD NEW\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s flist stats [-trim PREFIX] [-lenient] [-top N] FLIST\n", progName)
+}
+
+// flistCommand runs the `flist` sub commands and returns the process exit code
+func flistCommand(args []string) int {
+	if len(args) == 0 {
+		flistUsage()
+		return 2
+	}
+
+	switch args[0] {
+	case "lint":
+		return flistLint(args[1:])
+	case "diff":
+		return flistDiff(args[1:])
+	case "stats":
+		return flistStats(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown flist command '%s'\n", args[0])
+		flistUsage()
+		return 2
+	}
+}
+
+func flistLint(args []string) int {
+	flags := flag.NewFlagSet("flist lint", flag.ExitOnError)
+	trim := flags.String("trim", "", "prefix to trim from flist paths")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flistUsage()
+		return 2
+	}
+
+	name := flags.Arg(0)
+	problems, err := meta.LintFlist(name, *trim)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't read flist %s: %s\n", name, err)
+		return 1
+	}
+
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", name, problem)
+	}
+
+	if len(problems) != 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d problem(s) found\n", name, len(problems))
+		return 1
+	}
+
+	return 0
+}
+
+// populateFlags registers the flags that control flist parsing, so the tools
+// read a flist the same way a mount does
+func populateFlags(flags *flag.FlagSet) *meta.PopulateOptions {
+	opts := &meta.PopulateOptions{}
+	flags.StringVar(&opts.Trim, "trim", "", "prefix to trim from flist paths")
+	flags.BoolVar(&opts.Lenient, "lenient", false, "skip malformed lines instead of failing")
+	flags.IntVar(&opts.Workers, "workers", 0, "number of parsing goroutines (default: number of CPUs)")
+	return opts
+}
+
+func flistDiff(args []string) int {
+	flags := flag.NewFlagSet("flist diff", flag.ExitOnError)
+	opts := populateFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flistUsage()
+		return 2
+	}
+
+	changes, err := meta.DiffFlist(flags.Arg(0), flags.Arg(1), *opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	var added, removed, changed int
+	var delta int64
+	for _, change := range changes {
+		switch change.Kind {
+		case meta.Added:
+			added++
+		case meta.Removed:
+			removed++
+		case meta.Changed:
+			changed++
+		}
+		delta += change.SizeDelta()
+
+		line := fmt.Sprintf("%s %s %+d", change.Kind, change.Path, change.SizeDelta())
+		if details := change.Details(); len(details) != 0 {
+			line = fmt.Sprintf("%s (%s)", line, strings.Join(details, ", "))
+		}
+		fmt.Println(line)
+	}
+
+	fmt.Printf("%d added, %d removed, %d changed, size delta %+d bytes\n", added, removed, changed, delta)
+	return 0
+}
+
+func flistStats(args []string) int {
+	flags := flag.NewFlagSet("flist stats", flag.ExitOnError)
+	opts := populateFlags(flags)
+	top := flags.Int("top", 10, "number of largest files to show")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flistUsage()
+		return 2
+	}
+
+	stats, err := meta.StatFlist(flags.Arg(0), *opts, *top)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	fmt.Printf("entries:         %d\n", stats.Entries)
+	fmt.Printf("logical size:    %d bytes\n", stats.TotalSize)
+	fmt.Printf("unique size:     %d bytes\n", stats.UniqueSize)
+	fmt.Printf("distinct hashes: %d\n", stats.DistinctHashes)
+	fmt.Printf("dedupe ratio:    %.2f\n", stats.DedupeRatio())
+
+	types := make([]string, 0, len(stats.Types))
+	for filetype, count := range stats.Types {
+		types = append(types, fmt.Sprintf("  %-13s %d", meta.FileTypeName(filetype), count))
+	}
+	sort.Strings(types)
+	fmt.Println("file types:")
+	for _, line := range types {
+		fmt.Println(line)
+	}
+
+	fmt.Println("largest files:")
+	for _, entry := range stats.Largest {
+		fmt.Printf("  %12d %s\n", entry.Filesize, entry.Filepath)
+	}
+
+	return 0
+}
@@ -15,6 +15,7 @@ import (
 	"strings"
 
 	"github.com/g8os/fs/config"
+	"github.com/g8os/fs/storage"
 	"github.com/op/go-logging"
 	"github.com/robfig/cron"
 )
@@ -33,6 +34,8 @@ var (
 type Options struct {
 	Version    bool
 	Pprof      bool
+	Admin      string
+	AdminAuth  string
 	ConfigPath string
 	AutoConfig bool
 	LogLevel   int
@@ -46,6 +49,8 @@ func getCMDOptions() Options {
 
 	flag.BoolVar(&opts.Version, "v", false, "show version")
 	flag.BoolVar(&opts.Pprof, "pprof", false, "enable net pprof")
+	flag.StringVar(&opts.Admin, "admin", "", "serve the admin API (pins, prefetch progress) on this address")
+	flag.StringVar(&opts.AdminAuth, "admin-auth", "", "USER:PASSWORD required by the admin API")
 
 	flag.StringVar(&opts.ConfigPath, "config", "config.toml", "path to config file")
 	flag.BoolVar(&opts.AutoConfig, "auto", false, "enable auto configuration")
@@ -62,6 +67,9 @@ func getCMDOptions() Options {
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", progName)
 	fmt.Fprintf(os.Stderr, "  %s MOUNTPOINT\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s flist COMMAND [ARGS]\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s stor serve [ARGS] DIR\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s cached -admin URL [ARGS] MOUNT\n", progName)
 	fmt.Fprintf(os.Stderr, "\n")
 	flag.PrintDefaults()
 }
@@ -78,6 +86,16 @@ func writePidFile() error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "flist" {
+		os.Exit(flistCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stor" {
+		os.Exit(storCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cached" {
+		os.Exit(cachedCommand(os.Args[2:]))
+	}
+
 	opts := getCMDOptions()
 	if opts.Version {
 		fmt.Println("Version: ", version)
@@ -94,6 +112,22 @@ func main() {
 		}()
 	}
 
+	if opts.Admin != "" {
+		var user, password string
+		if opts.AdminAuth != "" {
+			var err error
+			if user, password, err = splitAuth(opts.AdminAuth); err != nil {
+				log.Fatalf("Invalid -admin-auth: %s", err)
+			}
+		} else {
+			log.Warningf("The admin API is served to anyone reaching %s, see -admin-auth", opts.Admin)
+		}
+		log.Infof("starting admin server on %s", opts.Admin)
+		go func() {
+			log.Error(http.ListenAndServe(opts.Admin, adminHandler(user, password)))
+		}()
+	}
+
 	writePidFile()
 
 	cfg := config.LoadConfig(opts.ConfigPath)
@@ -101,6 +135,27 @@ func main() {
 	scheduler := cron.New()
 	scheduler.Start()
 
+	downloads := storage.NewScheduler(int64(cfg.Bandwidth) * 1024)
+
+	blobCache, err := startBlobCache(scheduler, cfg)
+	if err != nil {
+		log.Fatalf("Failed to open the blob cache '%s': %s", cfg.BlobCache, err)
+	}
+
+	if cfg.ServeBlobs != "" {
+		if blobCache == nil {
+			log.Fatalf("Serving the blobs requires a blob cache")
+		}
+		server, err := blobServer(cfg, blobCache)
+		if err != nil {
+			log.Fatalf("Failed to serve the blob cache: %s", err)
+		}
+		log.Infof("serving the blob cache on %s", cfg.ServeBlobs)
+		go func() {
+			log.Error(http.ListenAndServe(cfg.ServeBlobs, server))
+		}()
+	}
+
 	wg := sync.WaitGroup{}
 
 	for _, mount := range cfg.Mount {
@@ -116,26 +171,28 @@ func main() {
 		if err != nil {
 			log.Fatalf("Definition of ayostor %s not found in config, but required for backend %s", backend.Stor, backend.Name)
 		}
-		stor, err := storCfg.GetStorClient()
+		storCfg.SpoolDir = backend.Path
+		client, err := storCfg.GetStorClient()
 		if err != nil {
 			log.Fatal("Failed to initialize stor client %s: %s", storCfg.URL, err)
 		}
+		stor := downloads.Store(storCfg.Name, client, storCfg.Concurrency).For(mount.Path)
 
 		if acl == config.RO {
-			if strings.EqualFold(mount.Flist, "") {
+			if len(mount.FlistLayers()) == 0 {
 				log.Fatalf("RO mount point requires a PList")
 			}
 			wg.Add(1)
 			os.MkdirAll(backend.Path, 0775)
-			go MountROFS(&wg, scheduler, mount, backend, stor, opts)
+			go MountROFS(&wg, scheduler, mount, backend, stor, blobCache, opts)
 		} else if acl == config.OL {
-			if strings.EqualFold(mount.Flist, "") {
+			if len(mount.FlistLayers()) == 0 {
 				log.Fatalf("OL mount point requires a PList")
 			}
 
 			wg.Add(1)
 			os.MkdirAll(backend.Path, 0775)
-			go MountOLFS(&wg, scheduler, mount, backend, stor, opts)
+			go MountOLFS(&wg, scheduler, mount, backend, stor, blobCache, opts)
 		} else {
 			log.Fatalf("Unknown ACL mode '%s' only (RW, RO, OL) are supported", mount.Mode)
 		}
@@ -6,9 +6,7 @@ import (
 	"github.com/g8os/fs/utils"
 	"io"
 	"os"
-	"os/user"
 	"path"
-	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -53,6 +51,12 @@ func (m metaFile) Load() (*MetaData, error) {
 		return nil, err
 	}
 
+	// hard links share the same meta file, its link count is theirs
+	var st syscall.Stat_t
+	if err := syscall.Stat(string(m), &st); err == nil {
+		meta.Nlink = uint32(st.Nlink)
+	}
+
 	return &meta, nil
 }
 
@@ -73,14 +77,30 @@ func (m metaFile) Children() <-chan Meta {
 	return nil
 }
 
+// metaDir is a directory of the store, its meta data is kept in the meta
+// file DirMeta inside it. A directory without one (created before it existed
+// or by hand) reports the attributes of the store directory.
 type metaDir string
 
+// DirMeta is the name of the meta file of a directory, inside the directory
+const DirMeta = MetaSuffix
+
+func (m metaDir) file() metaFile {
+	return metaFile(path.Join(string(m), DirMeta))
+}
+
 func (m metaDir) Stat() MetaState {
-	return MetaInitial
+	return m.file().Stat()
 }
 
 func (m metaDir) SetStat(state MetaState) {
-	//NOOP
+	file, err := os.OpenFile(string(m.file()), os.O_WRONLY|os.O_CREATE, os.FileMode(state))
+	if err != nil {
+		log.Warningf("Failed to set the state of directory '%s': %s", m, err)
+		return
+	}
+	file.Close()
+	m.file().SetStat(state)
 }
 
 func (m metaDir) String() string {
@@ -101,19 +121,33 @@ func (m metaDir) Load() (*MetaData, error) {
 		return nil, err
 	}
 
-	return &MetaData{
-		Filetype:    syscall.S_IFDIR,
-		Inode:       st.Ino,
-		Ctime:       uint64(st.Ctim.Sec),
-		Mtime:       uint64(st.Mtim.Sec),
-		Uid:         st.Uid,
-		Gid:         st.Gid,
-		Permissions: st.Mode & uint32(os.ModePerm),
-	}, nil
+	meta := &MetaData{}
+	if _, err := toml.DecodeFile(string(m.file()), meta); os.IsNotExist(err) {
+		meta = &MetaData{
+			Ctime:       uint64(st.Ctim.Sec),
+			CtimeNsec:   uint32(st.Ctim.Nsec),
+			Mtime:       uint64(st.Mtim.Sec),
+			MtimeNsec:   uint32(st.Mtim.Nsec),
+			Atime:       uint64(st.Atim.Sec),
+			AtimeNsec:   uint32(st.Atim.Nsec),
+			Uid:         st.Uid,
+			Gid:         st.Gid,
+			Permissions: st.Mode & uint32(os.ModePerm),
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the inode of the store directory is stable, even across populates
+	meta.Filetype = syscall.S_IFDIR
+	meta.Inode = st.Ino
+	return meta, nil
 }
 
 func (m metaDir) Save(meta *MetaData) error {
-	return fmt.Errorf("not supported")
+	data := *meta
+	data.Filetype = syscall.S_IFDIR
+	return m.file().Save(&data)
 }
 
 func (m metaDir) Children() <-chan Meta {
@@ -134,6 +168,9 @@ func (m metaDir) Children() <-chan Meta {
 			}
 
 			for _, entry := range entries {
+				if entry.Name() == DirMeta {
+					continue
+				}
 				fullname := path.Join(string(m), entry.Name())
 				log.Debugf("child: %s", fullname)
 				if entry.IsDir() {
@@ -209,87 +246,162 @@ func (s *fileMetaStore) CreateDir(name string) (Meta, error) {
 }
 
 func (s *fileMetaStore) Delete(meta Meta) error {
+	if dir, ok := meta.(metaDir); ok {
+		return dir.remove()
+	}
 	return os.Remove(meta.String())
 }
 
-func (s *fileMetaStore) Populate(plist string, trim string) error {
-	var parsed = 0
+// remove deletes the directory with its meta file, if it's empty
+func (m metaDir) remove() error {
+	d, err := os.Open(string(m))
+	if err != nil {
+		return err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if name != DirMeta {
+			return &os.PathError{Op: "remove", Path: string(m), Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	if err := os.Remove(string(m.file())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(string(m))
+}
 
-	iter, err := utils.IterFlistFile(plist)
+// Rename moves the meta file, or the directory holding the meta of a whole
+// subtree, to its new path.
+func (s *fileMetaStore) Rename(oldName, newName string) error {
+	oldName, newName, same, err := renamePaths(oldName, newName)
 	if err != nil {
 		return err
 	}
 
-	log.Infof("Populating mountpoint...")
+	oldPath := path.Join(s.base, oldName)
+	newPath := path.Join(s.base, newName)
 
-	for line := range iter {
-		entity, err := ParseLine(line, trim)
-		if err != nil {
-			return err
+	if st, err := os.Stat(oldPath); err != nil || !st.IsDir() {
+		oldPath += MetaSuffix
+		newPath += MetaSuffix
+		if !utils.Exists(oldPath) {
+			return ErrNotFound
 		}
+	}
 
-		if entity.Filetype == syscall.S_IFDIR {
-			s.CreateDir(entity.Filepath)
-			continue
-		}
+	if same {
+		return nil
+	}
 
-		m, err := s.CreateFile(entity.Filepath)
-		if err != nil {
-			return err
-		}
+	// the new path replaces a file or a directory
+	target := path.Join(s.base, newName)
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(target + MetaSuffix); err != nil {
+		return err
+	}
 
-		// user and group id
-		uid := 0
-		u, err := user.Lookup(entity.Uname)
-		if err == nil {
-			uid, _ = strconv.Atoi(u.Uid)
-		}
+	if err := os.MkdirAll(path.Dir(newPath), 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(oldPath, newPath)
+}
+
+// Link hard links the meta file, so all the names share the same meta data
+func (s *fileMetaStore) Link(oldName, newName string) (Meta, error) {
+	oldPath := path.Join(s.base, oldName)
+	if st, err := os.Stat(oldPath); err == nil && st.IsDir() {
+		return nil, ErrIsDir
+	}
+
+	oldPath += MetaSuffix
+	if !utils.Exists(oldPath) {
+		return nil, ErrNotFound
+	}
+
+	newPath := path.Join(s.base, newName)
+	if utils.Exists(newPath) || utils.Exists(newPath+MetaSuffix) {
+		return nil, ErrExists
+	}
+
+	if err := os.MkdirAll(path.Dir(newPath), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := os.Link(oldPath, newPath+MetaSuffix); err != nil {
+		return nil, err
+	}
 
-		gid := 0
-		g, err := user.LookupGroup(entity.Gname)
-		if err == nil {
-			gid, _ = strconv.Atoi(g.Gid)
+	return metaFile(newPath + MetaSuffix), nil
+}
+
+// putEntry adds a single flist entry to the store
+func (s *fileMetaStore) putEntry(entity *Entry, opts PopulateOptions) error {
+	var m Meta
+	var err error
+	if entity.Filetype == syscall.S_IFDIR {
+		m, err = s.CreateDir(entity.Filepath)
+	} else {
+		m, err = s.CreateFile(entity.Filepath)
+	}
+	if err != nil {
+		return err
+	}
+
+	// user and group id
+	uid, gid := opts.owner(entity)
+
+	data := entity.MetaData(uid, gid)
+	data.Inode = atomic.AddUint64(&s.ino, 1)
+
+	if !m.Stat().Modified() {
+		//both meta and file exists. This file wasn't modified we can
+		//just now place the meta and delete the file ONLY if file was changed.
+
+		oldMeta, err := m.Load()
+		if err != nil && !os.IsNotExist(err) {
+			return err
 		}
 
-		ino := atomic.AddUint64(&s.ino, 1)
-
-		data := &MetaData{
-			Hash:        entity.Hash,
-			Size:        uint64(entity.Filesize),
-			Uname:       entity.Uname,
-			Uid:         uint32(uid),
-			Gname:       entity.Gname,
-			Gid:         uint32(gid),
-			Permissions: uint32(entity.Permissions),
-			Filetype:    entity.Filetype,
-			Ctime:       uint64(entity.Ctime.Unix()),
-			Mtime:       uint64(entity.Mtime.Unix()),
-			Extended:    entity.Extended,
-			DevMajor:    entity.DevMajor,
-			DevMinor:    entity.DevMinor,
-			Inode:       ino,
+		if oldMeta.Hash != entity.Hash {
+			//TODO: remove old data file
+			//os.Remove(file)
 		}
+	}
 
-		if !m.Stat().Modified() {
-			//both meta and file exists. This file wasn't modified we can
-			//just now place the meta and delete the file ONLY if file was changed.
+	return m.Save(data)
+}
 
-			oldMeta, err := m.Load()
-			if err != nil && !os.IsNotExist(err) {
-				return err
-			}
+// Populate writes the meta files with opts.Workers goroutines, the entries
+// don't depend on each other since CreateFile creates the missing parents.
+func (s *fileMetaStore) Populate(flists []string, opts PopulateOptions) error {
+	opts = opts.withDefaults()
 
-			if oldMeta.Hash != entity.Hash {
-				//TODO: remove old data file
-				//os.Remove(file)
-			}
-		}
+	var parsed uint64
+
+	log.Infof("Populating mountpoint...")
 
-		if err := m.Save(data); err != nil {
+	err := putParallel(opts.Workers, func(fn func(*Entry) error) error {
+		return walkLayers(flists, opts, fn)
+	}, func(entity *Entry) error {
+		if err := s.putEntry(entity, opts); err != nil {
 			return err
 		}
 
-		parsed += 1
+		atomic.AddUint64(&parsed, 1)
+		return nil
+	})
+
+	if err != nil {
+		return err
 	}
 
 	log.Infof("Mountpoint populated: %v items parsed", parsed)
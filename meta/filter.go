@@ -0,0 +1,195 @@
+package meta
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/g8os/fs/utils"
+)
+
+type rewrite struct {
+	from string
+	to   string
+}
+
+// pathFilter selects and remaps the flist entries at populate time
+type pathFilter struct {
+	include  []string
+	exclude  []string
+	rewrites []rewrite
+}
+
+type byLongestPrefix []rewrite
+
+func (r byLongestPrefix) Len() int           { return len(r) }
+func (r byLongestPrefix) Less(i, j int) bool { return len(r[i].from) > len(r[j].from) }
+func (r byLongestPrefix) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+func newPathFilter(opts PopulateOptions) (*pathFilter, error) {
+	for _, pattern := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if err := utils.ValidateGlob(pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %s", pattern, err)
+		}
+	}
+
+	filter := &pathFilter{
+		include: opts.Include,
+		exclude: opts.Exclude,
+	}
+
+	for from, to := range opts.Rewrite {
+		r := rewrite{
+			from: cleanPath(from),
+			to:   cleanPath(to),
+		}
+		filter.rewrites = append(filter.rewrites, r)
+	}
+	sort.Sort(byLongestPrefix(filter.rewrites))
+
+	return filter, nil
+}
+
+// matchTree returns true if one of the patterns matches name or one of its
+// parent directories.
+func matchTree(patterns []string, name string) bool {
+	for p := name; ; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			if ok, _ := utils.MatchGlob(pattern, p); ok {
+				return true
+			}
+		}
+
+		if p == "/" {
+			return false
+		}
+	}
+}
+
+func (f *pathFilter) included(name string, filetype uint32) bool {
+	if len(f.include) == 0 || matchTree(f.include, name) {
+		return true
+	}
+
+	// keep the directories leading to included paths
+	if filetype == syscall.S_IFDIR {
+		for _, pattern := range f.include {
+			if ok, _ := utils.MatchGlobPrefix(pattern, name); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (f *pathFilter) rewrite(name string) string {
+	for _, r := range f.rewrites {
+		if r.from == "/" || name == r.from || strings.HasPrefix(name, r.from+"/") {
+			return path.Join(r.to, strings.TrimPrefix(name, r.from))
+		}
+	}
+
+	return name
+}
+
+// apply returns false if the entry is filtered out, otherwise the entry path
+// is remapped with the longest matching rewrite prefix. Patterns match the
+// flist path (after trim) before any rewrite. A pattern that matches a
+// directory matches its whole subtree.
+func (f *pathFilter) apply(entry *Entry) bool {
+	name := cleanPath(entry.Filepath)
+
+	if !f.included(name, entry.Filetype) || (len(f.exclude) != 0 && matchTree(f.exclude, name)) {
+		return false
+	}
+
+	entry.Filepath = f.rewrite(name)
+	return true
+}
+
+// rewritten is an entry with its flist path, before the rewrites
+type rewritten struct {
+	from  string
+	entry *Entry
+}
+
+// checkRewritten checks the entries once rewritten: two entries can't end up
+// at the same path, and their parents must be directories with no hole in the
+// tree, like in a flist. A directory rewritten to the root becomes the root of
+// the mount, in place of the root of the flist. In lenient mode the bad
+// entries are logged and skipped, otherwise all the problems are returned.
+func checkRewritten(entries []rewritten, lenient bool) ([]*Entry, error) {
+	seen := make(map[string]rewritten)
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problem := fmt.Sprintf(format, args...)
+		if lenient {
+			log.Warningf("Skipping %s", problem)
+			return
+		}
+		problems = append(problems, problem)
+	}
+
+	rewrittenRoot := false
+	for _, r := range entries {
+		if r.from != "/" && cleanPath(r.entry.Filepath) == "/" {
+			rewrittenRoot = true
+			break
+		}
+	}
+
+	var unique []rewritten
+	for _, r := range entries {
+		name := cleanPath(r.entry.Filepath)
+		if name == "/" {
+			if r.from == "/" && rewrittenRoot {
+				continue
+			}
+			if r.entry.Filetype != syscall.S_IFDIR {
+				report("'%s': rewritten to the root but is not a directory", r.from)
+				continue
+			}
+		}
+		if first, ok := seen[name]; ok {
+			report("'%s': rewritten to '%s' like '%s'", r.from, name, first.from)
+			continue
+		}
+		seen[name] = r
+		unique = append(unique, r)
+	}
+
+	var result []*Entry
+	for _, r := range unique {
+		name := cleanPath(r.entry.Filepath)
+		if name != "/" && !rewrittenParent(seen, name) {
+			report("'%s': rewritten to '%s' which has no parent directory", r.from, name)
+			continue
+		}
+		result = append(result, r.entry)
+	}
+
+	if len(problems) != 0 {
+		return nil, fmt.Errorf("invalid rewrites: %s", strings.Join(problems, "; "))
+	}
+	return result, nil
+}
+
+// rewrittenParent returns true if the parent of name is a directory, or is
+// above the top of the entries
+func rewrittenParent(seen map[string]rewritten, name string) bool {
+	parent := path.Dir(name)
+	if p, ok := seen[parent]; ok {
+		return p.entry.Filetype == syscall.S_IFDIR
+	}
+
+	for ancestor := parent; ancestor != "/"; {
+		ancestor = path.Dir(ancestor)
+		if _, ok := seen[ancestor]; ok {
+			return false
+		}
+	}
+	return true
+}
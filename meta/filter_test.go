@@ -0,0 +1,165 @@
+package meta
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPopulateFilters(t *testing.T) {
+	name := writeFlist(t,
+		"/opt||0|root|root|755|4|0|0|",
+		"/opt/app||0|root|root|755|4|0|0|",
+		"/opt/app/run|aa|10|root|root|755|2|0|0|",
+		"/opt/app/doc||0|root|root|755|4|0|0|",
+		"/opt/app/doc/README|bb|10|root|root|644|2|0|0|",
+		"/opt/other||0|root|root|755|4|0|0|",
+		"/opt/other/x|cc|10|root|root|644|2|0|0|",
+	)
+	defer os.Remove(name)
+
+	store := NewMemoryMetaStore()
+	err := store.Populate([]string{name}, PopulateOptions{
+		Include: []string{"/opt/app/**"},
+		Exclude: []string{"/opt/*/doc"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	exists := func(name string) bool {
+		_, ok := store.Get(name)
+		return ok
+	}
+
+	assert.True(t, exists("opt"))
+	assert.True(t, exists("opt/app/run"))
+	assert.False(t, exists("opt/app/doc"))
+	assert.False(t, exists("opt/app/doc/README"))
+	assert.False(t, exists("opt/other"))
+	assert.False(t, exists("opt/other/x"))
+}
+
+func TestPopulateRewrite(t *testing.T) {
+	name := writeFlist(t,
+		"/opt||0|root|root|755|4|0|0|",
+		"/opt/jumpscale||0|root|root|755|4|0|0|",
+		"/opt/jumpscale/bin||0|root|root|755|4|0|0|",
+		"/opt/jumpscale/bin/js|aa|10|root|root|755|2|0|0|",
+		"/opt/jumpscale/lib||0|root|root|755|4|0|0|",
+		"/opt/jumpscale/lib/x.so|bb|10|root|root|755|2|0|0|",
+	)
+	defer os.Remove(name)
+
+	store := NewMemoryMetaStore()
+	err := store.Populate([]string{name}, PopulateOptions{
+		Include: []string{"/opt/jumpscale/**"},
+		Rewrite: map[string]string{
+			"/opt/jumpscale":     "/js",
+			"/opt/jumpscale/lib": "/usr/lib",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	m, ok := store.Get("js/bin/js")
+	if assert.True(t, ok) {
+		data, _ := m.Load()
+		assert.Equal(t, "aa", data.Hash)
+	}
+
+	_, ok = store.Get("usr/lib/x.so")
+	assert.True(t, ok)
+	_, ok = store.Get("js/lib")
+	assert.False(t, ok)
+}
+
+func TestPopulateRewriteRoot(t *testing.T) {
+	name := writeFlist(t,
+		"/||0|root|root|755|4|0|0|",
+		"/opt||0|root|root|755|4|0|0|",
+		"/opt/jumpscale||0|admin|admin|750|4|0|0|",
+		"/opt/jumpscale/bin||0|root|root|755|4|0|0|",
+		"/opt/jumpscale/bin/js|aa|10|root|root|755|2|0|0|",
+	)
+	defer os.Remove(name)
+
+	store := NewMemoryMetaStore()
+	err := store.Populate([]string{name}, PopulateOptions{
+		Include: []string{"/opt/jumpscale/**"},
+		Rewrite: map[string]string{"/opt/jumpscale": "/"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	m, ok := store.Get("bin/js")
+	if assert.True(t, ok) {
+		data, _ := m.Load()
+		assert.Equal(t, "aa", data.Hash)
+	}
+	_, ok = store.Get("opt/jumpscale")
+	assert.False(t, ok)
+
+	// the rewritten directory is the root of the mount
+	m, ok = store.Get("/")
+	if assert.True(t, ok) {
+		data, _ := m.Load()
+		assert.Equal(t, "admin", data.Uname)
+		assert.Equal(t, uint32(0750), data.Permissions)
+	}
+}
+
+func TestPopulateBadRewrites(t *testing.T) {
+	name := writeFlist(t,
+		"/opt||0|root|root|755|4|0|0|",
+		"/opt/app||0|root|root|755|4|0|0|",
+		"/opt/app/run|aa|10|root|root|755|2|0|0|",
+		"/opt/other||0|root|root|755|4|0|0|",
+		"/opt/other/x|cc|10|root|root|644|2|0|0|",
+	)
+	defer os.Remove(name)
+
+	for _, rewrites := range []map[string]string{
+		// a file to the root
+		{"/opt/app/run": "/"},
+		// two directories to the root
+		{"/opt/app": "/", "/opt/other": "/"},
+		// twice the same path
+		{"/opt/app/run": "/opt/other/x"},
+		// a parent that is a file
+		{"/opt/app/run": "/opt/other/x/run"},
+		// a hole in the tree
+		{"/opt/app/run": "/opt/nothere/run"},
+	} {
+		store := NewMemoryMetaStore()
+		err := store.Populate([]string{name}, PopulateOptions{Rewrite: rewrites})
+		assert.Error(t, err, "%v", rewrites)
+	}
+
+	// lenient mode skips the bad entries, the first one of a path is kept
+	store := NewMemoryMetaStore()
+	err := store.Populate([]string{name}, PopulateOptions{
+		Rewrite: map[string]string{"/opt/app/run": "/opt/other/x"},
+		Lenient: true,
+	})
+	if assert.NoError(t, err) {
+		m, ok := store.Get("opt/other/x")
+		if assert.True(t, ok) {
+			data, _ := m.Load()
+			assert.Equal(t, "aa", data.Hash)
+		}
+		_, ok = store.Get("opt/app/run")
+		assert.False(t, ok)
+	}
+}
+
+func TestPopulateBadPattern(t *testing.T) {
+	name := writeFlist(t, "/opt||0|root|root|755|4|0|0|")
+	defer os.Remove(name)
+
+	store := NewMemoryMetaStore()
+	assert.Error(t, store.Populate([]string{name}, PopulateOptions{Include: []string{"/opt/[a"}}))
+}
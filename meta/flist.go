@@ -0,0 +1,449 @@
+package meta
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// PopulateOptions controls how a flist is loaded into a meta store
+type PopulateOptions struct {
+	// Trim is removed from the beginning of every flist path
+	Trim string
+	// Lenient makes populate skip bad lines (with a warning) instead of
+	// refusing the whole flist
+	Lenient bool
+	// Include, if not empty, only keeps the paths matching one of these
+	// globs, Exclude drops the paths matching one of these globs
+	Include []string
+	Exclude []string
+	// Rewrite maps path prefixes to new prefixes, the longest matching
+	// prefix wins
+	Rewrite map[string]string
+	// Owners maps the flist owner names to ids, defaults to the host
+	// passwd and group databases
+	Owners IDMapper
+	// FlistOwners, when Owners isn't set, builds Owners from files of the
+	// flists during the populate
+	FlistOwners *FlistOwners
+	// Workers is the number of goroutines parsing the flist (and writing
+	// the entries for the stores that support it), defaults to the number
+	// of CPUs
+	Workers int
+
+	// stream makes a strict walk of a single flist pass the entries as they
+	// are parsed, before the whole flist is checked, for the lazy store to
+	// serve them at once. The problems are still returned at the end.
+	stream bool
+}
+
+// withDefaults returns the options with the defaults filled in, a store
+// calls it once at the beginning of its populate.
+func (o PopulateOptions) withDefaults() PopulateOptions {
+	if o.Owners == nil && o.FlistOwners != nil {
+		// shared by the copies of the options, set by the walk
+		o.Owners = &flistIDMapper{}
+	} else if o.Owners == nil {
+		o.Owners = NewHostIDMapper()
+	}
+	if o.Workers <= 0 {
+		o.Workers = runtime.NumCPU()
+	}
+	return o
+}
+
+// owner returns the uid and gid of a flist entry
+func (o *PopulateOptions) owner(entry *Entry) (uint32, uint32) {
+	return o.Owners.Uid(entry.Uname), o.Owners.Gid(entry.Gname)
+}
+
+// LineError is a problem found on a single flist line
+type LineError struct {
+	Line int
+	Path string
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Path, e.Err)
+}
+
+// LintErrors is the list of all problems found in a flist
+type LintErrors []*LineError
+
+func (e LintErrors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return fmt.Sprintf("flist has %d problem(s):\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+// cleanPath normalizes a flist path to an absolute clean path, the mount
+// root being "/"
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// parsedLine is a flist line, and the result of its parsing
+type parsedLine struct {
+	lineno int
+	line   string
+	entry  *Entry
+	err    error
+}
+
+type parseBatch struct {
+	lines []parsedLine
+	done  chan struct{}
+}
+
+const parseBatchSize = 1024
+
+// parseFlist parses the flist lines with the given number of workers and
+// calls fn for every non blank line, in file order, with its line number
+// (starting at 1) and parse result.
+func parseFlist(plist string, trim string, workers int, fn func(line *parsedLine) error) error {
+	file, err := os.Open(plist)
+	if err != nil {
+		log.Errorf("Error opening flist %s :%v", plist, err)
+		return err
+	}
+	defer file.Close()
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	jobs := make(chan *parseBatch, workers)
+	ordered := make(chan *parseBatch, 2*workers)
+	quit := make(chan struct{})
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for batch := range jobs {
+				for i := range batch.lines {
+					line := &batch.lines[i]
+					line.entry, line.err = ParseLine(line.line, trim)
+				}
+				close(batch.done)
+			}
+		}()
+	}
+
+	var readErr error
+	go func() {
+		defer close(ordered)
+		defer close(jobs)
+
+		send := func(batch *parseBatch) bool {
+			select {
+			case ordered <- batch:
+			case <-quit:
+				return false
+			}
+			select {
+			case jobs <- batch:
+			case <-quit:
+				return false
+			}
+			return true
+		}
+
+		newBatch := func() *parseBatch {
+			return &parseBatch{
+				lines: make([]parsedLine, 0, parseBatchSize),
+				done:  make(chan struct{}),
+			}
+		}
+
+		lineno := 0
+		batch := newBatch()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lineno++
+			line := scanner.Text()
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+
+			batch.lines = append(batch.lines, parsedLine{lineno: lineno, line: line})
+			if len(batch.lines) == parseBatchSize {
+				if !send(batch) {
+					return
+				}
+				batch = newBatch()
+			}
+		}
+
+		if len(batch.lines) != 0 {
+			send(batch)
+		}
+
+		readErr = scanner.Err()
+	}()
+
+	var fnErr error
+	ignored := 0
+	for batch := range ordered {
+		if fnErr != nil {
+			// draining
+			continue
+		}
+
+		<-batch.done
+		for i := range batch.lines {
+			line := &batch.lines[i]
+			if line.err == nil && line.entry.freeFormExtended() {
+				ignored++
+			}
+			if fnErr = fn(line); fnErr != nil {
+				close(quit)
+				break
+			}
+		}
+	}
+
+	if ignored > 0 {
+		log.Warningf("Ignoring the extended data of %d entries of %s, it isn't extended attributes", ignored, plist)
+	}
+
+	if fnErr != nil {
+		return fnErr
+	}
+
+	return readErr
+}
+
+type lintEntry struct {
+	line     int
+	filetype uint32
+}
+
+// flistChecker validates flist lines one by one and remembers what it has
+// seen so it can also report problems that span multiple lines.
+type flistChecker struct {
+	entries map[string]lintEntry
+	order   []string
+	// lower resolves paths that are not defined in this flist but in the
+	// layers below it, it may be nil.
+	lower func(name string) (uint32, bool)
+}
+
+func newFlistChecker() *flistChecker {
+	return &flistChecker{
+		entries: make(map[string]lintEntry),
+	}
+}
+
+// check reports the parse error of a line, or if its path is a duplicate.
+func (c *flistChecker) check(line *parsedLine) (*Entry, *LineError) {
+	lineno, entry := line.lineno, line.entry
+	if line.err != nil {
+		name := ""
+		if i := strings.Index(line.line, "|"); i > 0 {
+			name = line.line[:i]
+		}
+		return nil, &LineError{Line: lineno, Path: name, Err: line.err}
+	}
+
+	name := cleanPath(entry.Filepath)
+	if first, ok := c.entries[name]; ok {
+		return nil, &LineError{
+			Line: lineno,
+			Path: entry.Filepath,
+			Err:  fmt.Errorf("duplicate path, first defined on line %d", first.line),
+		}
+	}
+
+	c.entries[name] = lintEntry{line: lineno, filetype: entry.Filetype}
+	c.order = append(c.order, name)
+
+	return entry, nil
+}
+
+func (c *flistChecker) lookupLower(name string) (uint32, bool) {
+	if c.lower == nil {
+		return 0, false
+	}
+	return c.lower(name)
+}
+
+// finish reports the problems that can only be detected once the whole flist
+// is read: parents that are not directories, and missing parent directories.
+// A flist describes a subtree, so a parent is only reported missing if one of
+// its own ancestors is part of the flist (a hole in the tree); the directories
+// above the top of the flist are provided by the mount.
+func (c *flistChecker) finish() LintErrors {
+	var problems LintErrors
+	for _, name := range c.order {
+		if name == "/" {
+			continue
+		}
+		entry := c.entries[name]
+		parent := path.Dir(name)
+		if p, ok := c.entries[parent]; ok {
+			if p.filetype != syscall.S_IFDIR {
+				problems = append(problems, &LineError{
+					Line: entry.line,
+					Path: name,
+					Err:  fmt.Errorf("parent '%s' (line %d) is not a directory", parent, p.line),
+				})
+			}
+			continue
+		}
+
+		if filetype, ok := c.lookupLower(parent); ok {
+			if filetype != syscall.S_IFDIR {
+				problems = append(problems, &LineError{
+					Line: entry.line,
+					Path: name,
+					Err:  fmt.Errorf("parent '%s' is not a directory in the lower layers", parent),
+				})
+			}
+			continue
+		}
+
+		for ancestor := parent; ancestor != "/"; {
+			ancestor = path.Dir(ancestor)
+			_, ok := c.entries[ancestor]
+			if _, lower := c.lookupLower(ancestor); ok || lower {
+				problems = append(problems, &LineError{
+					Line: entry.line,
+					Path: name,
+					Err:  fmt.Errorf("missing parent directory '%s'", parent),
+				})
+				break
+			}
+		}
+	}
+
+	return problems
+}
+
+// LintFlist checks the whole flist and returns every problem found, each with
+// its line number. The returned error is only set if the flist can't be read.
+func LintFlist(plist string, trim string) (LintErrors, error) {
+	return lintFlist(plist, trim, 0)
+}
+
+func lintFlist(plist string, trim string, workers int) (LintErrors, error) {
+	checker := newFlistChecker()
+	var problems LintErrors
+
+	err := parseFlist(plist, trim, workers, func(line *parsedLine) error {
+		if _, lerr := checker.check(line); lerr != nil {
+			problems = append(problems, lerr)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(problems, checker.finish()...), nil
+}
+
+// walkFlist calls fn for every valid entry of the flist, in file order, with a
+// single parse. In strict mode the entries are kept until the whole flist is
+// checked and nothing is walked if any problem is found, unless opts.stream
+// is set. In lenient mode bad lines are logged and skipped.
+func walkFlist(plist string, opts PopulateOptions, fn func(entry *Entry) error) error {
+	checker := newFlistChecker()
+	var entries []*Entry
+	var problems LintErrors
+
+	err := parseFlist(plist, opts.Trim, opts.Workers, func(line *parsedLine) error {
+		entry, lerr := checker.check(line)
+		switch {
+		case lerr != nil && opts.Lenient:
+			log.Warningf("Skipping flist '%s' %s", plist, lerr)
+		case lerr != nil:
+			problems = append(problems, lerr)
+		case opts.Lenient || opts.stream:
+			return fn(entry)
+		default:
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil || opts.Lenient {
+		return err
+	}
+
+	if problems = append(problems, checker.finish()...); len(problems) != 0 {
+		return problems
+	}
+
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// putParallel feeds the entries produced by walk to workers goroutines
+// calling put, and returns the first error of either. The walk stops at the
+// first put error.
+func putParallel(workers int, walk func(fn func(*Entry) error) error, put func(*Entry) error) error {
+	if workers <= 1 {
+		return walk(put)
+	}
+
+	entries := make(chan *Entry, workers*4)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var putErr error
+
+	failed := func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		return putErr
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range entries {
+				if failed() != nil {
+					continue
+				}
+				if err := put(entry); err != nil {
+					lock.Lock()
+					if putErr == nil {
+						putErr = err
+					}
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+
+	err := walk(func(entry *Entry) error {
+		if err := failed(); err != nil {
+			return err
+		}
+		entries <- entry
+		return nil
+	})
+
+	close(entries)
+	wg.Wait()
+
+	if err := failed(); err != nil {
+		return err
+	}
+
+	return err
+}
@@ -0,0 +1,255 @@
+package meta
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFlist(t *testing.T, lines ...string) string {
+	f, err := ioutil.TempFile("", "flist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func TestParseLine(t *testing.T) {
+	entry, err := ParseLine("/opt/bin/ls|d41d8cd98f00b204e9800998ecf8427e|120|root|root|100755|2|1470000000|1470000001|", "/opt")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "/bin/ls", entry.Filepath)
+	assert.Equal(t, int64(120), entry.Filesize)
+	assert.Equal(t, int64(0755), entry.Permissions)
+	assert.Equal(t, uint32(syscall.S_IFREG), entry.Filetype)
+}
+
+func TestParseLineDevice(t *testing.T) {
+	entry, err := ParseLine("/dev/null||0|root|root|666|5|0|0|1,3", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, uint32(syscall.S_IFCHR), entry.Filetype)
+	assert.Equal(t, int64(1), entry.DevMajor)
+	assert.Equal(t, int64(3), entry.DevMinor)
+}
+
+func TestParseLineErrors(t *testing.T) {
+	lines := []string{
+		"",
+		"/a|b|c",
+		"/a||x|root|root|644|2|0|0|",
+		"/a||0|root|root|9x|2|0|0|",
+		"/a||0|root|root|644|9|0|0|",
+		"/a||0|root|root|40755|2|0|0|",
+		"/a|nothex|10|root|root|644|2|0|0|",
+		"/a||10|root|root|644|2|0|0|",
+		"/a||0|root|root|777|1|0|0|",
+		"/dev/null||0|root|root|666|5|0|0|1",
+		"/dev/null||0|root|root|666|3|0|0|a,3",
+		"/a||0|root|root|644|2|x|0|",
+	}
+
+	for _, line := range lines {
+		_, err := ParseLine(line, "")
+		assert.Error(t, err, "line '%s' should not parse", line)
+	}
+}
+
+func TestLintFlist(t *testing.T) {
+	name := writeFlist(t,
+		"/opt||0|root|root|755|4|0|0|",
+		"/opt/a|d41d8cd98f00b204e9800998ecf8427e|1|root|root|644|2|0|0|",
+		"/opt/a|d41d8cd98f00b204e9800998ecf8427e|1|root|root|644|2|0|0|",
+		"/opt/a/b||0|root|root|644|2|0|0|",
+		"/opt/missing/c||0|root|root|644|2|0|0|",
+		"/opt/bad|zz|1|root|root|644|2|0|0|",
+		"",
+		"/opt/dev||0|root|root|644|3|0|0|",
+	)
+	defer os.Remove(name)
+
+	problems, err := LintFlist(name, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	lines := []int{}
+	for _, problem := range problems {
+		lines = append(lines, problem.Line)
+	}
+
+	assert.Equal(t, []int{3, 6, 8, 4, 5}, lines)
+}
+
+func TestLintFlistTopLevelParent(t *testing.T) {
+	// parents above the top of the flist are provided by the mount
+	name := writeFlist(t,
+		"/opt/js||0|root|root|755|4|0|0|",
+		"/opt/js/a||0|root|root|644|2|0|0|",
+	)
+	defer os.Remove(name)
+
+	problems, err := LintFlist(name, "")
+	if assert.NoError(t, err) {
+		assert.Len(t, problems, 0)
+	}
+}
+
+func TestPopulateStrict(t *testing.T) {
+	name := writeFlist(t,
+		"/a||0|root|root|755|4|0|0|",
+		"/a/b||0|root|root|644|2|0|x|",
+		"/a/c||0|root|root|644|2|0|0|",
+	)
+	defer os.Remove(name)
+
+	store := NewMemoryMetaStore()
+	err := store.Populate([]string{name}, PopulateOptions{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 2")
+	}
+
+	_, ok := store.Get("a/c")
+	assert.False(t, ok)
+}
+
+func TestPopulateLenient(t *testing.T) {
+	name := writeFlist(t,
+		"/a||0|root|root|755|4|0|0|",
+		"/a/b||0|root|root|644|2|0|x|",
+		"/a/c||0|root|root|644|2|0|0|",
+	)
+	defer os.Remove(name)
+
+	store := NewMemoryMetaStore()
+	if !assert.NoError(t, store.Populate([]string{name}, PopulateOptions{Lenient: true})) {
+		return
+	}
+
+	_, ok := store.Get("a/b")
+	assert.False(t, ok)
+	_, ok = store.Get("a/c")
+	assert.True(t, ok)
+}
+
+func TestStatFlist(t *testing.T) {
+	name := writeFlist(t,
+		"/a||0|root|root|755|4|0|0|",
+		"/a/one|aa|10|root|root|644|2|0|0|",
+		"/a/two|aa|10|root|root|644|2|0|0|",
+		"/a/three|bb|30|root|root|644|2|0|0|",
+		"/a/link||0|root|root|777|1|0|0|three",
+	)
+	defer os.Remove(name)
+
+	stats, err := StatFlist(name, PopulateOptions{}, 2)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, 5, stats.Entries)
+	assert.Equal(t, int64(50), stats.TotalSize)
+	assert.Equal(t, int64(40), stats.UniqueSize)
+	assert.Equal(t, 2, stats.DistinctHashes)
+	assert.Equal(t, 3, stats.Types[syscall.S_IFREG])
+	assert.InDelta(t, 1.25, stats.DedupeRatio(), 0.001)
+	if assert.Len(t, stats.Largest, 2) {
+		assert.Equal(t, "/a/three", stats.Largest[0].Filepath)
+		assert.Equal(t, int64(10), stats.Largest[1].Filesize)
+	}
+}
+
+func TestDiffFlist(t *testing.T) {
+	oldList := writeFlist(t,
+		"/a||0|root|root|755|4|0|0|",
+		"/a/same|aa|10|root|root|644|2|0|0|",
+		"/a/gone|aa|10|root|root|644|2|0|0|",
+		"/a/mod|aa|10|root|root|644|2|0|0|",
+	)
+	defer os.Remove(oldList)
+
+	newList := writeFlist(t,
+		"/a||0|root|root|755|4|0|0|",
+		"/a/same|aa|10|root|root|644|2|0|0|",
+		"/a/mod|bb|25|app|app|755|2|0|0|",
+		"/a/new|cc|5|root|root|644|2|0|0|",
+	)
+	defer os.Remove(newList)
+
+	changes, err := DiffFlist(oldList, newList, PopulateOptions{})
+	if !assert.NoError(t, err) || !assert.Len(t, changes, 3) {
+		return
+	}
+
+	assert.Equal(t, "/a/gone", changes[0].Path)
+	assert.Equal(t, Removed, changes[0].Kind)
+	assert.Equal(t, int64(-10), changes[0].SizeDelta())
+
+	assert.Equal(t, "/a/mod", changes[1].Path)
+	assert.Equal(t, Changed, changes[1].Kind)
+	assert.Equal(t, int64(15), changes[1].SizeDelta())
+	assert.Equal(t, []string{"mode 644->755", "owner root:root->app:app", "content"}, changes[1].Details())
+
+	assert.Equal(t, "/a/new", changes[2].Path)
+	assert.Equal(t, Added, changes[2].Kind)
+}
+
+func TestPopulateSpecialFiles(t *testing.T) {
+	name := writeFlist(t,
+		"/dev||0|root|root|755|4|0|0|",
+		"/dev/null||0|root|root|666|5|0|0|1,3",
+		"/dev/sda||0|root|disk|660|3|0|0|8,0",
+		"/run||0|root|root|755|4|0|0|",
+		"/run/initctl||0|root|root|600|6|0|0|",
+		"/run/agent.sock||0|root|root|755|0|0|0|",
+	)
+	defer os.Remove(name)
+
+	dir, err := ioutil.TempDir("", "meta")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for _, store := range []MetaStore{NewMemoryMetaStore(), NewFileMetaStore(dir)} {
+		if !assert.NoError(t, store.Populate([]string{name}, PopulateOptions{Owners: NewNumericIDMapper()})) {
+			continue
+		}
+
+		for path, expected := range map[string]MetaData{
+			"/dev/null":       {Filetype: syscall.S_IFCHR, Permissions: 0666, DevMajor: 1, DevMinor: 3},
+			"/dev/sda":        {Filetype: syscall.S_IFBLK, Permissions: 0660, DevMajor: 8, DevMinor: 0},
+			"/run/initctl":    {Filetype: syscall.S_IFIFO, Permissions: 0600},
+			"/run/agent.sock": {Filetype: syscall.S_IFSOCK, Permissions: 0755},
+		} {
+			m, ok := store.Get(path)
+			if !assert.True(t, ok, path) {
+				continue
+			}
+
+			data, err := m.Load()
+			if !assert.NoError(t, err) {
+				continue
+			}
+
+			assert.Equal(t, expected.Filetype, data.Filetype, path)
+			assert.Equal(t, expected.Permissions, data.Permissions, path)
+			assert.Equal(t, expected.DevMajor, data.DevMajor, path)
+			assert.Equal(t, expected.DevMinor, data.DevMinor, path)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package meta
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"syscall"
+)
+
+// FileTypeName returns a human readable name of a S_IFMT file type
+func FileTypeName(filetype uint32) string {
+	switch filetype {
+	case syscall.S_IFSOCK:
+		return "socket"
+	case syscall.S_IFLNK:
+		return "symlink"
+	case syscall.S_IFREG:
+		return "regular"
+	case syscall.S_IFBLK:
+		return "block device"
+	case syscall.S_IFDIR:
+		return "directory"
+	case syscall.S_IFCHR:
+		return "char device"
+	case syscall.S_IFIFO:
+		return "fifo"
+	default:
+		return fmt.Sprintf("unknown(%o)", filetype)
+	}
+}
+
+// FlistStats summarizes the content of a flist
+type FlistStats struct {
+	Entries int
+	// TotalSize is the logical size of all regular files
+	TotalSize int64
+	// UniqueSize is the size of the distinct blobs, this is what the stor
+	// actually holds for this flist
+	UniqueSize int64
+	// Types counts the entries per file type
+	Types map[uint32]int
+	// DistinctHashes is the number of distinct blobs
+	DistinctHashes int
+	// Largest holds the largest regular files, biggest first
+	Largest []*Entry
+}
+
+// DedupeRatio is the logical size divided by the size of the distinct blobs
+func (s *FlistStats) DedupeRatio() float64 {
+	if s.UniqueSize == 0 {
+		return 1
+	}
+	return float64(s.TotalSize) / float64(s.UniqueSize)
+}
+
+// bySize is a min heap of entries on their file size
+type bySize []*Entry
+
+func (h bySize) Len() int            { return len(h) }
+func (h bySize) Less(i, j int) bool  { return h[i].Filesize < h[j].Filesize }
+func (h bySize) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *bySize) Push(x interface{}) { *h = append(*h, x.(*Entry)) }
+func (h *bySize) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// StatFlist computes the statistics of a flist, keeping the top largest files
+func StatFlist(plist string, opts PopulateOptions, top int) (*FlistStats, error) {
+	stats := &FlistStats{
+		Types: make(map[uint32]int),
+	}
+
+	hashes := make(map[string]struct{})
+	largest := &bySize{}
+
+	err := walkFlist(plist, opts, func(entry *Entry) error {
+		stats.Entries++
+		stats.Types[entry.Filetype]++
+
+		if entry.Filetype != syscall.S_IFREG {
+			return nil
+		}
+
+		stats.TotalSize += entry.Filesize
+		if _, ok := hashes[entry.Hash]; !ok {
+			hashes[entry.Hash] = struct{}{}
+			stats.UniqueSize += entry.Filesize
+		}
+
+		if top > 0 {
+			heap.Push(largest, entry)
+			if largest.Len() > top {
+				heap.Pop(largest)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	stats.DistinctHashes = len(hashes)
+	stats.Largest = make([]*Entry, largest.Len())
+	for i := len(stats.Largest) - 1; i >= 0; i-- {
+		stats.Largest[i] = heap.Pop(largest).(*Entry)
+	}
+
+	return stats, nil
+}
+
+// ChangeKind tells how a path differs between two flists
+type ChangeKind int
+
+const (
+	Added ChangeKind = iota
+	Removed
+	Changed
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "A"
+	case Removed:
+		return "D"
+	default:
+		return "M"
+	}
+}
+
+// Change is a single path difference between two flists
+type Change struct {
+	Path string
+	Kind ChangeKind
+	Old  *Entry
+	New  *Entry
+}
+
+// SizeDelta is the change in file size of the path
+func (c *Change) SizeDelta() int64 {
+	var delta int64
+	if c.New != nil {
+		delta += c.New.Filesize
+	}
+	if c.Old != nil {
+		delta -= c.Old.Filesize
+	}
+	return delta
+}
+
+// Details lists what changed on a modified path
+func (c *Change) Details() []string {
+	if c.Kind != Changed {
+		return nil
+	}
+
+	var details []string
+	o, n := c.Old, c.New
+	if o.Filetype != n.Filetype {
+		details = append(details, fmt.Sprintf("type %s->%s", FileTypeName(o.Filetype), FileTypeName(n.Filetype)))
+	}
+	if o.Permissions != n.Permissions {
+		details = append(details, fmt.Sprintf("mode %o->%o", o.Permissions, n.Permissions))
+	}
+	if o.Uname != n.Uname || o.Gname != n.Gname {
+		details = append(details, fmt.Sprintf("owner %s:%s->%s:%s", o.Uname, o.Gname, n.Uname, n.Gname))
+	}
+	if o.Hash != n.Hash {
+		details = append(details, "content")
+	}
+	if o.Extended != n.Extended {
+		details = append(details, fmt.Sprintf("extended '%s'->'%s'", o.Extended, n.Extended))
+	}
+	if !o.Mtime.Equal(n.Mtime) {
+		details = append(details, "mtime")
+	}
+
+	return details
+}
+
+type changesByPath []*Change
+
+func (c changesByPath) Len() int           { return len(c) }
+func (c changesByPath) Less(i, j int) bool { return c[i].Path < c[j].Path }
+func (c changesByPath) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// DiffFlist compares two flists and returns the added, removed and changed
+// paths sorted by path.
+func DiffFlist(oldList, newList string, opts PopulateOptions) ([]*Change, error) {
+	old := make(map[string]*Entry)
+	err := walkFlist(oldList, opts, func(entry *Entry) error {
+		old[cleanPath(entry.Filepath)] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []*Change
+	err = walkFlist(newList, opts, func(entry *Entry) error {
+		name := cleanPath(entry.Filepath)
+		prev, ok := old[name]
+		if !ok {
+			changes = append(changes, &Change{Path: name, Kind: Added, New: entry})
+			return nil
+		}
+
+		delete(old, name)
+		change := &Change{Path: name, Kind: Changed, Old: prev, New: entry}
+		if len(change.Details()) != 0 || prev.Filesize != entry.Filesize {
+			changes = append(changes, change)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for name, entry := range old {
+		changes = append(changes, &Change{Path: name, Kind: Removed, Old: entry})
+	}
+
+	sort.Sort(changesByPath(changes))
+	return changes, nil
+}
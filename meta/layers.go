@@ -0,0 +1,257 @@
+package meta
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// WhiteoutPrefix marks an entry of an upper layer that hides the path
+	// with the same name (without the prefix) in the lower layers.
+	WhiteoutPrefix = ".wh."
+	// WhiteoutOpaque marks its directory as opaque, hiding everything the
+	// lower layers have under that directory.
+	WhiteoutOpaque = ".wh..wh..opq"
+)
+
+// isWhiteout returns true if the entry is a whiteout or opaque marker
+func isWhiteout(name string) bool {
+	return strings.HasPrefix(path.Base(name), WhiteoutPrefix)
+}
+
+// readLayer parses and checks a single layer. lower holds the merged result
+// of the layers below, it is used to resolve the parent directories the layer
+// doesn't define itself.
+func readLayer(plist string, index int, opts PopulateOptions, lower map[string]*Entry) ([]*Entry, error) {
+	checker := newFlistChecker()
+	checker.lower = func(name string) (uint32, bool) {
+		entry, ok := lower[name]
+		if !ok {
+			return 0, false
+		}
+		return entry.Filetype, true
+	}
+
+	var entries []*Entry
+	var problems LintErrors
+	err := parseFlist(plist, opts.Trim, opts.Workers, func(line *parsedLine) error {
+		entry, lerr := checker.check(line)
+		if lerr != nil {
+			if opts.Lenient {
+				log.Warningf("Skipping flist '%s' %s", plist, lerr)
+			} else {
+				problems = append(problems, lerr)
+			}
+			return nil
+		}
+
+		entry.Layer = index
+		entries = append(entries, entry)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.Lenient {
+		problems = append(problems, checker.finish()...)
+	}
+
+	if len(problems) != 0 {
+		return nil, fmt.Errorf("layer %d (%s): %s", index, plist, problems)
+	}
+
+	return entries, nil
+}
+
+// underAny returns true if name is one of dirs or is inside one of them
+func underAny(name string, dirs map[string]struct{}) bool {
+	for p := name; ; p = path.Dir(p) {
+		if _, ok := dirs[p]; ok {
+			return true
+		}
+		if p == "/" {
+			return false
+		}
+	}
+}
+
+// mergeLayers merges the given flists, the later layers overriding the
+// earlier ones. An upper layer hides a lower path with a whiteout entry
+// (.wh.<name>), or everything under a lower directory with an opaque
+// marker (.wh..wh..opq) inside that directory. A non directory entry in an
+// upper layer also hides the subtree of a lower directory with the same
+// path. The merged entries are returned sorted by path, so directories come
+// before their content.
+func mergeLayers(layers []string, opts PopulateOptions) ([]*Entry, error) {
+	merged := make(map[string]*Entry)
+
+	for index, plist := range layers {
+		entries, err := readLayer(plist, index, opts, merged)
+		if err != nil {
+			return nil, err
+		}
+
+		// paths hidden together with their subtree, and opaque directories
+		// whose lower content is hidden (but not the directory itself)
+		hidden := make(map[string]struct{})
+		opaque := make(map[string]struct{})
+
+		for _, entry := range entries {
+			name := cleanPath(entry.Filepath)
+			base := path.Base(name)
+			switch {
+			case base == WhiteoutOpaque:
+				opaque[path.Dir(name)] = struct{}{}
+			case strings.HasPrefix(base, WhiteoutPrefix):
+				hidden[path.Join(path.Dir(name), strings.TrimPrefix(base, WhiteoutPrefix))] = struct{}{}
+			default:
+				if prev, ok := merged[name]; ok && prev.Filetype != entry.Filetype {
+					hidden[name] = struct{}{}
+				}
+			}
+		}
+
+		if len(hidden) != 0 || len(opaque) != 0 {
+			for name, entry := range merged {
+				if underAny(name, hidden) || (underAny(path.Dir(name), opaque) && name != "/") {
+					log.Debugf("Layer %d hides '%s' from layer %d", index, name, entry.Layer)
+					delete(merged, name)
+				}
+			}
+		}
+
+		for _, entry := range entries {
+			if isWhiteout(entry.Filepath) {
+				continue
+			}
+			merged[cleanPath(entry.Filepath)] = entry
+		}
+	}
+
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]*Entry, 0, len(names))
+	for _, name := range names {
+		result = append(result, merged[name])
+	}
+
+	return result, nil
+}
+
+// walkLayers calls fn for every entry of the merged layers that passes the
+// include/exclude filters, with its path rewritten. Whiteout markers are never
+// passed to fn. A single layer is streamed as is, unless the owners are found
+// in the flists: the merged layers are then read before fn is called, to build
+// the owners from them.
+func walkLayers(layers []string, opts PopulateOptions, fn func(entry *Entry) error) error {
+	if len(layers) == 0 {
+		return fmt.Errorf("no flist to populate")
+	}
+
+	filter, err := newPathFilter(opts)
+	if err != nil {
+		return err
+	}
+
+	// the rewritten entries are checked as a whole before being walked
+	var rewrites []rewritten
+	apply := func(entry *Entry) error {
+		from := entry.Filepath
+		if !filter.apply(entry) {
+			return nil
+		}
+		if len(filter.rewrites) != 0 {
+			rewrites = append(rewrites, rewritten{from: from, entry: entry})
+			return nil
+		}
+		return fn(entry)
+	}
+
+	owners, _ := opts.Owners.(*flistIDMapper)
+	if len(layers) == 1 && owners == nil {
+		err = walkFlist(layers[0], opts, func(entry *Entry) error {
+			if isWhiteout(entry.Filepath) {
+				return nil
+			}
+			return apply(entry)
+		})
+	} else {
+		var entries []*Entry
+		entries, err = mergeLayers(layers, opts)
+		if err == nil && owners != nil {
+			err = owners.build(opts.FlistOwners, entries)
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := apply(entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err != nil || len(rewrites) == 0 {
+		return err
+	}
+
+	entries, err := checkRewritten(rewrites, opts.Lenient)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FindEntry returns the entry of the merged flists that is served at name,
+// after the filters and rewrites are applied.
+func FindEntry(flists []string, opts PopulateOptions, name string) (*Entry, error) {
+	entries, err := FindEntries(flists, opts, name)
+	if err != nil {
+		return nil, err
+	}
+	return entries[0], nil
+}
+
+// FindEntries returns the entries served at names, in the same order, with a
+// single walk of the flists. ErrNotFound is returned if one is missing.
+func FindEntries(flists []string, opts PopulateOptions, names ...string) ([]*Entry, error) {
+	wanted := make(map[string][]int)
+	for i, name := range names {
+		name = cleanPath(name)
+		wanted[name] = append(wanted[name], i)
+	}
+
+	found := make([]*Entry, len(names))
+	err := walkLayers(flists, opts, func(entry *Entry) error {
+		for _, i := range wanted[cleanPath(entry.Filepath)] {
+			found[i] = entry
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range found {
+		if entry == nil {
+			return nil, ErrNotFound
+		}
+	}
+
+	return found, nil
+}
@@ -0,0 +1,109 @@
+package meta
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPopulateLayers(t *testing.T) {
+	base := writeFlist(t,
+		"/etc||0|root|root|755|4|0|0|",
+		"/etc/passwd|aa|10|root|root|644|2|0|0|",
+		"/etc/shadow|bb|10|root|root|600|2|0|0|",
+		"/usr||0|root|root|755|4|0|0|",
+		"/usr/share||0|root|root|755|4|0|0|",
+		"/usr/share/doc||0|root|root|755|4|0|0|",
+		"/usr/share/doc/README|cc|10|root|root|644|2|0|0|",
+		"/var||0|root|root|755|4|0|0|",
+		"/var/log||0|root|root|755|4|0|0|",
+		"/var/log/old|dd|10|root|root|644|2|0|0|",
+	)
+	defer os.Remove(base)
+
+	app := writeFlist(t,
+		"/etc/passwd|ee|20|root|root|644|2|0|0|",
+		"/etc/.wh.shadow||0|root|root|644|2|0|0|",
+		"/usr/share/.wh.doc||0|root|root|644|2|0|0|",
+		"/var/log/.wh..wh..opq||0|root|root|644|2|0|0|",
+		"/var/log/app|ff|10|root|root|644|2|0|0|",
+		"/opt||0|root|root|755|4|0|0|",
+		"/opt/app|ff|10|root|root|755|2|0|0|",
+	)
+	defer os.Remove(app)
+
+	store := NewMemoryMetaStore()
+	if !assert.NoError(t, store.Populate([]string{base, app}, PopulateOptions{})) {
+		return
+	}
+
+	exists := func(name string) bool {
+		_, ok := store.Get(name)
+		return ok
+	}
+
+	m, ok := store.Get("etc/passwd")
+	if assert.True(t, ok) {
+		data, _ := m.Load()
+		assert.Equal(t, "ee", data.Hash)
+		assert.Equal(t, 1, data.Layer)
+	}
+
+	m, ok = store.Get("var/log")
+	if assert.True(t, ok) {
+		data, _ := m.Load()
+		assert.Equal(t, 0, data.Layer)
+	}
+
+	assert.False(t, exists("etc/shadow"))
+	assert.False(t, exists("etc/.wh.shadow"))
+	assert.False(t, exists("usr/share/doc"))
+	assert.False(t, exists("usr/share/doc/README"))
+	assert.True(t, exists("usr/share"))
+	assert.False(t, exists("var/log/old"))
+	assert.False(t, exists("var/log/.wh..wh..opq"))
+	assert.True(t, exists("var/log/app"))
+	assert.True(t, exists("opt/app"))
+}
+
+func TestPopulateLayersParentFromLower(t *testing.T) {
+	base := writeFlist(t,
+		"/usr||0|root|root|755|4|0|0|",
+		"/usr/lib||0|root|root|755|4|0|0|",
+	)
+	defer os.Remove(base)
+
+	// /usr/lib is not part of the upper layer, but it is in the base one
+	app := writeFlist(t,
+		"/usr||0|root|root|755|4|0|0|",
+		"/usr/lib/libapp.so|aa|10|root|root|644|2|0|0|",
+	)
+	defer os.Remove(app)
+
+	store := NewMemoryMetaStore()
+	assert.NoError(t, store.Populate([]string{base, app}, PopulateOptions{}))
+
+	problems, err := LintFlist(app, "")
+	if assert.NoError(t, err) {
+		assert.Len(t, problems, 1)
+	}
+}
+
+func TestFindEntries(t *testing.T) {
+	name := writeFlist(t,
+		"/etc||0|root|root|755|4|0|0|",
+		"/etc/passwd|aa|10|root|root|644|2|0|0|",
+		"/etc/group|bb|10|root|root|644|2|0|0|",
+	)
+	defer os.Remove(name)
+
+	entries, err := FindEntries([]string{name}, PopulateOptions{}, "/etc/group", "etc/passwd")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bb", entries[0].Hash)
+		assert.Equal(t, "aa", entries[1].Hash)
+	}
+
+	_, err = FindEntries([]string{name}, PopulateOptions{}, "/etc/passwd", "/etc/shadow")
+	assert.Equal(t, ErrNotFound, err)
+}
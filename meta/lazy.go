@@ -0,0 +1,359 @@
+package meta
+
+import (
+	"fmt"
+	"path"
+	"sync"
+)
+
+// entryWriter is implemented by the meta stores that can add flist entries
+// one by one, which is what their Populate does for every entry.
+type entryWriter interface {
+	putEntry(entry *Entry, opts PopulateOptions) error
+}
+
+// LazyMetaStore wraps a meta store so it can be served before it is
+// populated. Populate returns at once and runs in the background: the flists
+// are first parsed into an in memory index, then written to the wrapped store.
+// Until the populate is over, lookups use the index and add the entries they
+// need to the wrapped store on demand.
+//
+// A single flist without rewrites is indexed while it is parsed: a lookup is
+// served as soon as its entry is parsed, even in strict mode (a bad line found
+// later fails the populate). A path that is not in the index yet, the listing
+// of a directory (complete only at the end of the flists) and the changes
+// wait for the whole parse. The layers, the rewrites and the owners found in
+// the flists need all the entries, they are indexed at the end of the parse. All the operations and the
+// background writer share a single lock, the writer takes it for one entry at
+// a time.
+type LazyMetaStore struct {
+	MetaStore
+	writer entryWriter
+	opts   PopulateOptions
+
+	lock sync.Mutex
+	// indexed is signaled for every entry added to the index, and once the
+	// index is complete
+	indexed  *sync.Cond
+	complete bool
+	entries  map[string]*Entry
+	children map[string][]string
+	// added are the entries already in the wrapped store, deleted are the
+	// paths removed while populating that must not be added anymore
+	added   map[string]struct{}
+	deleted map[string]struct{}
+
+	ready chan struct{}
+	done  chan struct{}
+	err   error
+}
+
+// NewLazyMetaStore wraps store, it fails if the store can't be populated
+// entry by entry.
+func NewLazyMetaStore(store MetaStore) (*LazyMetaStore, error) {
+	writer, ok := store.(entryWriter)
+	if !ok {
+		return nil, fmt.Errorf("meta store %T doesn't support lazy populate", store)
+	}
+
+	s := &LazyMetaStore{
+		MetaStore: store,
+		writer:    writer,
+		entries:   make(map[string]*Entry),
+		children:  make(map[string][]string),
+		added:     make(map[string]struct{}),
+		deleted:   make(map[string]struct{}),
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	s.indexed = sync.NewCond(&s.lock)
+	return s, nil
+}
+
+// Populate starts populating the store in the background, use Wait to get
+// the result.
+func (s *LazyMetaStore) Populate(flists []string, opts PopulateOptions) error {
+	opts = opts.withDefaults()
+	s.opts = opts
+	go s.populate(flists, opts)
+	return nil
+}
+
+func (s *LazyMetaStore) populate(flists []string, opts PopulateOptions) {
+	defer close(s.done)
+
+	var order []string
+	opts.stream = true
+	err := walkLayers(flists, opts, func(entry *Entry) error {
+		name := cleanPath(entry.Filepath)
+		s.lock.Lock()
+		if _, ok := s.entries[name]; !ok {
+			order = append(order, name)
+			if name != "/" {
+				s.children[path.Dir(name)] = append(s.children[path.Dir(name)], name)
+			}
+		}
+		s.entries[name] = entry
+		s.lock.Unlock()
+		s.indexed.Broadcast()
+		return nil
+	})
+
+	s.lock.Lock()
+	s.complete, s.err = true, err
+	s.lock.Unlock()
+	s.indexed.Broadcast()
+	close(s.ready)
+
+	if err != nil {
+		return
+	}
+
+	log.Infof("Flist index ready (%d entries), populating in the background", len(order))
+
+	for _, name := range order {
+		if err := s.ensure(name); err != nil {
+			s.lock.Lock()
+			s.err = err
+			s.lock.Unlock()
+			return
+		}
+	}
+
+	// the store is complete, the index is not needed anymore
+	s.lock.Lock()
+	s.entries, s.children, s.added, s.deleted = nil, nil, nil, nil
+	s.lock.Unlock()
+
+	log.Infof("Background populate done: %d entries", len(order))
+}
+
+// Wait blocks until the background populate is over and returns its error
+func (s *LazyMetaStore) Wait() error {
+	<-s.done
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// ensureLocked adds the entry at name, and its parents, to the wrapped store
+// if it's not there yet.
+func (s *LazyMetaStore) ensureLocked(name string) error {
+	if s.entries == nil {
+		return nil
+	}
+
+	if _, ok := s.added[name]; ok {
+		return nil
+	}
+
+	entry, ok := s.entries[name]
+	if !ok || underAny(name, s.deleted) {
+		return nil
+	}
+
+	if parent := path.Dir(name); parent != name {
+		if err := s.ensureLocked(parent); err != nil {
+			return err
+		}
+	}
+
+	s.added[name] = struct{}{}
+	return s.writer.putEntry(entry, s.opts)
+}
+
+// waitLocked waits until the entry at name is indexed, or until the index is
+// complete if it's not in the flists
+func (s *LazyMetaStore) waitLocked(name string) {
+	for !s.complete {
+		if _, ok := s.entries[name]; ok {
+			return
+		}
+		s.indexed.Wait()
+	}
+}
+
+func (s *LazyMetaStore) ensure(name string) error {
+	<-s.ready
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ensureLocked(cleanPath(name))
+}
+
+// ensureChildren adds all the entries of the directory name to the wrapped
+// store
+func (s *LazyMetaStore) ensureChildren(name string) error {
+	<-s.ready
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	name = cleanPath(name)
+	if err := s.ensureLocked(name); err != nil {
+		return err
+	}
+
+	for _, child := range s.children[name] {
+		if err := s.ensureLocked(child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureTreeLocked adds the entry at name and everything under it to the
+// wrapped store
+func (s *LazyMetaStore) ensureTreeLocked(name string) error {
+	if err := s.ensureLocked(name); err != nil {
+		return err
+	}
+
+	for _, child := range s.children[name] {
+		if err := s.ensureTreeLocked(child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *LazyMetaStore) wrap(m Meta, name string) Meta {
+	select {
+	case <-s.done:
+		return m
+	default:
+		return &lazyMeta{Meta: m, store: s, path: name}
+	}
+}
+
+// The wrapped store is only accessed with the lock held, since the
+// background populate writes to it concurrently.
+
+func (s *LazyMetaStore) Get(name string) (Meta, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.waitLocked(cleanPath(name))
+	if err := s.ensureLocked(cleanPath(name)); err != nil {
+		log.Errorf("Failed to populate '%s': %s", name, err)
+	}
+
+	m, ok := s.MetaStore.Get(name)
+	if !ok {
+		return nil, false
+	}
+
+	return s.wrap(m, name), true
+}
+
+func (s *LazyMetaStore) CreateFile(name string) (Meta, error) {
+	<-s.ready
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.ensureLocked(cleanPath(name)); err != nil {
+		return nil, err
+	}
+
+	m, err := s.MetaStore.CreateFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.wrap(m, name), nil
+}
+
+func (s *LazyMetaStore) CreateDir(name string) (Meta, error) {
+	<-s.ready
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.ensureLocked(cleanPath(name)); err != nil {
+		return nil, err
+	}
+
+	m, err := s.MetaStore.CreateDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.wrap(m, name), nil
+}
+
+func (s *LazyMetaStore) Delete(meta Meta) error {
+	<-s.ready
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if m, ok := meta.(*lazyMeta); ok {
+		if s.deleted != nil {
+			s.deleted[cleanPath(m.path)] = struct{}{}
+		}
+		meta = m.Meta
+	}
+
+	return s.MetaStore.Delete(meta)
+}
+
+// Rename first adds both subtrees to the wrapped store, so the background
+// populate doesn't bring back the moved or replaced entries afterwards.
+func (s *LazyMetaStore) Rename(oldName, newName string) error {
+	<-s.ready
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	oldName, newName = cleanPath(oldName), cleanPath(newName)
+	if err := s.ensureTreeLocked(oldName); err != nil {
+		return err
+	}
+	if err := s.ensureTreeLocked(newName); err != nil {
+		return err
+	}
+
+	if err := s.MetaStore.Rename(oldName, newName); err != nil {
+		return err
+	}
+
+	if s.deleted != nil && oldName != newName {
+		s.deleted[oldName] = struct{}{}
+	}
+
+	return nil
+}
+
+func (s *LazyMetaStore) Link(oldName, newName string) (Meta, error) {
+	<-s.ready
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	oldName, newName = cleanPath(oldName), cleanPath(newName)
+	if err := s.ensureLocked(oldName); err != nil {
+		return nil, err
+	}
+	if err := s.ensureLocked(newName); err != nil {
+		return nil, err
+	}
+
+	m, err := s.MetaStore.Link(oldName, newName)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.wrap(m, newName), nil
+}
+
+// lazyMeta makes sure the children of a directory are in the store before
+// they are listed
+type lazyMeta struct {
+	Meta
+	store *LazyMetaStore
+	path  string
+}
+
+func (m *lazyMeta) Children() <-chan Meta {
+	if err := m.store.ensureChildren(m.path); err != nil {
+		log.Errorf("Failed to populate '%s': %s", m.path, err)
+	}
+
+	return m.Meta.Children()
+}
@@ -0,0 +1,113 @@
+package meta
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyMetaStore(t *testing.T) {
+	name := writeFlist(t,
+		"/a||0|root|root|755|4|0|0|",
+		"/a/b||0|root|root|755|4|0|0|",
+		"/a/b/c|aa|10|root|root|644|2|0|0|",
+		"/a/d|bb|10|root|root|644|2|0|0|",
+		"/e||0|root|root|755|4|0|0|",
+		"/e/f|cc|10|root|root|644|2|0|0|",
+	)
+	defer os.Remove(name)
+
+	store, err := NewLazyMetaStore(NewMemoryMetaStore())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, store.Populate([]string{name}, PopulateOptions{}))
+
+	m, ok := store.Get("a/b/c")
+	if assert.True(t, ok) {
+		data, _ := m.Load()
+		assert.Equal(t, "aa", data.Hash)
+	}
+
+	e, ok := store.Get("e")
+	if assert.True(t, ok) {
+		assert.NoError(t, store.Delete(e))
+	}
+
+	assert.NoError(t, store.Wait())
+
+	_, ok = store.Get("a/d")
+	assert.True(t, ok)
+	_, ok = store.Get("e/f")
+	assert.False(t, ok)
+}
+
+func TestLazyMetaStoreError(t *testing.T) {
+	name := writeFlist(t, "/a||0|root|root|755|9|0|0|")
+	defer os.Remove(name)
+
+	store, err := NewLazyMetaStore(NewMemoryMetaStore())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, store.Populate([]string{name}, PopulateOptions{}))
+	assert.Error(t, store.Wait())
+}
+
+func TestLazyMetaStoreServesWhileParsing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the flist is a pipe, the end of the flist is only written once the
+	// first entries are served
+	name := path.Join(dir, "flist")
+	if err := syscall.Mkfifo(name, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewLazyMetaStore(NewMemoryMetaStore())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, store.Populate([]string{name}, PopulateOptions{Workers: 1}))
+
+	pipe, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipe.Close()
+
+	fmt.Fprintln(pipe, "/a||0|root|root|755|4|0|0|")
+	for i := 0; i < parseBatchSize; i++ {
+		fmt.Fprintf(pipe, "/a/f%d|aa|10|root|root|644|2|0|0|\n", i)
+	}
+
+	found := make(chan bool)
+	go func() {
+		_, ok := store.Get("a/f1")
+		found <- ok
+	}()
+
+	select {
+	case ok := <-found:
+		assert.True(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Error("lookup not served while parsing")
+	}
+
+	// a bad line at the end still fails a strict populate
+	fmt.Fprintln(pipe, "/b||0|root|root|755|9|0|0|")
+	pipe.Close()
+	assert.Error(t, store.Wait())
+}
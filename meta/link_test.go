@@ -0,0 +1,95 @@
+package meta
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testLink(t *testing.T, store MetaStore) {
+	name := writeFlist(t, renameFlist...)
+	defer os.Remove(name)
+
+	if !assert.NoError(t, store.Populate([]string{name}, PopulateOptions{Owners: NewNumericIDMapper()})) {
+		return
+	}
+
+	link, err := store.Link("/a/d", "/e/g")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	orig, ok := store.Get("/a/d")
+	if !assert.True(t, ok) {
+		return
+	}
+
+	origData, err := orig.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+	linkData, err := link.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, origData.Inode, linkData.Inode)
+	assert.Equal(t, "bb", linkData.Hash)
+	assert.Equal(t, uint32(2), origData.Links())
+	assert.Equal(t, uint32(2), linkData.Links())
+
+	_, err = store.Link("/a/d", "/e/f")
+	assert.Equal(t, ErrExists, err)
+	_, err = store.Link("/a", "/z")
+	assert.Equal(t, ErrIsDir, err)
+	_, err = store.Link("/missing", "/z")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.NoError(t, store.Delete(orig))
+
+	m, ok := store.Get("/e/g")
+	if assert.True(t, ok) {
+		data, err := m.Load()
+		if assert.NoError(t, err) {
+			assert.Equal(t, "bb", data.Hash)
+			assert.Equal(t, uint32(1), data.Links())
+		}
+	}
+}
+
+func TestLink(t *testing.T) {
+	for _, s := range testStores {
+		t.Run(s.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "meta")
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer os.RemoveAll(dir)
+
+			testLink(t, s.open(t, dir))
+		})
+	}
+}
+
+func TestMemoryLinkShared(t *testing.T) {
+	store := NewMemoryMetaStore()
+	m, err := store.CreateFile("/a")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, m.Save(&MetaData{Filetype: syscall.S_IFREG, Permissions: 0644, Inode: 7}))
+
+	link, err := store.Link("/a", "/b")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, link.Save(&MetaData{Filetype: syscall.S_IFREG, Permissions: 0600, Inode: 7}))
+
+	data, _ := m.Load()
+	assert.Equal(t, uint32(0600), data.Permissions)
+	assert.Equal(t, uint32(2), data.Links())
+}
@@ -1,10 +1,7 @@
 package meta
 
 import (
-	"github.com/g8os/fs/utils"
-	"os/user"
 	"path"
-	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -38,6 +35,13 @@ func (m *memMeta) Load() (*MetaData, error) {
 }
 
 func (m *memMeta) Save(meta *MetaData) error {
+	if m.meta != nil && m.meta.Nlink > 1 {
+		// the data is shared with the other names of the entry
+		meta.Nlink = m.meta.Nlink
+		*m.meta = *meta
+		return nil
+	}
+
 	m.meta = meta
 	return nil
 }
@@ -113,7 +117,8 @@ func (s *memMetaStore) mkall(name string) *memMeta {
 	return m
 }
 
-func (s *memMetaStore) delete(name string) {
+// detach removes the node at name from the tree and returns it
+func (s *memMetaStore) detach(name string) *memMeta {
 	name = strings.Trim(name, "/")
 	parts := strings.Split(path.Clean(name), "/")
 	m := s.root
@@ -123,18 +128,46 @@ func (s *memMetaStore) delete(name string) {
 		}
 
 		if m.children == nil {
-			return
+			return nil
 		}
 
-		if i == len(parts)-1 {
-			delete(m.children, part)
-		}
 		c, ok := m.children[part]
 		if !ok {
-			return
+			return nil
+		}
+
+		if i == len(parts)-1 {
+			delete(m.children, part)
+			return c
 		}
 		m = c
 	}
+
+	return nil
+}
+
+func (s *memMetaStore) delete(name string) {
+	if m := s.detach(name); m != nil {
+		m.unlink()
+	}
+}
+
+// unlink drops the links of m and all its children, when they are deleted
+func (m *memMeta) unlink() {
+	if m.meta != nil && m.meta.Nlink > 1 {
+		m.meta.Nlink--
+	}
+	for _, child := range m.children {
+		child.unlink()
+	}
+}
+
+// setPath updates the path of m and all its children after a rename
+func (m *memMeta) setPath(name string) {
+	m.path = name
+	for base, child := range m.children {
+		child.setPath(path.Join(name, base))
+	}
 }
 
 func (s *memMetaStore) Get(name string) (Meta, bool) {
@@ -156,48 +189,26 @@ func (s *memMetaStore) Get(name string) (Meta, bool) {
 	return m, true
 }
 
-func (s *memMetaStore) Populate(plist string, trim string) error {
-	iter, err := utils.IterFlistFile(plist)
-	if err != nil {
-		return err
-	}
+// putEntry adds a single flist entry to the store
+func (s *memMetaStore) putEntry(entity *Entry, opts PopulateOptions) error {
+	// user and group id
+	uid, gid := opts.owner(entity)
 
-	for line := range iter {
-		entity, err := ParseLine(line, trim)
-		if err != nil {
-			return err
-		}
+	meta := s.mkall(entity.Filepath)
+	meta.meta = entity.MetaData(uid, gid)
+	meta.meta.Inode = atomic.AddUint64(&s.ino, 1)
 
-		// user and group id
-		uid := 0
-		u, err := user.Lookup(entity.Uname)
-		if err == nil {
-			uid, _ = strconv.Atoi(u.Uid)
-		}
+	return nil
+}
 
-		gid := 0
-		g, err := user.LookupGroup(entity.Gname)
-		if err == nil {
-			gid, _ = strconv.Atoi(g.Gid)
-		}
+func (s *memMetaStore) Populate(flists []string, opts PopulateOptions) error {
+	opts = opts.withDefaults()
+	err := walkLayers(flists, opts, func(entity *Entry) error {
+		return s.putEntry(entity, opts)
+	})
 
-		meta := s.mkall(entity.Filepath)
-		meta.meta = &MetaData{
-			Hash:        entity.Hash,
-			Size:        uint64(entity.Filesize),
-			Uname:       entity.Uname,
-			Uid:         uint32(uid),
-			Gname:       entity.Gname,
-			Gid:         uint32(gid),
-			Permissions: uint32(entity.Permissions),
-			Filetype:    entity.Filetype,
-			Ctime:       uint64(entity.Ctime.Unix()),
-			Mtime:       uint64(entity.Mtime.Unix()),
-			Extended:    entity.Extended,
-			DevMajor:    entity.DevMajor,
-			DevMinor:    entity.DevMinor,
-			Inode:       atomic.AddUint64(&s.ino, 1),
-		}
+	if err != nil {
+		return err
 	}
 	log.Debugf("Populated: %d", s.ino)
 
@@ -208,6 +219,7 @@ func (s *memMetaStore) CreateFile(name string) (Meta, error) {
 	m := s.mkall(name)
 	m.meta = &MetaData{
 		Filetype: syscall.S_IFREG,
+		Inode:    atomic.AddUint64(&s.ino, 1),
 	}
 	return m, nil
 }
@@ -216,6 +228,7 @@ func (s *memMetaStore) CreateDir(name string) (Meta, error) {
 	m := s.mkall(name)
 	m.meta = &MetaData{
 		Filetype: syscall.S_IFDIR,
+		Inode:    atomic.AddUint64(&s.ino, 1),
 	}
 	return m, nil
 }
@@ -224,3 +237,54 @@ func (s *memMetaStore) Delete(meta Meta) error {
 	s.delete(meta.String())
 	return nil
 }
+
+func (s *memMetaStore) Rename(oldName, newName string) error {
+	oldName, newName, same, err := renamePaths(oldName, newName)
+	if err != nil {
+		return err
+	}
+
+	m, ok := s.Get(oldName)
+	if !ok {
+		return ErrNotFound
+	}
+
+	if same {
+		return nil
+	}
+
+	node := m.(*memMeta)
+	s.detach(oldName)
+	s.delete(newName)
+
+	// mkall creates the missing parents, the placeholder it makes for the
+	// new name itself is replaced by the moved node
+	s.mkall(newName)
+	parent, _ := s.Get(path.Dir(newName))
+	parent.(*memMeta).children[path.Base(newName)] = node
+	node.setPath(newName)
+
+	return nil
+}
+
+func (s *memMetaStore) Link(oldName, newName string) (Meta, error) {
+	m, ok := s.Get(oldName)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	node := m.(*memMeta)
+	if node.meta == nil || node.meta.Filetype == syscall.S_IFDIR {
+		return nil, ErrIsDir
+	}
+
+	if _, ok := s.Get(newName); ok {
+		return nil, ErrExists
+	}
+
+	link := s.mkall(newName)
+	node.meta.Nlink = node.meta.Links() + 1
+	link.meta = node.meta
+
+	return link, nil
+}
@@ -1,9 +1,10 @@
 package meta
 
 import (
+	"encoding/hex"
 	"fmt"
 	"github.com/op/go-logging"
-	"os"
+	"path"
 	"strconv"
 	"strings"
 	"syscall"
@@ -13,6 +14,11 @@ import (
 var (
 	log         = logging.MustGetLogger("meta")
 	ErrNotFound = fmt.Errorf("not found")
+	// ErrInvalidRename is returned when renaming the root, moving a
+	// directory inside itself or replacing one of its own parents
+	ErrInvalidRename = fmt.Errorf("invalid rename")
+	ErrExists        = fmt.Errorf("already exists")
+	ErrIsDir         = fmt.Errorf("is a directory")
 )
 
 type MetaData struct {
@@ -32,6 +38,24 @@ type MetaData struct {
 	UserKey     string
 	StoreKey    string
 	Inode       uint64
+	Layer       int    // index of the flist layer the entry comes from
+	Nlink       uint32 // number of names (hard links) of the entry, 0 means 1
+	// Xattrs are the extended attributes, values are base64 encoded
+	Xattrs map[string]string `toml:",omitempty"`
+	// Atime is the access time, 0 means Mtime
+	Atime uint64 `toml:",omitempty"`
+	// nanoseconds of the times
+	CtimeNsec uint32 `toml:",omitempty"`
+	MtimeNsec uint32 `toml:",omitempty"`
+	AtimeNsec uint32 `toml:",omitempty"`
+}
+
+// Links returns the number of hard links of the entry
+func (m *MetaData) Links() uint32 {
+	if m.Nlink == 0 {
+		return 1
+	}
+	return m.Nlink
 }
 
 type MetaState uint32
@@ -81,11 +105,39 @@ type Meta interface {
 }
 
 type MetaStore interface {
-	Populate(plist string, trim string) error
+	Populate(flists []string, opts PopulateOptions) error
 	Get(name string) (Meta, bool)
 	CreateFile(name string) (Meta, error)
 	CreateDir(name string) (Meta, error)
 	Delete(meta Meta) error
+	// Rename moves the entry at oldName, and everything under it, to
+	// newName. An existing entry at newName is replaced with its subtree.
+	Rename(oldName, newName string) error
+	// Link adds newName as another name of the entry at oldName, the names
+	// share the same inode and meta data. Directories can't be linked.
+	Link(oldName, newName string) (Meta, error)
+}
+
+// renamePaths cleans the paths of a rename (relative to the store root) and
+// checks that the rename is valid. same is true if both paths are the same
+// entry.
+func renamePaths(oldName, newName string) (string, string, bool, error) {
+	oldName = strings.Trim(path.Clean("/"+oldName), "/")
+	newName = strings.Trim(path.Clean("/"+newName), "/")
+
+	if oldName == "" || newName == "" {
+		return "", "", false, ErrInvalidRename
+	}
+
+	if oldName == newName {
+		return oldName, newName, true, nil
+	}
+
+	if strings.HasPrefix(newName, oldName+"/") || strings.HasPrefix(oldName, newName+"/") {
+		return "", "", false, ErrInvalidRename
+	}
+
+	return oldName, newName, false, nil
 }
 
 /*
@@ -109,20 +161,68 @@ type Entry struct {
 	Extended    string    // extended attribute (see python flist doc)
 	DevMajor    int64     // block/char device major id
 	DevMinor    int64     // block/char device minor id
+	Layer       int       // index of the flist layer the entry comes from
+	// Xattrs are the extended attributes carried in the extended column,
+	// values are base64 encoded
+	Xattrs map[string]string
+}
+
+// freeFormExtended tells if the extended column of the entry is ignored,
+// being neither a symlink target, a device number nor extended attributes
+func (e *Entry) freeFormExtended() bool {
+	switch e.Filetype {
+	case syscall.S_IFLNK, syscall.S_IFBLK, syscall.S_IFCHR:
+		return false
+	}
+	return e.Extended != "" && e.Xattrs == nil
+}
+
+// MetaData returns the meta data of the entry, owned by uid and gid
+func (e *Entry) MetaData(uid, gid uint32) *MetaData {
+	return &MetaData{
+		Hash:        e.Hash,
+		Size:        uint64(e.Filesize),
+		Uname:       e.Uname,
+		Uid:         uid,
+		Gname:       e.Gname,
+		Gid:         gid,
+		Permissions: uint32(e.Permissions),
+		Filetype:    e.Filetype,
+		Ctime:       uint64(e.Ctime.Unix()),
+		Mtime:       uint64(e.Mtime.Unix()),
+		Extended:    e.Extended,
+		DevMajor:    e.DevMajor,
+		DevMinor:    e.DevMinor,
+		Layer:       e.Layer,
+		Xattrs:      e.Xattrs,
+	}
+}
+
+// fileTypes maps the flist file type column to the matching S_IFMT bits
+var fileTypes = map[int]uint32{
+	0: syscall.S_IFSOCK,
+	1: syscall.S_IFLNK,
+	2: syscall.S_IFREG,
+	3: syscall.S_IFBLK,
+	4: syscall.S_IFDIR,
+	5: syscall.S_IFCHR,
+	6: syscall.S_IFIFO,
 }
 
 func ParseLine(line string, trim string) (*Entry, error) {
 	if line == "" {
-		err := fmt.Errorf("Cannot parse empty lines\n")
-		return nil, err
+		return nil, fmt.Errorf("cannot parse empty line")
 	}
 
 	// split line
 	items := strings.Split(line, "|")
 
 	if len(items) < 10 {
-		err := fmt.Errorf("Flist item: malformed line, at least 10 fields expected, %d found\n", len(items))
-		return nil, err
+		return nil, fmt.Errorf("malformed line, at least 10 fields expected, %d found", len(items))
+	}
+
+	if items[0] == "" {
+		return nil, fmt.Errorf("empty file path")
 	}
 
 	//
@@ -131,95 +231,110 @@ func ParseLine(line string, trim string) (*Entry, error) {
 	filepath := strings.TrimPrefix(items[0], trim)
 
 	length, err := strconv.ParseInt(items[2], 10, 64)
-	if err != nil {
-		fmt.Errorf("Error parsing filesize: %v\n", err)
-		return nil, err
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid filesize '%s'", items[2])
 	}
 
 	perms, err := strconv.ParseInt(items[5], 8, 64)
-	if err != nil {
-		fmt.Errorf("Error parsing permissions: %v\n", err)
-		return nil, err
+	if err != nil || perms < 0 {
+		return nil, fmt.Errorf("invalid permissions '%s'", items[5])
 	}
 
 	//
 	// file type
 	//
 	ftype, err := strconv.Atoi(items[6])
-	fileType := os.ModeDir
 	if err != nil {
-		fmt.Errorf("Error parsing filetype: %v\n", err)
-		return nil, err
+		return nil, fmt.Errorf("invalid filetype '%s'", items[6])
+	}
+
+	fileType, ok := fileTypes[ftype]
+	if !ok {
+		return nil, fmt.Errorf("unknown filetype %d", ftype)
+	}
+
+	// permissions may be given as a full st_mode, in which case the type
+	// bits must agree with the filetype column.
+	if typeBits := uint32(perms) & syscall.S_IFMT; typeBits != 0 && typeBits != fileType {
+		return nil, fmt.Errorf("permissions %o do not match filetype %d", perms, ftype)
+	}
+	if perms&^(syscall.S_IFMT|07777) != 0 {
+		return nil, fmt.Errorf("invalid permissions '%s'", items[5])
+	}
+	perms &= 07777
+
+	hash := items[1]
+	switch fileType {
+	case syscall.S_IFREG:
+		if hash == "" && length > 0 {
+			return nil, fmt.Errorf("missing hash for regular file of %d bytes", length)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("invalid hash '%s': not hex encoded", hash)
+		}
+	case syscall.S_IFLNK:
+		if items[9] == "" {
+			return nil, fmt.Errorf("symlink without target")
+		}
 	}
 
 	devMajor := int64(0)
 	devMinor := int64(0)
+	var xattrs map[string]string
 
-	if ftype == 3 || ftype == 5 {
+	switch fileType {
+	case syscall.S_IFLNK:
+	case syscall.S_IFBLK, syscall.S_IFCHR:
 		temp := strings.Split(items[9], ",")
+		if len(temp) != 2 {
+			return nil, fmt.Errorf("invalid device number '%s', expected 'major,minor'", items[9])
+		}
 
 		devMajor, err = strconv.ParseInt(temp[0], 10, 64)
-		if err != nil {
-			fmt.Errorf("Error parsing device major id: %v\n", err)
-			return nil, err
+		if err != nil || devMajor < 0 {
+			return nil, fmt.Errorf("invalid device major id '%s'", temp[0])
 		}
 
 		devMinor, err = strconv.ParseInt(temp[1], 10, 64)
+		if err != nil || devMinor < 0 {
+			return nil, fmt.Errorf("invalid device minor id '%s'", temp[1])
+		}
+	default:
+		// the extended column used to be free form, it only holds extended
+		// attributes if it parses as such, the flist parser warns about the
+		// rest once
+		xattrs, err = ParseXattrs(items[9])
 		if err != nil {
-			fmt.Errorf("Error parsing device minor id: %v\n", err)
-			return nil, err
+			xattrs = nil
 		}
 	}
 
-	if ftype == 0 {
-		fileType = syscall.S_IFSOCK
-	}
-	if ftype == 1 {
-		fileType = syscall.S_IFLNK
-	}
-	if ftype == 2 {
-		fileType = syscall.S_IFREG
-	}
-	if ftype == 3 {
-		fileType = syscall.S_IFBLK
-	}
-	if ftype == 4 {
-		fileType = syscall.S_IFDIR
-	}
-	if ftype == 5 {
-		fileType = syscall.S_IFCHR
-	}
-	if ftype == 6 {
-		fileType = syscall.S_IFIFO
-	}
-
 	//
 	// file times
 	//
 	ctime, err := strconv.ParseInt(items[7], 10, 64)
 	if err != nil {
-		fmt.Errorf("Error parsing creation time: %v\n", err)
-		return nil, err
+		return nil, fmt.Errorf("invalid creation time '%s'", items[7])
 	}
 
 	mtime, err := strconv.ParseInt(items[8], 10, 64)
 	if err != nil {
-		fmt.Errorf("Error parsing modification time: %v\n", err)
-		return nil, err
+		return nil, fmt.Errorf("invalid modification time '%s'", items[8])
 	}
 
 	return &Entry{
 		Filepath:    filepath,
-		Hash:        items[1],
+		Hash:        hash,
 		Filesize:    length,
 		Uname:       items[3],
 		Gname:       items[4],
 		Permissions: perms,
-		Filetype:    uint32(fileType),
+		Filetype:    fileType,
 		Ctime:       time.Unix(ctime, 0),
 		Mtime:       time.Unix(mtime, 0),
 		Extended:    items[9],
 		DevMajor:    devMajor,
 		DevMinor:    devMinor,
+		Xattrs:      xattrs,
 	}, nil
 }
@@ -0,0 +1,261 @@
+package meta
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IDMapper resolves the user and group names of the flist entries to the
+// numeric ids served by the mount
+type IDMapper interface {
+	Uid(name string) uint32
+	Gid(name string) uint32
+}
+
+// unknownIDs logs a single warning for every name that can't be mapped
+type unknownIDs struct {
+	lock sync.Mutex
+	seen map[string]struct{}
+}
+
+func (u *unknownIDs) warn(kind, name string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.seen == nil {
+		u.seen = make(map[string]struct{})
+	}
+	key := kind + ":" + name
+	if _, ok := u.seen[key]; ok {
+		return
+	}
+	u.seen[key] = struct{}{}
+	log.Warningf("Can't map %s '%s', using id 0", kind, name)
+}
+
+// parseID parses a numeric user or group id
+func parseID(name string) (uint32, bool) {
+	id, err := strconv.ParseUint(name, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+type hostIDMapper struct{}
+
+// NewHostIDMapper maps names through the passwd and group databases of the
+// host, unknown names are mapped to 0. Lookups are cached, so every name is
+// only resolved once.
+func NewHostIDMapper() IDMapper {
+	return NewCachedIDMapper(hostIDMapper{})
+}
+
+func (hostIDMapper) Uid(name string) uint32 {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0
+	}
+	uid, _ := parseID(u.Uid)
+	return uid
+}
+
+func (hostIDMapper) Gid(name string) uint32 {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0
+	}
+	gid, _ := parseID(g.Gid)
+	return gid
+}
+
+type cachedIDMapper struct {
+	mapper IDMapper
+	lock   sync.RWMutex
+	users  map[string]uint32
+	groups map[string]uint32
+}
+
+// NewCachedIDMapper remembers the ids returned by mapper, it is safe for
+// concurrent use if mapper is.
+func NewCachedIDMapper(mapper IDMapper) IDMapper {
+	return &cachedIDMapper{
+		mapper: mapper,
+		users:  make(map[string]uint32),
+		groups: make(map[string]uint32),
+	}
+}
+
+func (m *cachedIDMapper) lookup(table map[string]uint32, name string, resolve func(string) uint32) uint32 {
+	m.lock.RLock()
+	id, ok := table[name]
+	m.lock.RUnlock()
+	if ok {
+		return id
+	}
+
+	id = resolve(name)
+	m.lock.Lock()
+	table[name] = id
+	m.lock.Unlock()
+	return id
+}
+
+func (m *cachedIDMapper) Uid(name string) uint32 {
+	return m.lookup(m.users, name, m.mapper.Uid)
+}
+
+func (m *cachedIDMapper) Gid(name string) uint32 {
+	return m.lookup(m.groups, name, m.mapper.Gid)
+}
+
+type tableIDMapper struct {
+	users   map[string]uint32
+	groups  map[string]uint32
+	unknown unknownIDs
+}
+
+// NewTableIDMapper maps names with the given tables. Names missing from the
+// tables are used as numeric ids if they are numbers, or mapped to 0.
+func NewTableIDMapper(users, groups map[string]uint32) IDMapper {
+	return &tableIDMapper{
+		users:  users,
+		groups: groups,
+	}
+}
+
+// NewNumericIDMapper uses the numeric ids stored in the flist owner columns
+func NewNumericIDMapper() IDMapper {
+	return NewTableIDMapper(nil, nil)
+}
+
+func (m *tableIDMapper) lookup(kind string, table map[string]uint32, name string) uint32 {
+	if id, ok := table[name]; ok {
+		return id
+	}
+	if id, ok := parseID(name); ok {
+		return id
+	}
+	m.unknown.warn(kind, name)
+	return 0
+}
+
+func (m *tableIDMapper) Uid(name string) uint32 {
+	return m.lookup("user", m.users, name)
+}
+
+func (m *tableIDMapper) Gid(name string) uint32 {
+	return m.lookup("group", m.groups, name)
+}
+
+// parseIDFile reads a passwd or group formatted file and returns the
+// name -> id (third column) table.
+func parseIDFile(r io.Reader) (map[string]uint32, error) {
+	table := make(map[string]uint32)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("malformed line '%s'", line)
+		}
+
+		id, ok := parseID(fields[2])
+		if !ok {
+			return nil, fmt.Errorf("invalid id '%s' for '%s'", fields[2], fields[0])
+		}
+
+		if _, ok := table[fields[0]]; !ok {
+			table[fields[0]] = id
+		}
+	}
+
+	return table, scanner.Err()
+}
+
+// NewPasswdIDMapper maps names through passwd and group files, typically the
+// ones shipped inside the flist itself.
+func NewPasswdIDMapper(passwd, group io.Reader) (IDMapper, error) {
+	users, err := parseIDFile(passwd)
+	if err != nil {
+		return nil, fmt.Errorf("passwd: %s", err)
+	}
+
+	groups, err := parseIDFile(group)
+	if err != nil {
+		return nil, fmt.Errorf("group: %s", err)
+	}
+
+	return NewTableIDMapper(users, groups), nil
+}
+
+type squashIDMapper struct {
+	uid uint32
+	gid uint32
+}
+
+// NewSquashIDMapper maps every user to uid and every group to gid
+func NewSquashIDMapper(uid, gid uint32) IDMapper {
+	return &squashIDMapper{uid: uid, gid: gid}
+}
+
+func (m *squashIDMapper) Uid(name string) uint32 {
+	return m.uid
+}
+
+func (m *squashIDMapper) Gid(name string) uint32 {
+	return m.gid
+}
+
+// FlistOwners builds the id mapper of a populate from files of the flists
+// themselves, typically their passwd and group files. The files are looked up
+// in the merged layers before the include, exclude and rewrite filters apply,
+// by the populate walk itself.
+type FlistOwners struct {
+	// Names are the paths of the files in the flists
+	Names []string
+	// Build returns the id mapper from the entries of Names, in order
+	Build func(entries []*Entry) (IDMapper, error)
+}
+
+// flistIDMapper is the id mapper of a populate with FlistOwners, set by the
+// walk before it passes any entry on
+type flistIDMapper struct {
+	IDMapper
+}
+
+// build sets the mapper from the files of owners among the merged entries
+func (m *flistIDMapper) build(owners *FlistOwners, merged []*Entry) error {
+	wanted := make(map[string][]int)
+	for i, name := range owners.Names {
+		name = cleanPath(name)
+		wanted[name] = append(wanted[name], i)
+	}
+
+	found := make([]*Entry, len(owners.Names))
+	for _, entry := range merged {
+		for _, i := range wanted[cleanPath(entry.Filepath)] {
+			found[i] = entry
+		}
+	}
+	for i, entry := range found {
+		if entry == nil {
+			return fmt.Errorf("can't find '%s' in the flists", owners.Names[i])
+		}
+	}
+
+	mapper, err := owners.Build(found)
+	if err != nil {
+		return err
+	}
+	m.IDMapper = mapper
+	return nil
+}
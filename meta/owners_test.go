@@ -0,0 +1,137 @@
+package meta
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNumericIDMapper(t *testing.T) {
+	m := NewNumericIDMapper()
+	assert.Equal(t, uint32(1000), m.Uid("1000"))
+	assert.Equal(t, uint32(50), m.Gid("50"))
+	assert.Equal(t, uint32(0), m.Uid("nobody-here"))
+}
+
+func TestTableIDMapper(t *testing.T) {
+	m := NewTableIDMapper(map[string]uint32{"www-data": 33}, map[string]uint32{"www-data": 34})
+	assert.Equal(t, uint32(33), m.Uid("www-data"))
+	assert.Equal(t, uint32(34), m.Gid("www-data"))
+	assert.Equal(t, uint32(12), m.Uid("12"))
+}
+
+func TestPasswdIDMapper(t *testing.T) {
+	passwd := "root:x:0:0:root:/root:/bin/bash\n# comment\npostgres:x:70:70::/var/lib/postgresql:/bin/sh\n"
+	group := "root:x:0:\npostgres:x:71:\n"
+
+	m, err := NewPasswdIDMapper(strings.NewReader(passwd), strings.NewReader(group))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, uint32(70), m.Uid("postgres"))
+	assert.Equal(t, uint32(71), m.Gid("postgres"))
+	assert.Equal(t, uint32(0), m.Uid("root"))
+
+	_, err = NewPasswdIDMapper(strings.NewReader("bad"), strings.NewReader(group))
+	assert.Error(t, err)
+}
+
+func TestPopulateOwners(t *testing.T) {
+	name := writeFlist(t,
+		"/a||0|root|root|755|4|0|0|",
+		"/a/b||0|app|staff|644|2|0|0|",
+	)
+	defer os.Remove(name)
+
+	store := NewMemoryMetaStore()
+	err := store.Populate([]string{name}, PopulateOptions{Owners: NewSquashIDMapper(1000, 2000)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	m, ok := store.Get("a/b")
+	if assert.True(t, ok) {
+		data, _ := m.Load()
+		assert.Equal(t, uint32(1000), data.Uid)
+		assert.Equal(t, uint32(2000), data.Gid)
+		assert.Equal(t, "app", data.Uname)
+	}
+}
+
+func TestPopulateFlistOwners(t *testing.T) {
+	lower := writeFlist(t,
+		"/etc||0|root|root|755|4|0|0|",
+		"/etc/passwd|aa|10|root|root|644|2|0|0|",
+		"/etc/group|bb|10|root|root|644|2|0|0|",
+	)
+	defer os.Remove(lower)
+	upper := writeFlist(t,
+		"/a||0|root|root|755|4|0|0|",
+		"/a/b||0|app|staff|644|2|0|0|",
+		"/etc/group|cc|10|root|root|644|2|0|0|",
+	)
+	defer os.Remove(upper)
+
+	var built [][]string
+	owners := &FlistOwners{
+		Names: []string{"/etc/passwd", "/etc/group"},
+		Build: func(entries []*Entry) (IDMapper, error) {
+			var hashes []string
+			for _, entry := range entries {
+				hashes = append(hashes, entry.Hash)
+			}
+			built = append(built, hashes)
+			return NewSquashIDMapper(1000, 2000), nil
+		},
+	}
+
+	// the files are found in the merged layers, out of the included paths
+	store := NewMemoryMetaStore()
+	err := store.Populate([]string{lower, upper}, PopulateOptions{Include: []string{"/a/**"}, FlistOwners: owners})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, [][]string{{"aa", "cc"}}, built)
+
+	m, ok := store.Get("a/b")
+	if assert.True(t, ok) {
+		data, _ := m.Load()
+		assert.Equal(t, uint32(1000), data.Uid)
+		assert.Equal(t, uint32(2000), data.Gid)
+	}
+	_, ok = store.Get("etc/passwd")
+	assert.False(t, ok)
+
+	owners.Names = []string{"/etc/shadow"}
+	err = NewMemoryMetaStore().Populate([]string{lower}, PopulateOptions{FlistOwners: owners})
+	assert.Error(t, err)
+}
+
+type countingIDMapper struct {
+	calls int
+}
+
+func (m *countingIDMapper) Uid(name string) uint32 {
+	m.calls++
+	return 42
+}
+
+func (m *countingIDMapper) Gid(name string) uint32 {
+	m.calls++
+	return 43
+}
+
+func TestCachedIDMapper(t *testing.T) {
+	counter := &countingIDMapper{}
+	m := NewCachedIDMapper(counter)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, uint32(42), m.Uid("www-data"))
+		assert.Equal(t, uint32(43), m.Gid("www-data"))
+	}
+
+	assert.Equal(t, 2, counter.calls)
+}
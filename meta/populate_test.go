@@ -0,0 +1,176 @@
+package meta
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// generateFlist writes a synthetic flist of n entries: directories holding
+// 100 regular files each.
+func generateFlist(n int) (string, error) {
+	f, err := ioutil.TempFile("", "flist")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for i := 0; i < n; i++ {
+		dir := fmt.Sprintf("/data/d%d", i/100)
+		if i%100 == 0 {
+			fmt.Fprintf(w, "%s||4096|root|root|755|4|1470000000|1470000000|\n", dir)
+			continue
+		}
+		fmt.Fprintf(w, "%s/f%d|%032x|%d|root|root|644|2|1470000000|1470000000|\n", dir, i, i, i)
+	}
+
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+func TestParseFlistOrder(t *testing.T) {
+	// spans several parse batches
+	n := 3*parseBatchSize + 17
+	name, err := generateFlist(n)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(name)
+
+	lines := 0
+	err = parseFlist(name, "", 4, func(line *parsedLine) error {
+		lines++
+		assert.Equal(t, lines, line.lineno)
+		assert.NoError(t, line.err)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, n, lines)
+}
+
+func TestParseFlistStop(t *testing.T) {
+	name, err := generateFlist(3 * parseBatchSize)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(name)
+
+	stop := fmt.Errorf("stop")
+	lines := 0
+	err = parseFlist(name, "", 4, func(line *parsedLine) error {
+		if lines++; lines == 10 {
+			return stop
+		}
+		return nil
+	})
+
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 10, lines)
+}
+
+func TestPopulateFileParallel(t *testing.T) {
+	name, err := generateFlist(1000)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(name)
+
+	base, err := ioutil.TempDir("", "meta")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(base)
+
+	store := NewFileMetaStore(base)
+	err = store.Populate([]string{name}, PopulateOptions{Owners: NewNumericIDMapper(), Workers: 8})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	m, ok := store.Get("/data/d9/f999")
+	if !assert.True(t, ok) {
+		return
+	}
+
+	data, err := m.Load()
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(999), data.Size)
+	}
+}
+
+const benchEntries = 1000000
+
+var benchFlist struct {
+	once sync.Once
+	name string
+	err  error
+}
+
+// benchmarkFlist returns the synthetic 1M entries flist, generated once
+func benchmarkFlist(b *testing.B) string {
+	benchFlist.once.Do(func() {
+		benchFlist.name, benchFlist.err = generateFlist(benchEntries)
+	})
+
+	if benchFlist.err != nil {
+		b.Fatal(benchFlist.err)
+	}
+
+	return benchFlist.name
+}
+
+func BenchmarkParseFlist(b *testing.B) {
+	name := benchmarkFlist(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := walkLayers([]string{name}, PopulateOptions{}, func(*Entry) error {
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPopulateMemory(b *testing.B) {
+	name := benchmarkFlist(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := NewMemoryMetaStore().Populate([]string{name}, PopulateOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPopulateFile(b *testing.B) {
+	name := benchmarkFlist(b)
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		base, err := ioutil.TempDir("", "meta")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		if err := NewFileMetaStore(base).Populate([]string{name}, PopulateOptions{}); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		os.RemoveAll(base)
+		b.StartTimer()
+	}
+}
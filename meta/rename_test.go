@@ -0,0 +1,142 @@
+package meta
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var renameFlist = []string{
+	"/a||0|root|root|755|4|0|0|",
+	"/a/b||0|root|root|755|4|0|0|",
+	"/a/b/c|aa|10|root|root|644|2|0|0|",
+	"/a/d|bb|20|root|root|644|2|0|0|",
+	"/e||0|root|root|755|4|0|0|",
+	"/e/f|cc|30|root|root|644|2|0|0|",
+}
+
+type testStore struct {
+	name string
+	open func(t *testing.T, dir string) MetaStore
+}
+
+var testStores = []testStore{
+	{"memory", func(t *testing.T, dir string) MetaStore {
+		return NewMemoryMetaStore()
+	}},
+	{"file", func(t *testing.T, dir string) MetaStore {
+		return NewFileMetaStore(dir)
+	}},
+	{"sqlite", func(t *testing.T, dir string) MetaStore {
+		store, err := NewSqliteMetaStore(path.Join(dir, "meta.db"))
+		if err != nil {
+			t.Skipf("sqlite not available: %s", err)
+		}
+		return store
+	}},
+}
+
+func children(m Meta) []string {
+	var names []string
+	if ch := m.Children(); ch != nil {
+		for child := range ch {
+			names = append(names, child.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func testRename(t *testing.T, store MetaStore) {
+	name := writeFlist(t, renameFlist...)
+	defer os.Remove(name)
+
+	if !assert.NoError(t, store.Populate([]string{name}, PopulateOptions{Owners: NewNumericIDMapper()})) {
+		return
+	}
+
+	// directory with a subtree, to a new parent
+	assert.NoError(t, store.Rename("/a", "/x/y"))
+
+	_, ok := store.Get("/a")
+	assert.False(t, ok)
+	_, ok = store.Get("/a/b/c")
+	assert.False(t, ok)
+
+	m, ok := store.Get("/x/y/b/c")
+	if assert.True(t, ok) {
+		data, err := m.Load()
+		if assert.NoError(t, err) {
+			assert.Equal(t, "aa", data.Hash)
+		}
+	}
+
+	if m, ok := store.Get("/x/y"); assert.True(t, ok) {
+		assert.Equal(t, []string{"b", "d"}, children(m))
+	}
+
+	// a file replacing a file
+	assert.NoError(t, store.Rename("/x/y/d", "/e/f"))
+	m, ok = store.Get("/e/f")
+	if assert.True(t, ok) {
+		data, err := m.Load()
+		if assert.NoError(t, err) {
+			assert.Equal(t, "bb", data.Hash)
+		}
+	}
+	if m, ok := store.Get("/x/y"); assert.True(t, ok) {
+		assert.Equal(t, []string{"b"}, children(m))
+	}
+
+	// a directory replacing a directory
+	assert.NoError(t, store.Rename("/x/y/b", "/e"))
+	_, ok = store.Get("/e/f")
+	assert.False(t, ok)
+	_, ok = store.Get("/e/c")
+	assert.True(t, ok)
+
+	assert.Equal(t, ErrNotFound, store.Rename("/missing", "/other"))
+	assert.Equal(t, ErrInvalidRename, store.Rename("/x", "/x/y/z"))
+	assert.Equal(t, ErrInvalidRename, store.Rename("/x/y", "/x"))
+	assert.Equal(t, ErrInvalidRename, store.Rename("/", "/z"))
+	assert.NoError(t, store.Rename("/e", "/e/"))
+}
+
+func TestRename(t *testing.T) {
+	for _, s := range testStores {
+		t.Run(s.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "meta")
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer os.RemoveAll(dir)
+
+			testRename(t, s.open(t, dir))
+		})
+	}
+}
+
+func TestLazyRename(t *testing.T) {
+	name := writeFlist(t, renameFlist...)
+	defer os.Remove(name)
+
+	store, err := NewLazyMetaStore(NewMemoryMetaStore())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, store.Populate([]string{name}, PopulateOptions{}))
+	assert.NoError(t, store.Rename("/a", "/z"))
+	assert.NoError(t, store.Wait())
+
+	_, ok := store.Get("/a/b/c")
+	assert.False(t, ok)
+	_, ok = store.Get("/z/b/c")
+	assert.True(t, ok)
+	_, ok = store.Get("/z/d")
+	assert.True(t, ok)
+}
@@ -2,11 +2,8 @@ package meta
 
 import (
 	"database/sql"
-	"github.com/g8os/fs/utils"
 	_ "github.com/mattn/go-sqlite3"
-	"os/user"
 	"path"
-	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -14,8 +11,19 @@ import (
 )
 
 const (
-	INSERT_STMT = `insert into meta (inode, parent, path, state, hash, uid, gid, permissions, filetype, ctime, mtime, extended, devmajor, devminor) values
-		(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	INSERT_STMT = `insert into meta (inode, parent, path, state, hash, uid, gid, permissions, filetype, ctime, mtime, extended, devmajor, devminor, layer, xattrs) values
+		(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	// REPLACE_STMT overrides an existing entry with the same path
+	REPLACE_STMT = `insert or replace into meta (inode, parent, path, state, hash, uid, gid, permissions, filetype, ctime, mtime, extended, devmajor, devminor, layer, xattrs) values
+		(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	// LINK_STMT adds a name sharing the inode of an existing entry
+	LINK_STMT = `insert into meta (inode, parent, path, state, hash, uid, gid, permissions, filetype, ctime, mtime, extended, devmajor, devminor, layer, xattrs)
+		select inode, ?, ?, state, hash, uid, gid, permissions, filetype, ctime, mtime, extended, devmajor, devminor, layer, xattrs from meta where path = ?`
+	// NLINK_COLUMN counts the names (hard links) of a meta row
+	NLINK_COLUMN = `(select count(*) from meta l where l.inode = meta.inode)`
+	// INSERT_PARENT_STMT adds an implicit directory, unless it's already defined
+	INSERT_PARENT_STMT = `insert or ignore into meta (inode, parent, path, state, hash, uid, gid, permissions, filetype, ctime, mtime, extended, devmajor, devminor, layer, xattrs) values
+		(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 )
 
 type sqlMeta struct {
@@ -51,7 +59,7 @@ func (m *sqlMeta) Save(meta *MetaData) error {
 }
 
 func (m *sqlMeta) Children() <-chan Meta {
-	rows, err := m.db.Query(`select inode, path, hash, state, uid, gid, permissions, filetype, ctime, mtime, extended, devmajor, devminor from meta
+	rows, err := m.db.Query(`select inode, path, hash, state, uid, gid, permissions, filetype, ctime, mtime, extended, devmajor, devminor, layer, xattrs, `+NLINK_COLUMN+` from meta
 		where parent = ?`, m.path)
 
 	if err != nil {
@@ -65,10 +73,12 @@ func (m *sqlMeta) Children() <-chan Meta {
 		for rows.Next() {
 			state := MetaInitial
 			name := ""
+			xattrs := ""
 			meta := MetaData{}
-			if err := rows.Scan(&meta.Inode, &name, &meta.Hash, &state, &meta.Uid, &meta.Gid, &meta.Permissions, &meta.Filetype, &meta.Ctime, &meta.Mtime, &meta.Extended, &meta.DevMajor, &meta.DevMinor); err != nil {
+			if err := rows.Scan(&meta.Inode, &name, &meta.Hash, &state, &meta.Uid, &meta.Gid, &meta.Permissions, &meta.Filetype, &meta.Ctime, &meta.Mtime, &meta.Extended, &meta.DevMajor, &meta.DevMinor, &meta.Layer, &xattrs, &meta.Nlink); err != nil {
 				break
 			}
+			meta.Xattrs, _ = ParseXattrs(xattrs)
 
 			ch <- &sqlMeta{
 				db:   m.db,
@@ -110,10 +120,12 @@ func NewSqliteMetaStore(name string) (MetaStore, error) {
 		UserKey     string
 		StoreKey    string
 		Inode       uint64
+		Layer       int
 	*/
 	_, err = db.Exec(`
-	create table meta (inode not null primary key, parent text, path text unique, state int64, hash text,
-	uid int, gid int, permissions int, filetype int, ctime int, mtime int, extended text, devmajor int64, devminor int64);
+	create table meta (inode not null, parent text, path text not null primary key, state int64, hash text,
+	uid int, gid int, permissions int, filetype int, ctime int, mtime int, extended text, devmajor int64, devminor int64, layer int, xattrs text);
+	create index meta_inode on meta (inode);
 
 	delete from meta;
 	`)
@@ -153,15 +165,17 @@ func (s *sqliteMetaStore) Get(name string) (Meta, bool) {
 		}, true
 	}
 
-	row := s.db.QueryRow(`select inode, hash, state, uid, gid, permissions, filetype, ctime, mtime, extended, devmajor, devminor from meta
+	row := s.db.QueryRow(`select inode, hash, state, uid, gid, permissions, filetype, ctime, mtime, extended, devmajor, devminor, layer, xattrs, `+NLINK_COLUMN+` from meta
 		where path = ?`, name)
 
 	state := MetaInitial
+	xattrs := ""
 	m := MetaData{}
-	if err := row.Scan(&m.Inode, &m.Hash, &state, &m.Uid, &m.Gid, &m.Permissions, &m.Filetype, &m.Ctime, &m.Mtime, &m.Extended, &m.DevMajor, &m.DevMinor); err != nil {
+	if err := row.Scan(&m.Inode, &m.Hash, &state, &m.Uid, &m.Gid, &m.Permissions, &m.Filetype, &m.Ctime, &m.Mtime, &m.Extended, &m.DevMajor, &m.DevMinor, &m.Layer, &xattrs, &m.Nlink); err != nil {
 		log.Errorf("sql error: %s", err)
 		return nil, false
 	}
+	m.Xattrs, _ = ParseXattrs(xattrs)
 
 	return &sqlMeta{
 		db:   s.db,
@@ -204,6 +218,8 @@ func (s *sqliteMetaStore) CreateFile(name string) (Meta, error) {
 		"",
 		0,
 		0,
+		0,
+		"",
 	)
 
 	return m, err
@@ -243,6 +259,8 @@ func (s *sqliteMetaStore) CreateDir(name string) (Meta, error) {
 		"",
 		0,
 		0,
+		0,
+		"",
 	)
 
 	return m, err
@@ -256,98 +274,273 @@ func (s *sqliteMetaStore) Delete(meta Meta) error {
 	return nil
 }
 
-func (s *sqliteMetaStore) Populate(plist string, trim string) error {
-	log.Debugf("Populating plist")
-	iter, err := utils.IterFlistFile(plist)
+// Rename moves the entry and all the rows under it in a single transaction
+func (s *sqliteMetaStore) Rename(oldName, newName string) error {
+	oldName, newName, same, err := renamePaths(oldName, newName)
 	if err != nil {
 		return err
 	}
 
+	if _, ok := s.Get(oldName); !ok {
+		return ErrNotFound
+	}
+
+	if same {
+		return nil
+	}
+
 	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
 
-	stmt, err := tx.Prepare(INSERT_STMT)
+	// the new path replaces an entry, and its subtree
+	if _, err := tx.Exec(`delete from meta where path = ? or substr(path, 1, length(?) + 1) = ? || '/'`,
+		newName, newName, newName); err != nil {
+		tx.Rollback()
+		return err
+	}
 
-	if err != nil {
+	if _, err := tx.Exec(`update meta set
+		path = ? || substr(path, length(?) + 1),
+		parent = case when path = ? then ? else ? || substr(parent, length(?) + 1) end
+		where path = ? or substr(path, 1, length(?) + 1) = ? || '/'`,
+		newName, oldName,
+		oldName, path.Dir(newName), newName, oldName,
+		oldName, oldName, oldName); err != nil {
+		tx.Rollback()
 		return err
 	}
 
-	parents := map[string]int{}
+	ux := time.Now().Unix()
+	for base := path.Dir(newName); base != "."; base = path.Dir(base) {
+		if _, err := tx.Exec(INSERT_PARENT_STMT, s.parentArgs(base, ux)...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
 
-	for line := range iter {
-		entity, err := ParseLine(line, trim)
-		if err != nil {
+	return tx.Commit()
+}
+
+func (s *sqliteMetaStore) Link(oldName, newName string) (Meta, error) {
+	m, ok := s.Get(oldName)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	data, err := m.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	if data.Filetype == syscall.S_IFDIR {
+		return nil, ErrIsDir
+	}
+
+	newName = strings.Trim(path.Clean(newName), "/")
+	if _, ok := s.Get(newName); ok {
+		return nil, ErrExists
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(LINK_STMT, path.Dir(newName), newName, m.String()); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	ux := time.Now().Unix()
+	for base := path.Dir(newName); base != "."; base = path.Dir(base) {
+		if _, err := tx.Exec(INSERT_PARENT_STMT, s.parentArgs(base, ux)...); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	link, ok := s.Get(newName)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return link, nil
+}
+
+// entryArgs returns the INSERT_STMT arguments of a flist entry
+func (s *sqliteMetaStore) entryArgs(entity *Entry, opts PopulateOptions) []interface{} {
+	// user and group id
+	uid, gid := opts.owner(entity)
+
+	name := strings.Trim(path.Clean(entity.Filepath), "/")
+
+	return []interface{}{
+		atomic.AddUint64(&s.ino, 1),
+		path.Dir(name),
+		name,
+		MetaInitial,
+		entity.Hash,
+		uid,
+		gid,
+		entity.Permissions,
+		entity.Filetype,
+		uint64(entity.Ctime.Unix()),
+		uint64(entity.Mtime.Unix()),
+		entity.Extended,
+		entity.DevMajor,
+		entity.DevMinor,
+		entity.Layer,
+		FormatXattrs(entity.Xattrs),
+	}
+}
+
+// parentArgs returns the INSERT_STMT arguments of an implicit parent directory
+func (s *sqliteMetaStore) parentArgs(parent string, ux int64) []interface{} {
+	return []interface{}{
+		atomic.AddUint64(&s.ino, 1),
+		path.Dir(parent),
+		parent,
+		MetaInitial,
+		"",
+		0,
+		0,
+		0755,
+		syscall.S_IFDIR,
+		ux,
+		ux,
+		"",
+		0,
+		0,
+		0,
+		"",
+	}
+}
+
+// putEntry adds a single flist entry, and its missing parent directories, to
+// the store
+func (s *sqliteMetaStore) putEntry(entity *Entry, opts PopulateOptions) error {
+	args := s.entryArgs(entity, opts)
+
+	ux := time.Now().Unix()
+	for base := args[1].(string); base != "."; base = path.Dir(base) {
+		if _, err := s.db.Exec(INSERT_PARENT_STMT, s.parentArgs(base, ux)...); err != nil {
 			return err
 		}
+	}
 
-		// user and group id
-		uid := 0
-		u, err := user.Lookup(entity.Uname)
-		if err == nil {
-			uid, _ = strconv.Atoi(u.Uid)
+	_, err := s.db.Exec(REPLACE_STMT, args...)
+	return err
+}
+
+// batchWriter executes a prepared statement in transactions of at most
+// sqliteBatchSize rows, so a large flist doesn't end up in a single huge
+// transaction.
+type batchWriter struct {
+	db    *sql.DB
+	query string
+	tx    *sql.Tx
+	stmt  *sql.Stmt
+	count int
+}
+
+const sqliteBatchSize = 10000
+
+func (w *batchWriter) exec(args ...interface{}) error {
+	if w.tx == nil {
+		tx, err := w.db.Begin()
+		if err != nil {
+			return err
 		}
 
-		gid := 0
-		g, err := user.LookupGroup(entity.Gname)
-		if err == nil {
-			gid, _ = strconv.Atoi(g.Gid)
+		stmt, err := tx.Prepare(w.query)
+		if err != nil {
+			tx.Rollback()
+			return err
 		}
 
-		name := strings.Trim(path.Clean(entity.Filepath), "/")
+		w.tx, w.stmt = tx, stmt
+	}
 
-		parent := path.Dir(name)
+	if _, err := w.stmt.Exec(args...); err != nil {
+		return err
+	}
+
+	if w.count++; w.count == sqliteBatchSize {
+		return w.commit()
+	}
 
-		base := parent
+	return nil
+}
+
+func (w *batchWriter) commit() error {
+	if w.tx == nil {
+		return nil
+	}
+
+	tx := w.tx
+	w.stmt.Close()
+	w.tx, w.stmt, w.count = nil, nil, 0
+	return tx.Commit()
+}
+
+func (w *batchWriter) rollback() {
+	if w.tx == nil {
+		return
+	}
+
+	w.stmt.Close()
+	w.tx.Rollback()
+	w.tx, w.stmt, w.count = nil, nil, 0
+}
+
+func (s *sqliteMetaStore) Populate(flists []string, opts PopulateOptions) error {
+	log.Debugf("Populating plist")
+
+	opts = opts.withDefaults()
+
+	entries := &batchWriter{db: s.db, query: REPLACE_STMT}
+	parents := map[string]int{}
+
+	err := walkLayers(flists, opts, func(entity *Entry) error {
+		args := s.entryArgs(entity, opts)
+
+		base := args[1].(string)
 		for base != "." {
 			parents[base] = 1
 			base = path.Dir(base)
 		}
 
-		stmt.Exec(
-			atomic.AddUint64(&s.ino, 1),
-			parent,
-			name,
-			MetaInitial,
-			entity.Hash,
-			uid,
-			gid,
-			entity.Permissions,
-			entity.Filetype,
-			uint64(entity.Ctime.Unix()),
-			uint64(entity.Mtime.Unix()),
-			entity.Extended,
-			entity.DevMajor,
-			entity.DevMinor,
-		)
+		return entries.exec(args...)
+	})
+
+	if err == nil {
+		err = entries.commit()
+	}
+
+	if err != nil {
+		entries.rollback()
+		return err
 	}
 
+	dirs := &batchWriter{db: s.db, query: INSERT_PARENT_STMT}
 	ux := time.Now().Unix()
 	for parent := range parents {
-		_, err := stmt.Exec(
-			atomic.AddUint64(&s.ino, 1),
-			path.Dir(parent),
-			parent,
-			MetaInitial,
-			"",
-			0,
-			0,
-			0755,
-			syscall.S_IFDIR,
-			ux,
-			ux,
-			"",
-			0,
-			0,
-		)
-
-		if err != nil {
+		if err := dirs.exec(s.parentArgs(parent, ux)...); err != nil {
+			dirs.rollback()
 			return err
 		}
 	}
 
-	tx.Commit()
+	if err := dirs.commit(); err != nil {
+		return err
+	}
+
 	log.Debugf("Populated: %d", s.ino)
 
 	return nil
@@ -0,0 +1,52 @@
+package meta
+
+import (
+	"time"
+)
+
+// The times of an entry are kept as seconds (Ctime, Mtime and Atime, like
+// the flist columns) plus nanoseconds.
+
+// ChangeTime returns the status change time
+func (m *MetaData) ChangeTime() time.Time {
+	return time.Unix(int64(m.Ctime), int64(m.CtimeNsec))
+}
+
+// ModTime returns the content modification time
+func (m *MetaData) ModTime() time.Time {
+	return time.Unix(int64(m.Mtime), int64(m.MtimeNsec))
+}
+
+// AccessTime returns the access time, entries coming from a flist have none
+// and use their modification time
+func (m *MetaData) AccessTime() time.Time {
+	if m.Atime == 0 && m.AtimeNsec == 0 {
+		return m.ModTime()
+	}
+	return time.Unix(int64(m.Atime), int64(m.AtimeNsec))
+}
+
+func (m *MetaData) SetChangeTime(t time.Time) {
+	m.Ctime, m.CtimeNsec = uint64(t.Unix()), uint32(t.Nanosecond())
+}
+
+func (m *MetaData) SetModTime(t time.Time) {
+	m.Mtime, m.MtimeNsec = uint64(t.Unix()), uint32(t.Nanosecond())
+}
+
+func (m *MetaData) SetAccessTime(t time.Time) {
+	m.Atime, m.AtimeNsec = uint64(t.Unix()), uint32(t.Nanosecond())
+}
+
+// SetTimes sets all the times to t, for a new entry
+func (m *MetaData) SetTimes(t time.Time) {
+	m.SetChangeTime(t)
+	m.SetModTime(t)
+	m.SetAccessTime(t)
+}
+
+// Touch records a change of the content at t
+func (m *MetaData) Touch(t time.Time) {
+	m.SetModTime(t)
+	m.SetChangeTime(t)
+}
@@ -0,0 +1,59 @@
+package meta
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetaDataTimes(t *testing.T) {
+	md := &MetaData{Ctime: 1470000000, Mtime: 1460000000}
+
+	// flist entries have no access time
+	assert.Equal(t, time.Unix(1460000000, 0), md.AccessTime())
+
+	now := time.Unix(1480000000, 123456789)
+	md.SetTimes(now)
+	assert.Equal(t, now, md.ChangeTime())
+	assert.Equal(t, now, md.ModTime())
+	assert.Equal(t, now, md.AccessTime())
+
+	later := now.Add(time.Second)
+	md.Touch(later)
+	assert.Equal(t, later, md.ModTime())
+	assert.Equal(t, later, md.ChangeTime())
+	assert.Equal(t, now, md.AccessTime())
+}
+
+func TestFileMetaStoreTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileMetaStore(dir)
+	m, err := store.CreateFile("file")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	md := &MetaData{Size: 1}
+	md.SetModTime(time.Unix(1470000000, 1))
+	md.SetAccessTime(time.Unix(1470000001, 2))
+	md.SetChangeTime(time.Unix(1470000002, 3))
+	if !assert.NoError(t, m.Save(md)) {
+		return
+	}
+
+	loaded, err := m.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, time.Unix(1470000000, 1), loaded.ModTime())
+	assert.Equal(t, time.Unix(1470000001, 2), loaded.AccessTime())
+	assert.Equal(t, time.Unix(1470000002, 3), loaded.ChangeTime())
+}
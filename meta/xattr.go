@@ -0,0 +1,95 @@
+package meta
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Extended attributes are kept in the meta data as name -> base64 encoded
+// value, so binary values (like security.capability) survive the text based
+// meta stores. In a flist they are carried in the extended column of the
+// entries that don't use it otherwise, as a comma separated list of
+// name=base64 pairs.
+
+// ParseXattrs parses the name=base64 list of a flist extended column
+func ParseXattrs(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	xattrs := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid extended attribute '%s', expected name=base64", pair)
+		}
+
+		name, value := pair[:i], pair[i+1:]
+		if _, err := base64.StdEncoding.DecodeString(value); err != nil {
+			return nil, fmt.Errorf("invalid value of extended attribute '%s': %s", name, err)
+		}
+
+		if _, ok := xattrs[name]; ok {
+			return nil, fmt.Errorf("duplicate extended attribute '%s'", name)
+		}
+		xattrs[name] = value
+	}
+
+	return xattrs, nil
+}
+
+// FormatXattrs returns the flist extended column of the xattrs
+func FormatXattrs(xattrs map[string]string) string {
+	pairs := make([]string, 0, len(xattrs))
+	for name, value := range xattrs {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Xattr returns the value of the extended attribute name
+func (m *MetaData) Xattr(name string) ([]byte, bool) {
+	value, ok := m.Xattrs[name]
+	if !ok {
+		return nil, false
+	}
+
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		log.Errorf("corrupted extended attribute '%s': %s", name, err)
+		return nil, false
+	}
+
+	return data, true
+}
+
+// SetXattr sets the value of the extended attribute name
+func (m *MetaData) SetXattr(name string, value []byte) {
+	if m.Xattrs == nil {
+		m.Xattrs = make(map[string]string)
+	}
+	m.Xattrs[name] = base64.StdEncoding.EncodeToString(value)
+}
+
+// RemoveXattr removes the extended attribute name, it returns false if it
+// doesn't exist
+func (m *MetaData) RemoveXattr(name string) bool {
+	if _, ok := m.Xattrs[name]; !ok {
+		return false
+	}
+	delete(m.Xattrs, name)
+	return true
+}
+
+// XattrNames returns the sorted names of the extended attributes
+func (m *MetaData) XattrNames() []string {
+	names := make([]string, 0, len(m.Xattrs))
+	for name := range m.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,169 @@
+package meta
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseXattrs(t *testing.T) {
+	xattrs, err := ParseXattrs("user.a=aGVsbG8=,security.capability=AQAAAgAgAAAAAAAAAAAAAAAAAAA=")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "aGVsbG8=", xattrs["user.a"])
+	assert.Equal(t, "security.capability=AQAAAgAgAAAAAAAAAAAAAAAAAAA=,user.a=aGVsbG8=", FormatXattrs(xattrs))
+
+	for _, bad := range []string{"user.a", "=aGVsbG8=", "user.a=!!", "user.a=aGVsbG8=,user.a=aGVsbG8="} {
+		_, err := ParseXattrs(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParseLineXattrs(t *testing.T) {
+	entry, err := ParseLine("/bin/ping|aa|10|root|root|755|2|0|0|security.capability=AQAAAgAgAAAAAAAAAAAAAAAAAAA=", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, entry.Xattrs, 1)
+	assert.False(t, entry.freeFormExtended())
+
+	// the extended column of symlinks is their target
+	entry, err = ParseLine("/bin/sh||0|root|root|777|1|0|0|bash", "")
+	if assert.NoError(t, err) {
+		assert.Nil(t, entry.Xattrs)
+		assert.False(t, entry.freeFormExtended())
+	}
+
+	// free form extended data is kept, but is no extended attribute
+	entry, err = ParseLine("/bin/ping|aa|10|root|root|755|2|0|0|garbage", "")
+	if assert.NoError(t, err) {
+		assert.Nil(t, entry.Xattrs)
+		assert.Equal(t, "garbage", entry.Extended)
+		assert.True(t, entry.freeFormExtended())
+	}
+}
+
+func TestMetaDataXattrs(t *testing.T) {
+	md := &MetaData{}
+	_, ok := md.Xattr("user.a")
+	assert.False(t, ok)
+
+	md.SetXattr("user.b", []byte{0, 1, 2})
+	md.SetXattr("user.a", []byte("x"))
+
+	value, ok := md.Xattr("user.b")
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0, 1, 2}, value)
+	assert.Equal(t, []string{"user.a", "user.b"}, md.XattrNames())
+
+	assert.True(t, md.RemoveXattr("user.a"))
+	assert.False(t, md.RemoveXattr("user.a"))
+	assert.Equal(t, []string{"user.b"}, md.XattrNames())
+}
+
+func TestFileMetaStoreXattrs(t *testing.T) {
+	name := writeFlist(t,
+		"/bin||0|root|root|755|4|0|0|",
+		"/bin/ping|aa|10|root|root|755|2|0|0|security.capability=AQAAAgAgAAAAAAAAAAAAAAAAAAA=",
+	)
+	defer os.Remove(name)
+
+	dir, err := ioutil.TempDir("", "meta")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileMetaStore(dir)
+	if !assert.NoError(t, store.Populate([]string{name}, PopulateOptions{Owners: NewNumericIDMapper()})) {
+		return
+	}
+
+	m, ok := store.Get("/bin/ping")
+	if !assert.True(t, ok) {
+		return
+	}
+
+	md, err := m.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	md.SetXattr("user.binary", []byte{0xff, 0, 0xfe})
+	assert.NoError(t, m.Save(md))
+
+	md, err = m.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, []string{"security.capability", "user.binary"}, md.XattrNames())
+	value, _ := md.Xattr("user.binary")
+	assert.Equal(t, []byte{0xff, 0, 0xfe}, value)
+}
+
+func TestFileMetaStoreDirs(t *testing.T) {
+	name := writeFlist(t,
+		"/srv||0|1000|1001|750|4|1470000000|1470000001|user.a=eA==",
+		"/srv/file|aa|10|1000|1001|644|2|0|0|",
+	)
+	defer os.Remove(name)
+
+	dir, err := ioutil.TempDir("", "meta")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileMetaStore(dir)
+	if !assert.NoError(t, store.Populate([]string{name}, PopulateOptions{Owners: NewNumericIDMapper()})) {
+		return
+	}
+
+	m, ok := store.Get("/srv")
+	if !assert.True(t, ok) {
+		return
+	}
+	md, err := m.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint32(syscall.S_IFDIR), md.Filetype)
+	assert.Equal(t, uint32(1000), md.Uid)
+	assert.Equal(t, uint32(1001), md.Gid)
+	assert.Equal(t, uint32(0750), md.Permissions)
+	assert.Equal(t, uint64(1470000001), md.Mtime)
+	assert.Equal(t, []string{"user.a"}, md.XattrNames())
+
+	md.Permissions = 0700
+	md.SetXattr("user.b", []byte("y"))
+	if !assert.NoError(t, m.Save(md)) {
+		return
+	}
+	m, _ = store.Get("/srv")
+	md, err = m.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint32(0700), md.Permissions)
+	assert.Equal(t, []string{"user.a", "user.b"}, md.XattrNames())
+
+	// the meta file of the directory is not one of its children
+	var children []string
+	for child := range m.Children() {
+		children = append(children, child.Name())
+	}
+	assert.Equal(t, []string{"file"}, children)
+
+	assert.Error(t, store.Delete(m))
+	file, _ := store.Get("/srv/file")
+	assert.NoError(t, store.Delete(file))
+	assert.NoError(t, store.Delete(m))
+	_, ok = store.Get("/srv")
+	assert.False(t, ok)
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/g8os/fs/blobs"
 	"github.com/g8os/fs/config"
 	"github.com/g8os/fs/files"
 	"github.com/g8os/fs/meta"
 	"github.com/g8os/fs/storage"
 	"github.com/g8os/fs/watcher"
 	"github.com/robfig/cron"
+	"net/url"
 	"os"
 	//"path"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -51,63 +56,348 @@ func mountFS(
 	backendCfg *config.Backend,
 	stor storage.Storage,
 	meta meta.MetaStore,
-	readOnly bool) error {
+	options files.Options,
+	populated func() error) error {
 
-	fs, err := files.NewFS(mountCfg.Path, backendCfg, stor, meta, readOnly)
+	fs, err := files.NewFS(mountCfg.Path, backendCfg, stor, meta, options)
 	if err != nil {
 		return err
 	}
+	registerMount(mountCfg, fs)
+
+	if mountCfg.Record > 0 {
+		if err := recordProfile(fs, mountCfg, time.Duration(mountCfg.Record)*time.Second, mountCfg.RecordRanges); err != nil {
+			log.Errorf("Can't record the accesses to '%s': %s", mountCfg.Path, err)
+		}
+	}
+
+	// the profile is replayed and the pinned files are prefetched once the
+	// meta is complete
+	go func() {
+		if populated != nil {
+			if err := populated(); err != nil {
+				log.Errorf("Failed to populate '%s': %s", mountCfg.Path, err)
+				if mountCfg.FailOnPopulateError() {
+					log.Errorf("Unmounting '%s'", mountCfg.Path)
+					if err := fs.Unmount(); err != nil {
+						log.Errorf("Failed to unmount '%s': %s", mountCfg.Path, err)
+					}
+					return
+				}
+			}
+		}
+		replayProfile(fs, mountCfg)
+		fs.Prefetch()
+	}()
+
 	log.Info("Serving File system")
 	fs.Serve()
 
 	return nil
 }
 
-func MountOLFS(wg *sync.WaitGroup, scheduler *cron.Cron, mount config.Mount, backend *config.Backend, stor storage.Storage, opts Options) {
-	//ms := meta.NewFileMetaStore(backend.Path)
-	metaBackend := fmt.Sprintf("%s+meta", backend.Path)
-	os.MkdirAll(metaBackend, 0755)
-	ms := meta.NewFileMetaStore(metaBackend)
+// recordProfile records the files opened in fs during d, then writes them as
+// the prefetch profile of the mount
+func recordProfile(fs *files.FS, mount config.Mount, d time.Duration, ranges bool) error {
+	name := mount.ProfilePath()
+	if name == "" {
+		return fmt.Errorf("the mount has no flist")
+	}
 
-	if err := ms.Populate(mount.Flist, mount.Trim); err != nil {
-		log.Errorf("Failed to mount overllay fs '%s': %s", mount, err)
+	if err := fs.StartRecording(ranges); err != nil {
+		return err
+	}
+
+	time.AfterFunc(d, func() {
+		profile, err := fs.StopRecording()
+		if err != nil {
+			log.Errorf("Failed to record the accesses to '%s': %s", mount.Path, err)
+			return
+		}
+
+		if err := files.WriteProfileFile(name, profile); err != nil {
+			log.Errorf("Failed to write the prefetch profile of '%s': %s", mount.Path, err)
+			return
+		}
+		log.Infof("Wrote the prefetch profile of '%s' to %s", mount.Path, name)
+	})
+
+	return nil
+}
+
+// replayProfile prefetches the files of the prefetch profile of the mount, if
+// it has one
+func replayProfile(fs *files.FS, mount config.Mount) {
+	name := mount.ProfilePath()
+	if name == "" {
+		return
+	}
+
+	profile, err := files.ReadProfileFile(name)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Errorf("Can't read the prefetch profile of '%s': %s", mount.Path, err)
+		return
+	}
+
+	fs.Replay(profile, mount.ReplayWorkers)
+}
+
+func populateOptions(mount config.Mount) meta.PopulateOptions {
+	return meta.PopulateOptions{
+		Trim:    mount.Trim,
+		Lenient: mount.Lenient,
+		Include: mount.Include,
+		Exclude: mount.Exclude,
+		Rewrite: mount.Rewrite,
+		Workers: mount.PopulateWorkers,
+	}
+}
+
+// fetchEntries downloads the content of flist entries
+func fetchEntries(backend *config.Backend, stor storage.Storage, entries []*meta.Entry) ([][]byte, error) {
+	contents := make([][]byte, len(entries))
+	for i, entry := range entries {
+		var buf bytes.Buffer
+		if err := files.Fetch(stor, backend, entry.MetaData(0, 0), &buf); err != nil {
+			return nil, fmt.Errorf("can't download '%s': %s", entry.Filepath, err)
+		}
+		contents[i] = buf.Bytes()
+	}
+
+	return contents, nil
+}
+
+// setOwners sets the owner mapping of the mount ownership policy in opts. The
+// flist policy reads the passwd and group files of the flists during the
+// populate, whatever the filters of the mount.
+func setOwners(opts *meta.PopulateOptions, mount config.Mount, backend *config.Backend, stor storage.Storage) error {
+	switch strings.ToLower(mount.Owners) {
+	case "", config.OwnersHost:
+		opts.Owners = meta.NewHostIDMapper()
+	case config.OwnersNumeric:
+		opts.Owners = meta.NewNumericIDMapper()
+	case config.OwnersMap:
+		opts.Owners = meta.NewTableIDMapper(mount.UidMap, mount.GidMap)
+	case config.OwnersSquash:
+		opts.Owners = meta.NewSquashIDMapper(mount.SquashUid, mount.SquashGid)
+	case config.OwnersFlist:
+		passwdFile, groupFile := mount.Passwd, mount.Group
+		if passwdFile == "" {
+			passwdFile = "/etc/passwd"
+		}
+		if groupFile == "" {
+			groupFile = "/etc/group"
+		}
+
+		opts.FlistOwners = &meta.FlistOwners{
+			Names: []string{passwdFile, groupFile},
+			Build: func(entries []*meta.Entry) (meta.IDMapper, error) {
+				contents, err := fetchEntries(backend, stor, entries)
+				if err != nil {
+					return nil, err
+				}
+				return meta.NewPasswdIDMapper(bytes.NewReader(contents[0]), bytes.NewReader(contents[1]))
+			},
+		}
+	default:
+		return fmt.Errorf("unknown owners policy '%s'", mount.Owners)
+	}
+	return nil
+}
+
+// populate fills the meta store with the mount flists
+func populate(ms meta.MetaStore, mount config.Mount, backend *config.Backend, stor storage.Storage) error {
+	opts := populateOptions(mount)
+	if err := setOwners(&opts, mount, backend, stor); err != nil {
+		return err
+	}
+
+	return ms.Populate(mount.FlistLayers(), opts)
+}
+
+// startPopulate populates the meta store of the mount. A lazy mount returns at
+// once with a store that can be served right away, and a function waiting for
+// the result of the background populate.
+func startPopulate(ms meta.MetaStore, mount config.Mount, backend *config.Backend, stor storage.Storage) (meta.MetaStore, func() error, error) {
+	if !mount.Lazy {
+		return ms, nil, populate(ms, mount, backend, stor)
+	}
+
+	lazy, err := meta.NewLazyMetaStore(ms)
+	if err != nil {
+		return ms, nil, err
+	}
+
+	if err := populate(lazy, mount, backend, stor); err != nil {
+		return lazy, nil, err
+	}
+
+	return lazy, lazy.Wait, nil
+}
+
+// mountPins returns the pins of a mount, from its pin globs and pin file
+func mountPins(mount config.Mount) (*watcher.Pins, error) {
+	patterns := mount.Pin
+	if mount.PinFile != "" {
+		list, err := watcher.ReadPinFile(mount.PinFile)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(append([]string{}, patterns...), list...)
+	}
+
+	return watcher.NewPins(patterns)
+}
+
+// startCleaner starts the cache manager of a mount, continuously or on the
+// cleanup cron of the backend. It returns the filesystem options sharing the
+// usage, the pins, the blob cache and the offline mode of the mount with the
+// cache manager.
+func startCleaner(scheduler *cron.Cron, ms meta.MetaStore, mount config.Mount, backend *config.Backend, stor storage.Storage, blobs *blobs.Cache) (files.Options, error) {
+	pins, err := mountPins(mount)
+	if err != nil {
+		return files.Options{}, err
+	}
+
+	usage := watcher.NewUsage()
+	offline := watcher.NewOffline(stor, mount.Offline)
+	cleaner, err := watcher.NewCleaner(ms, backend, usage, pins, blobs, offline)
+	if err != nil {
+		return files.Options{}, err
+	}
+
+	options := files.Options{
+		Usage:   usage,
+		Pins:    pins,
+		Blobs:   blobs,
+		Offline: offline,
+	}
+
+	if backend.CacheCheckInterval > 0 {
+		go cleaner.Loop(time.Duration(backend.CacheCheckInterval) * time.Second)
+		return options, nil
 	}
 
-	//2- Start the cleaner worker, but never the watcher since we don't push ever to stor in OL mode
-	job := watcher.NewCleaner(ms, backend)
 	cron := backend.CleanupCron
 	if cron == "" {
 		cron = "@every 1d"
 	}
-	scheduler.AddJob(cron, job)
+	scheduler.AddJob(cron, cleaner)
+	return options, nil
+}
+
+func MountOLFS(wg *sync.WaitGroup, scheduler *cron.Cron, mount config.Mount, backend *config.Backend, stor storage.Storage, blobs *blobs.Cache, opts Options) {
+	//ms := meta.NewFileMetaStore(backend.Path)
+	metaBackend := fmt.Sprintf("%s+meta", backend.Path)
+	os.MkdirAll(metaBackend, 0755)
+	ms, populated, err := startPopulate(meta.NewFileMetaStore(metaBackend), mount, backend, stor)
+	if err != nil {
+		log.Errorf("Failed to populate '%s': %s", mount.Path, err)
+		if mount.FailOnPopulateError() {
+			log.Errorf("Not mounting '%s'", mount.Path)
+			wg.Done()
+			return
+		}
+	}
+
+	//2- Start the cleaner worker, but never the watcher since we don't push ever to stor in OL mode
+	fsOptions, err := startCleaner(scheduler, ms, mount, backend, stor, blobs)
+	if err != nil {
+		log.Errorf("Invalid cache configuration of '%s': %s", mount.Path, err)
+		wg.Done()
+		return
+	}
 
 	//TODO: 3- start RWFS with overlay compatibility.
-	if err := mountFS(mount, backend, stor, ms, false); err != nil {
+	if err := mountFS(mount, backend, stor, ms, fsOptions, populated); err != nil {
 		log.Fatal(err)
 	}
 	wg.Done()
 }
 
-func MountROFS(wg *sync.WaitGroup, scheduler *cron.Cron, mount config.Mount, backend *config.Backend, stor storage.Storage, opts Options) {
+func MountROFS(wg *sync.WaitGroup, scheduler *cron.Cron, mount config.Mount, backend *config.Backend, stor storage.Storage, blobs *blobs.Cache, opts Options) {
 	//ms := meta.NewFileMetaStore(backend.Path)
 	metaBackend := fmt.Sprintf("%s.meta", backend.Path)
 	os.MkdirAll(metaBackend, 0755)
-	ms := meta.NewFileMetaStore(metaBackend)
-
-	if err := ms.Populate(mount.Flist, mount.Trim); err != nil {
-		log.Errorf("Failed to mount overllay fs '%s': %s", mount, err)
+	ms, populated, err := startPopulate(meta.NewFileMetaStore(metaBackend), mount, backend, stor)
+	if err != nil {
+		log.Errorf("Failed to populate '%s': %s", mount.Path, err)
+		if mount.FailOnPopulateError() {
+			log.Errorf("Not mounting '%s'", mount.Path)
+			wg.Done()
+			return
+		}
 	}
 
 	//2- Start the cleaner worker, but never the watcher since we don't push ever to stor in OL mode
-	job := watcher.NewCleaner(ms, backend)
-	cron := backend.CleanupCron
-	if cron == "" {
-		cron = "@every 1d"
+	fsOptions, err := startCleaner(scheduler, ms, mount, backend, stor, blobs)
+	if err != nil {
+		log.Errorf("Invalid cache configuration of '%s': %s", mount.Path, err)
+		wg.Done()
+		return
 	}
-	scheduler.AddJob(cron, job)
 
-	if err := mountFS(mount, backend, stor, ms, true); err != nil {
+	fsOptions.ReadOnly = true
+	if err := mountFS(mount, backend, stor, ms, fsOptions, populated); err != nil {
 		log.Fatal(err)
 	}
 	wg.Done()
 }
+
+// startBlobCache opens the blob cache of the config and schedules its
+// cleanup, it returns nil if the config has none
+func startBlobCache(scheduler *cron.Cron, cfg *config.Config) (*blobs.Cache, error) {
+	if cfg.BlobCache == "" {
+		return nil, nil
+	}
+
+	cache, err := blobs.NewCache(cfg.BlobCache)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := cfg.BlobCacheCron
+	if schedule == "" {
+		schedule = "@every 1h"
+	}
+	keep := int64(cfg.BlobCacheKeep) * 1024 * 1024
+	clean := cache.Cleaner(keep)
+	job := func() {
+		// the blobs may be all an offline mount can get
+		if anyOffline() {
+			log.Debugf("A mount is offline, keeping the blob cache")
+			return
+		}
+		clean()
+	}
+	if err := scheduler.AddJob(schedule, cron.FuncJob(job)); err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+}
+
+// blobServer returns the server of the blob cache to the peer nodes, with the
+// serve_blobs_auth auth. It's required when a store has an auth, or anyone
+// could get its blobs from the cache.
+func blobServer(cfg *config.Config, cache *blobs.Cache) (*blobs.Server, error) {
+	server := &blobs.Server{Cache: cache}
+	if cfg.ServeBlobsAuth != "" {
+		var err error
+		if server.User, server.Password, err = splitAuth(cfg.ServeBlobsAuth); err != nil {
+			return nil, fmt.Errorf("invalid serve_blobs_auth: %s", err)
+		}
+		return server, nil
+	}
+
+	for name, stor := range cfg.Stor {
+		u, err := url.Parse(stor.URL)
+		if err == nil && u.User != nil {
+			return nil, fmt.Errorf("the store %s has an auth, its blobs are served only with serve_blobs_auth", name)
+		}
+	}
+	log.Warningf("The blob cache is served to anyone reaching %s", cfg.ServeBlobs)
+	return server, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/g8os/fs/codec"
+	"github.com/g8os/fs/config"
+	"github.com/g8os/fs/storage"
+)
+
+func storUsage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s stor:\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s stor serve [-addr ADDR] [-auth USER:PASSWORD] [-private] [-no-verify] DIR\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s stor put [-codec CODEC] URL FILE...\n", progName)
+}
+
+// storCommand runs the `stor` sub commands and returns the process exit code
+func storCommand(args []string) int {
+	if len(args) == 0 {
+		storUsage()
+		return 2
+	}
+
+	switch args[0] {
+	case "serve":
+		return storServe(args[1:])
+	case "put":
+		return storPut(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown stor command '%s'\n", args[0])
+		storUsage()
+		return 2
+	}
+}
+
+func storServe(args []string) int {
+	flags := flag.NewFlagSet("stor serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	auth := flags.String("auth", "", "USER:PASSWORD required to upload")
+	private := flags.Bool("private", false, "require the auth to download too")
+	noVerify := flags.Bool("no-verify", false, "accept the uploads whose content doesn't match their hash")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		storUsage()
+		return 2
+	}
+
+	server := &storage.Server{
+		Dir:      flags.Arg(0),
+		Private:  *private,
+		NoVerify: *noVerify,
+	}
+	if *auth != "" {
+		var err error
+		if server.User, server.Password, err = splitAuth(*auth); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 2
+		}
+	}
+	if server.Private && server.User == "" {
+		fmt.Fprintf(os.Stderr, "a private stor requires -auth\n")
+		return 2
+	}
+
+	if err := os.MkdirAll(server.Dir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "can't create %s: %s\n", server.Dir, err)
+		return 1
+	}
+
+	log.Infof("Serving the blobs of %s on %s", server.Dir, *addr)
+	if err := http.ListenAndServe(*addr, server); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func storPut(args []string) int {
+	flags := flag.NewFlagSet("stor put", flag.ExitOnError)
+	codecName := flags.String("codec", "zstd", "codec of the uploaded blobs: brotli, zstd, gzip or none")
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		storUsage()
+		return 2
+	}
+
+	blobCodec, err := codec.Get(*codecName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	cfg := config.StorConfig{URL: flags.Arg(0)}
+	stor, err := cfg.GetStorClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid stor %s: %s\n", cfg.URL, err)
+		return 2
+	}
+	uploader, ok := stor.(storage.Uploader)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "can't upload to %s\n", cfg.URL)
+		return 2
+	}
+
+	status := 0
+	for _, name := range flags.Args()[1:] {
+		hash, err := putFile(uploader, blobCodec, name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't upload %s: %s\n", name, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s  %s\n", hash, name)
+	}
+	return status
+}
+
+// putFile uploads the file name encoded with c, and returns its hash
+func putFile(uploader storage.Uploader, c codec.Codec, name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	sum := md5.New()
+	if _, err := io.Copy(sum, file); err != nil {
+		return "", err
+	}
+	hash := fmt.Sprintf("%x", sum.Sum(nil))
+
+	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+		return "", err
+	}
+
+	blob := codec.Encode(c, file)
+	defer blob.Close()
+	return hash, uploader.Put(hash, blob)
+}
@@ -7,26 +7,49 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+
+	"github.com/g8os/fs/codec"
 )
 
 type aydoStor struct {
 	baseURL string
-	client  *http.Client
+	// user is the basic auth of the store, given in its URL
+	user   *url.Userinfo
+	client *http.Client
 }
 
 func NewAydoStorage(u *url.URL) (Storage, error) {
+	base := *u
+	base.User = nil
 	return &aydoStor{
 		client:  &http.Client{},
-		baseURL: strings.TrimRight(u.String(), "/"),
+		user:    u.User,
+		baseURL: strings.TrimRight(base.String(), "/"),
 	}, nil
 }
 
+func (s *aydoStor) newRequest(method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.user != nil {
+		password, _ := s.user.Password()
+		req.SetBasicAuth(s.user.Username(), password)
+	}
+	return req, nil
+}
+
 func (s *aydoStor) Get(hash string) (io.ReadCloser, error) {
 	u := fmt.Sprintf("%s/%s", s.baseURL, hash)
 	log.Infof("Downloading: %s", u)
 
-	req, _ := http.NewRequest("GET", u, nil)
-	req.Header.Set("Accept", "application/brotli")
+	req, err := s.newRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
 
 	response, err := s.client.Do(req)
 	if err != nil {
@@ -36,8 +59,37 @@ func (s *aydoStor) Get(hash string) (io.ReadCloser, error) {
 	if response.StatusCode != http.StatusOK {
 		defer response.Body.Close()
 		body, _ := ioutil.ReadAll(response.Body)
-		return nil, fmt.Errorf("invalid response from stor (%d): %s", response.StatusCode, body)
+		return nil, &StatusError{Code: response.StatusCode, Body: string(body)}
+	}
+
+	return &typedBody{ReadCloser: response.Body, contentType: response.Header.Get("Content-Type")}, nil
+}
+
+// Put uploads an encoded blob, brotli unless it tells its content type
+func (s *aydoStor) Put(hash string, blob io.Reader) error {
+	u := fmt.Sprintf("%s/%s", s.baseURL, hash)
+	log.Infof("Uploading: %s", u)
+
+	req, err := s.newRequest("PUT", u, blob)
+	if err != nil {
+		return err
+	}
+	contentType := ContentType(blob)
+	if contentType == "" {
+		contentType = codec.Brotli.ContentType()
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	response, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(response.Body)
+		return &StatusError{Code: response.StatusCode, Body: string(body)}
 	}
 
-	return response.Body, nil
+	return nil
 }
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"io"
+	"strings"
+
+	"github.com/g8os/fs/codec"
+)
+
+// typed is a blob that knows its content type
+type typed interface {
+	ContentType() string
+}
+
+// encoded is a blob whose codec may be known, Codec returns nil if it's not
+type encoded interface {
+	Codec() codec.Codec
+}
+
+// ContentType returns the content type of a blob, empty if it's unknown
+func ContentType(blob io.Reader) string {
+	if t, ok := blob.(typed); ok {
+		return t.ContentType()
+	}
+	return ""
+}
+
+// NewReader decodes a blob got from a store, with the codec of its store if
+// it's configured, or else the one it tells, see codec.Detect
+func NewReader(blob io.Reader) (io.ReadCloser, error) {
+	if e, ok := blob.(encoded); ok {
+		if c := e.Codec(); c != nil {
+			return c.NewReader(blob)
+		}
+	}
+	return codec.NewReader(blob, ContentType(blob))
+}
+
+// accept is the Accept header of the requests of blobs
+var accept = strings.Join([]string{
+	codec.Brotli.ContentType(),
+	codec.Zstd.ContentType(),
+	codec.Gzip.ContentType(),
+}, ", ")
+
+type typedBody struct {
+	io.ReadCloser
+	contentType string
+}
+
+func (b *typedBody) ContentType() string {
+	return b.contentType
+}
+
+// WithCodec returns a Storage whose blobs are all encoded with c
+func WithCodec(stor Storage, c codec.Codec) Storage {
+	return &codecStorage{Storage: stor, codec: c}
+}
+
+type codecStorage struct {
+	Storage
+	codec codec.Codec
+}
+
+func (s *codecStorage) Get(key string) (io.ReadCloser, error) {
+	body, err := s.Storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return &codecBody{ReadCloser: body, codec: s.codec}, nil
+}
+
+type codecBody struct {
+	io.ReadCloser
+	codec codec.Codec
+}
+
+func (b *codecBody) Codec() codec.Codec {
+	return b.codec
+}
+
+func (b *codecBody) ContentType() string {
+	return b.codec.ContentType()
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// unhealthyAfter is the number of failed downloads in a row after which
+	// a store is unhealthy
+	unhealthyAfter = 3
+	// retryAfter is how long an unhealthy store isn't tried, after that the
+	// next download tells if it's back
+	retryAfter = 30 * time.Second
+)
+
+// Checker is a Storage that knows if it can be reached
+type Checker interface {
+	Healthy() bool
+}
+
+// Healthy returns false if stor is known to be unreachable
+func Healthy(stor Storage) bool {
+	if c, ok := stor.(Checker); ok {
+		return c.Healthy()
+	}
+	return true
+}
+
+// StatusError is an error response of a store
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("invalid response from stor (%d): %s", e.Code, e.Body)
+}
+
+// unhealthy returns true if err tells the store can't serve at all, a
+// missing key doesn't
+func unhealthy(err error) bool {
+	if e, ok := err.(*StatusError); ok {
+		return e.Code >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// health follows the downloads from a store
+type health struct {
+	lock     sync.Mutex
+	failures int
+	failed   time.Time
+}
+
+func (h *health) healthy() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.failures < unhealthyAfter || time.Since(h.failed) > retryAfter
+}
+
+// done records the result of a download
+func (h *health) done(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err == nil {
+		if h.failures >= unhealthyAfter {
+			log.Infof("Store is back")
+		}
+		h.failures = 0
+		return
+	}
+
+	if !unhealthy(err) {
+		return
+	}
+
+	h.failures++
+	h.failed = time.Now()
+	if h.failures == unhealthyAfter {
+		log.Warningf("Store is unhealthy after %d failed downloads: %s", h.failures, err)
+	}
+}
@@ -73,7 +73,8 @@ loop:
 	}
 
 	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("response error: %s", response.Status)
+		response.Body.Close()
+		return nil, &StatusError{Code: response.StatusCode, Body: response.Status}
 	}
 
 	return response.Body, nil
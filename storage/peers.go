@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"io"
+	"os"
+
+	"github.com/g8os/fs/utils"
+)
+
+// peerStorage gets the blobs from the peer nodes first, and from the central
+// store when no peer has them. A blob from a peer is used only once checked
+// against its hash, the md5 of its content.
+type peerStorage struct {
+	peers []*peer
+	stor  Storage
+	// spool is the directory of the blobs spooled while they're checked
+	spool string
+}
+
+// Peer is the store of a peer node
+type Peer struct {
+	Name string
+	Stor Storage
+}
+
+type peer struct {
+	Peer
+	health health
+}
+
+// NewPeerStorage returns a Storage getting from the peers, in order, before
+// stor. The blobs of the peers are spooled to check them, past
+// utils.DefaultSpoolSize in a temporary file of spool, the temporary
+// directory when it's empty.
+func NewPeerStorage(stor Storage, peers []Peer, spool string) Storage {
+	s := &peerStorage{stor: stor, spool: spool}
+	for _, p := range peers {
+		s.peers = append(s.peers, &peer{Peer: p})
+	}
+	return s
+}
+
+func (s *peerStorage) Get(key string) (io.ReadCloser, error) {
+	for _, p := range s.peers {
+		// a peer that's down isn't tried for a while
+		if !p.health.healthy() {
+			continue
+		}
+
+		body, err := p.Stor.Get(key)
+		p.health.done(err)
+		if err != nil {
+			log.Debugf("Peer %s can't serve %s: %s", p.Name, key, err)
+			continue
+		}
+
+		verified, err := verify(key, body, s.spool)
+		if err != nil {
+			log.Warningf("Ignoring blob %s from peer %s: %s", key, p.Name, err)
+			continue
+		}
+
+		log.Debugf("Got %s from peer %s", key, p.Name)
+		return verified, nil
+	}
+
+	return s.stor.Get(key)
+}
+
+// verify spools an encoded blob to dir, and returns it if its content
+// matches hash
+func verify(hash string, body io.ReadCloser, dir string) (io.ReadCloser, error) {
+	contentType := ContentType(body)
+	blob := utils.NewReadSeeker(body, dir)
+
+	c, err := blobCodec(blob, contentType)
+	if err == nil {
+		err = verifyBlob(hash, blob, c)
+	}
+	if err == nil {
+		_, err = blob.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return &typedBody{ReadCloser: blob, contentType: contentType}, nil
+}
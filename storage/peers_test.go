@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dsnet/compress/brotli"
+	"github.com/g8os/fs/blobs"
+	"github.com/g8os/fs/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// peerCache serves the blobs of a blob cache, by hash
+func peerCache(t *testing.T, content map[string]string) (*httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := blobs.NewCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hash, data := range content {
+		if hash != hashOf(data) {
+			// a blob corrupted on the disk of the peer
+			name := cache.Path(hash)
+			os.MkdirAll(filepath.Dir(name), 0755)
+			if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		_, err := cache.Get(hash, func(w io.Writer) error {
+			_, err := io.WriteString(w, data)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(&blobs.Server{Cache: cache})
+	return server, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func hashOf(data string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(data)))
+}
+
+func TestPeerStorage(t *testing.T) {
+	hello, world := hashOf("hello"), hashOf("world")
+
+	// the first peer is down, the second one has a corrupted blob
+	down, cleanup := peerCache(t, nil)
+	cleanup()
+	corrupted, cleanup := peerCache(t, map[string]string{hello: "bye"})
+	defer cleanup()
+	good, cleanup := peerCache(t, map[string]string{hello: "hello"})
+	defer cleanup()
+
+	var peers []Peer
+	for _, server := range []*httptest.Server{down, corrupted, good} {
+		u, _ := url.Parse(server.URL)
+		client, _ := NewAydoStorage(u)
+		peers = append(peers, Peer{Name: server.URL, Stor: client})
+	}
+
+	central := testStorage{world: []byte("central")}
+	stor := NewPeerStorage(central, peers, "")
+
+	body, err := stor.Get(hello)
+	if assert.NoError(t, err) {
+		r, err := brotli.NewReader(body, nil)
+		if assert.NoError(t, err) {
+			data, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(data))
+		}
+		body.Close()
+	}
+
+	// no peer has it
+	body, err = stor.Get(world)
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(body)
+		assert.Equal(t, "central", string(data))
+		body.Close()
+	}
+}
+
+func TestPeerStorageSpool(t *testing.T) {
+	// a blob spooled to a file
+	data := strings.Repeat("0123456789", utils.DefaultSpoolSize/5)
+	hash := hashOf(data)
+	server, cleanup := peerCache(t, map[string]string{hash: data})
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u, _ := url.Parse(server.URL)
+	client, _ := NewAydoStorage(u)
+	stor := NewPeerStorage(testStorage{}, []Peer{{Name: server.URL, Stor: client}}, dir)
+
+	body, err := stor.Get(hash)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer body.Close()
+
+	r, err := NewReader(body)
+	if assert.NoError(t, err) {
+		got, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, data, string(got))
+	}
+
+	// the spool file is removed right away
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/g8os/fs/codec"
+)
+
+// Priority orders the downloads waiting for a store
+type Priority int
+
+const (
+	// Foreground downloads are files an application is waiting for
+	Foreground Priority = iota
+	// Background downloads are prefetches
+	Background
+
+	numPriorities = 2
+)
+
+// DefaultConcurrency is the number of downloads at once from a store when
+// it's not configured
+const DefaultConcurrency = 8
+
+// Prioritized is a Storage whose downloads can be given a priority
+type Prioritized interface {
+	Storage
+	GetPriority(key string, priority Priority) (io.ReadCloser, error)
+}
+
+type withPriority struct {
+	Prioritized
+	priority Priority
+}
+
+func (s withPriority) Get(key string) (io.ReadCloser, error) {
+	return s.GetPriority(key, s.priority)
+}
+
+// WithPriority returns a Storage getting from stor with priority, or stor
+// itself if it doesn't support priorities
+func WithPriority(stor Storage, priority Priority) Storage {
+	if p, ok := stor.(Prioritized); ok {
+		return withPriority{Prioritized: p, priority: priority}
+	}
+	return stor
+}
+
+// Scheduler bounds the downloads from the stores: each store has a maximum
+// of downloads at once, and all the downloads share a bandwidth limit. The
+// downloads waiting for a store start by priority, and in turns between the
+// mounts with the same priority.
+type Scheduler struct {
+	lock    sync.Mutex
+	stores  map[string]*ScheduledStore
+	limiter *limiter
+}
+
+// NewScheduler returns a scheduler limiting the downloads to bandwidth bytes
+// per second, 0 is unlimited
+func NewScheduler(bandwidth int64) *Scheduler {
+	s := &Scheduler{
+		stores: make(map[string]*ScheduledStore),
+	}
+	if bandwidth > 0 {
+		s.limiter = &limiter{rate: bandwidth}
+	}
+	return s
+}
+
+// Store returns the store name with at most concurrency downloads at once.
+// stor is the client of the store, only the first one given for a name is
+// used.
+func (s *Scheduler) Store(name string, stor Storage, concurrency int) *ScheduledStore {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if store, ok := s.stores[name]; ok {
+		return store
+	}
+
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	store := &ScheduledStore{
+		stor:    stor,
+		limit:   concurrency,
+		limiter: s.limiter,
+	}
+	for i := range store.waiting {
+		store.waiting[i] = newFairQueue()
+	}
+	s.stores[name] = store
+	return store
+}
+
+// ScheduledStore is a store whose downloads are scheduled
+type ScheduledStore struct {
+	stor    Storage
+	limiter *limiter
+	health  health
+
+	lock    sync.Mutex
+	limit   int
+	running int
+	waiting [numPriorities]*fairQueue
+}
+
+// For returns the Storage a mount downloads from
+func (s *ScheduledStore) For(mount string) Storage {
+	return &mountStorage{store: s, mount: mount}
+}
+
+// Healthy returns false if the last downloads from the store failed, see
+// Checker
+func (s *ScheduledStore) Healthy() bool {
+	return s.health.healthy()
+}
+
+// acquire waits for a download slot
+func (s *ScheduledStore) acquire(mount string, priority Priority) {
+	s.lock.Lock()
+	if s.running < s.limit {
+		s.running++
+		s.lock.Unlock()
+		return
+	}
+
+	ready := make(chan struct{})
+	s.waiting[priority].push(mount, ready)
+	s.lock.Unlock()
+
+	// the slot is handed over by release
+	<-ready
+}
+
+// release gives the slot of a download over to the next one waiting
+func (s *ScheduledStore) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, queue := range s.waiting {
+		if ready, ok := queue.pop(); ok {
+			close(ready)
+			return
+		}
+	}
+	s.running--
+}
+
+type mountStorage struct {
+	store *ScheduledStore
+	mount string
+}
+
+func (s *mountStorage) Get(key string) (io.ReadCloser, error) {
+	return s.GetPriority(key, Foreground)
+}
+
+func (s *mountStorage) Healthy() bool {
+	return s.store.Healthy()
+}
+
+// GetPriority waits for a download slot of the store, held until the body is
+// closed
+func (s *mountStorage) GetPriority(key string, priority Priority) (io.ReadCloser, error) {
+	if priority < 0 || priority >= numPriorities {
+		priority = Background
+	}
+
+	s.store.acquire(s.mount, priority)
+	body, err := s.store.stor.Get(key)
+	s.store.health.done(err)
+	if err != nil {
+		s.store.release()
+		return nil, err
+	}
+
+	return &scheduledBody{
+		body:    body,
+		limiter: s.store.limiter,
+		health:  &s.store.health,
+		release: s.store.release,
+	}, nil
+}
+
+// chunkSize is the most read from a body at once, so the bandwidth limit is
+// smooth
+const chunkSize = 32 * 1024
+
+type scheduledBody struct {
+	body    io.ReadCloser
+	limiter *limiter
+	health  *health
+	release func()
+	once    sync.Once
+}
+
+func (b *scheduledBody) Read(p []byte) (int, error) {
+	if b.limiter != nil && len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+
+	n, err := b.body.Read(p)
+	b.limiter.wait(n)
+	if err != nil && err != io.EOF {
+		// the store went away during the download
+		b.health.done(err)
+	}
+	return n, err
+}
+
+// Codec returns the codec of the body, nil if it's not known
+func (b *scheduledBody) Codec() codec.Codec {
+	if e, ok := b.body.(encoded); ok {
+		return e.Codec()
+	}
+	return nil
+}
+
+func (b *scheduledBody) ContentType() string {
+	return ContentType(b.body)
+}
+
+func (b *scheduledBody) Close() error {
+	err := b.body.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// fairQueue is a FIFO of waiters per mount, served in turns
+type fairQueue struct {
+	mounts  []string
+	waiters map[string][]chan struct{}
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{
+		waiters: make(map[string][]chan struct{}),
+	}
+}
+
+func (q *fairQueue) push(mount string, ready chan struct{}) {
+	if len(q.waiters[mount]) == 0 {
+		q.mounts = append(q.mounts, mount)
+	}
+	q.waiters[mount] = append(q.waiters[mount], ready)
+}
+
+// pop returns the first waiter of the next mount
+func (q *fairQueue) pop() (chan struct{}, bool) {
+	if len(q.mounts) == 0 {
+		return nil, false
+	}
+
+	mount := q.mounts[0]
+	q.mounts = q.mounts[1:]
+
+	waiters := q.waiters[mount]
+	ready := waiters[0]
+	if len(waiters) == 1 {
+		delete(q.waiters, mount)
+	} else {
+		q.waiters[mount] = waiters[1:]
+		// its next waiter waits for the other mounts
+		q.mounts = append(q.mounts, mount)
+	}
+
+	return ready, true
+}
+
+// limiter spreads the transfers so they don't go over rate bytes per second
+type limiter struct {
+	lock sync.Mutex
+	rate int64
+	next time.Time
+}
+
+// wait blocks until the transfer of n bytes fits the rate
+func (l *limiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.lock.Unlock()
+
+	time.Sleep(delay)
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testStorage map[string][]byte
+
+func (s testStorage) Get(key string) (io.ReadCloser, error) {
+	data, ok := s[key]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", key)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// waitingCount returns the number of downloads waiting for the store
+func (s *ScheduledStore) waitingCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := 0
+	for _, queue := range s.waiting {
+		for _, waiters := range queue.waiters {
+			n += len(waiters)
+		}
+	}
+	return n
+}
+
+// queue starts a download that waits for the store, the key is sent to done
+// once it got a slot, and the slot is released at once
+func queue(t *testing.T, store *ScheduledStore, mount, key string, priority Priority, done chan<- string) {
+	before := store.waitingCount()
+	go func() {
+		body, err := store.For(mount).(Prioritized).GetPriority(key, priority)
+		if assert.NoError(t, err) {
+			done <- key
+			body.Close()
+		}
+	}()
+
+	for store.waitingCount() == before {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerConcurrency(t *testing.T) {
+	stor := testStorage{"a": []byte("a")}
+	store := NewScheduler(0).Store("stor", stor, 2)
+
+	first, err := store.For("/opt").Get("a")
+	assert.NoError(t, err)
+	second, err := store.For("/opt").Get("a")
+	assert.NoError(t, err)
+
+	done := make(chan string, 1)
+	queue(t, store, "/opt", "a", Foreground, done)
+
+	select {
+	case <-done:
+		t.Fatal("third download started with 2 running")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	first.Close()
+	// closing twice doesn't release twice
+	first.Close()
+	assert.Equal(t, "a", <-done)
+	second.Close()
+
+	// a failed download releases its slot
+	for i := 0; i < 3; i++ {
+		_, err := store.For("/opt").Get("missing")
+		assert.Error(t, err)
+	}
+	store.lock.Lock()
+	assert.Equal(t, 0, store.running)
+	store.lock.Unlock()
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	stor := testStorage{"1": nil, "2": nil, "3": nil, "4": nil, "5": nil}
+	store := NewScheduler(0).Store("stor", stor, 1)
+
+	running, err := store.For("/opt").Get("1")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	done := make(chan string, 4)
+	queue(t, store, "/opt", "2", Background, done)
+	queue(t, store, "/opt", "3", Foreground, done)
+	queue(t, store, "/opt", "4", Foreground, done)
+	queue(t, store, "/var", "5", Foreground, done)
+	running.Close()
+
+	// foreground first, in turns between the mounts
+	var order []string
+	for i := 0; i < 4; i++ {
+		order = append(order, <-done)
+	}
+	assert.Equal(t, []string{"3", "5", "4", "2"}, order)
+}
+
+func TestSchedulerBandwidth(t *testing.T) {
+	stor := testStorage{"a": make([]byte, 256*1024)}
+	store := NewScheduler(1024*1024).Store("stor", stor, 0)
+
+	start := time.Now()
+	body, err := store.For("/opt").Get("a")
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+
+	assert.NoError(t, err)
+	assert.Len(t, data, 256*1024)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "read 256KiB at 1MiB/s in %s", time.Since(start))
+}
+
+func TestWithPriority(t *testing.T) {
+	stor := testStorage{}
+	assert.Equal(t, Storage(stor), WithPriority(stor, Background))
+
+	scheduler := NewScheduler(0)
+	store := scheduler.Store("stor", stor, 1)
+	_, ok := WithPriority(store.For("/opt"), Background).(withPriority)
+	assert.True(t, ok)
+
+	// the mounts of a store share it
+	assert.True(t, store == scheduler.Store("stor", testStorage{}, 4))
+}
+
+type failingStorage struct {
+	err error
+}
+
+func (s failingStorage) Get(key string) (io.ReadCloser, error) {
+	return nil, s.err
+}
+
+func TestHealth(t *testing.T) {
+	down := &failingStorage{err: fmt.Errorf("connection refused")}
+	store := NewScheduler(0).Store("stor", down, 1)
+	stor := store.For("/opt")
+	assert.True(t, Healthy(stor))
+
+	// a missing key doesn't make a store unhealthy
+	down.err = &StatusError{Code: 404}
+	for i := 0; i < unhealthyAfter; i++ {
+		stor.Get("a")
+	}
+	assert.True(t, Healthy(stor))
+
+	down.err = fmt.Errorf("connection refused")
+	for i := 0; i < unhealthyAfter; i++ {
+		assert.True(t, Healthy(stor))
+		stor.Get("a")
+	}
+	assert.False(t, Healthy(stor))
+
+	// after a while the next download tells if it's back
+	store.health.failed = time.Now().Add(-retryAfter - time.Second)
+	assert.True(t, Healthy(stor))
+	store.stor = testStorage{"a": nil}
+	body, err := stor.Get("a")
+	if assert.NoError(t, err) {
+		body.Close()
+	}
+	assert.True(t, Healthy(stor))
+
+	assert.True(t, Healthy(testStorage{}))
+}
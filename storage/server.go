@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/g8os/fs/codec"
+	"github.com/g8os/fs/utils"
+)
+
+// DefaultNamespace is the namespace of the blobs requested without one
+const DefaultNamespace = "default"
+
+// Server serves the encoded blobs of a directory like the stores the aydo
+// client gets from: GET /[NAMESPACE/]HASH returns a blob, and PUT uploads
+// one. The blobs are in DIR/NAMESPACE/HA/HASH.CODEC, as uploaded with the
+// codec of their content type, and a blob is never replaced once stored. The
+// blobs stored without their codec in DIR/NAMESPACE/HA/HASH are served as
+// brotli unless their header tells another codec.
+type Server struct {
+	Dir string
+	// User and Password are required to upload, and to download too if
+	// Private is set. Anyone can upload when User is empty.
+	User     string
+	Password string
+	Private  bool
+	// NoVerify accepts the uploads whose content doesn't match their hash,
+	// the md5 of their content, which are refused otherwise
+	NoVerify bool
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	namespace, hash, ok := splitBlobPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if s.Private && !s.authorized(r) {
+			s.unauthorized(w)
+			return
+		}
+		s.get(w, r, namespace, hash)
+	case "PUT", "POST":
+		if !s.authorized(r) {
+			s.unauthorized(w)
+			return
+		}
+		s.put(w, r, namespace, hash)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// splitBlobPath returns the namespace and the hash of a blob path
+func splitBlobPath(path string) (string, string, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	namespace, hash := DefaultNamespace, parts[len(parts)-1]
+	switch len(parts) {
+	case 1:
+	case 2:
+		namespace = parts[0]
+	default:
+		return "", "", false
+	}
+
+	for _, name := range []string{namespace, hash} {
+		if len(name) < 2 || strings.HasPrefix(name, ".") {
+			return "", "", false
+		}
+	}
+	return namespace, hash, true
+}
+
+// storedCodecs are the codecs of the blob names, in the order they're looked
+// for
+var storedCodecs = []codec.Codec{codec.Brotli, codec.Zstd, codec.Gzip, codec.None}
+
+func (s *Server) path(namespace, hash string) string {
+	return filepath.Join(s.Dir, namespace, hash[:2], hash)
+}
+
+// find returns the path of a stored blob and its codec, nil if it was stored
+// without one, or an empty path if it's not stored
+func (s *Server) find(namespace, hash string) (string, codec.Codec) {
+	name := s.path(namespace, hash)
+	if _, err := os.Stat(name); err == nil {
+		return name, nil
+	}
+	for _, c := range storedCodecs {
+		if _, err := os.Stat(name + "." + c.Name()); err == nil {
+			return name + "." + c.Name(), c
+		}
+	}
+	return "", nil
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	return utils.Authorized(r, s.User, s.Password)
+}
+
+func (s *Server) unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="stor"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, namespace, hash string) {
+	name, c := s.find(namespace, hash)
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Errorf("Failed to serve blob %s/%s: %s", namespace, hash, err)
+		http.Error(w, "can't read blob", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	header := make([]byte, 4)
+	n, _ := io.ReadFull(file, header)
+	if c == nil {
+		var ok bool
+		if c, ok = codec.Sniff(header[:n]); !ok {
+			c = codec.Brotli
+		}
+	}
+
+	w.Header().Set("Content-Type", c.ContentType())
+	if r.Method == "HEAD" {
+		return
+	}
+
+	if _, err := io.Copy(w, io.MultiReader(bytes.NewReader(header[:n]), file)); err != nil {
+		log.Warningf("Failed to serve blob %s/%s to %s: %s", namespace, hash, r.RemoteAddr, err)
+	}
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, namespace, hash string) {
+	if name, _ := s.find(namespace, hash); name != "" {
+		log.Debugf("Blob %s/%s is already stored", namespace, hash)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	name := s.path(namespace, hash)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		log.Errorf("Failed to store blob %s/%s: %s", namespace, hash, err)
+		http.Error(w, "can't store blob", http.StatusInternalServerError)
+		return
+	}
+
+	// the blob is written aside, so it's never served partially
+	file, err := ioutil.TempFile(filepath.Dir(name), "."+hash)
+	if err != nil {
+		log.Errorf("Failed to store blob %s/%s: %s", namespace, hash, err)
+		http.Error(w, "can't store blob", http.StatusInternalServerError)
+		return
+	}
+	tmp := file.Name()
+	defer os.Remove(tmp)
+
+	var c codec.Codec
+	_, err = io.Copy(file, r.Body)
+	if err == nil {
+		c, err = blobCodec(file, r.Header.Get("Content-Type"))
+	}
+	if err == nil && !s.NoVerify {
+		if err = verifyBlob(hash, file, c); err != nil {
+			file.Close()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		// a link doesn't replace a blob stored meanwhile
+		if err = os.Link(tmp, name+"."+c.Name()); os.IsExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to store blob %s/%s: %s", namespace, hash, err)
+		http.Error(w, "can't store blob", http.StatusInternalServerError)
+		return
+	}
+
+	log.Debugf("Stored blob %s/%s as %s", namespace, hash, c.Name())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// blobCodec returns the codec of the blob in file from its content type, see
+// codec.Detect. Unlike the stores predating the codecs, this server and the
+// peers give application/octet-stream for the blobs of the None codec only.
+func blobCodec(file io.ReadSeeker, contentType string) (codec.Codec, error) {
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == codec.None.ContentType() {
+		return codec.None, nil
+	}
+
+	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	c, _ := codec.Detect(file, contentType)
+	return c, nil
+}
+
+// verifyBlob checks that the blob in file encoded with c is the content of
+// hash
+func verifyBlob(hash string, file io.ReadSeeker, c codec.Codec) error {
+	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	r, err := c.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("invalid blob: %s", err)
+	}
+	defer r.Close()
+
+	sum := md5.New()
+	if _, err := io.Copy(sum, r); err != nil {
+		return fmt.Errorf("invalid blob: %s", err)
+	}
+
+	if got := fmt.Sprintf("%x", sum.Sum(nil)); got != hash {
+		return fmt.Errorf("content hash is %s", got)
+	}
+	return nil
+}
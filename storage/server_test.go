@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/g8os/fs/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+// brotliStored encodes data as a brotli uncompressed meta-block
+func brotliStored(data []byte) []byte {
+	header := uint32(len(data)-1)<<4 | 1<<20
+	out := []byte{byte(header), byte(header >> 8), byte(header >> 16)}
+	out = append(out, data...)
+	return append(out, 0x03)
+}
+
+// testServer serves a temporary directory, and returns a function making the
+// clients of a namespace, with the user:secret auth if auth is set
+func testServer(t *testing.T, server *Server) (func(namespace string, auth bool) Storage, func()) {
+	dir, err := ioutil.TempDir("", "stor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Dir = dir
+	httpServer := httptest.NewServer(server)
+
+	client := func(namespace string, auth bool) Storage {
+		u, err := url.Parse(httpServer.URL + "/" + namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth {
+			u.User = url.UserPassword("user", "secret")
+		}
+		stor, _ := NewAydoStorage(u)
+		return stor
+	}
+
+	return client, func() {
+		httpServer.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestServer(t *testing.T) {
+	client, cleanup := testServer(t, &Server{User: "user", Password: "secret"})
+	defer cleanup()
+
+	hello := hashOf("hello")
+	blob := brotliStored([]byte("hello"))
+	anonymous, authorized := client("", false), client("", true)
+	assert.Error(t, anonymous.(Uploader).Put(hello, bytes.NewReader(blob)))
+	assert.NoError(t, authorized.(Uploader).Put(hello, bytes.NewReader(blob)))
+
+	// uploads are checked against their hash
+	err := authorized.(Uploader).Put(hashOf("other"), bytes.NewReader(blob))
+	if assert.IsType(t, &StatusError{}, err) {
+		assert.Equal(t, http.StatusBadRequest, err.(*StatusError).Code)
+	}
+
+	body, err := anonymous.Get(hello)
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(body)
+		body.Close()
+		assert.Equal(t, blob, data)
+	}
+
+	// the namespaces are apart
+	_, err = client("ns", true).Get(hello)
+	if assert.IsType(t, &StatusError{}, err) {
+		assert.Equal(t, http.StatusNotFound, err.(*StatusError).Code)
+	}
+	assert.NoError(t, client("ns", true).(Uploader).Put(hello, bytes.NewReader(blob)))
+	body, err = client("ns", true).Get(hello)
+	if assert.NoError(t, err) {
+		body.Close()
+	}
+}
+
+func TestPrivateServer(t *testing.T) {
+	client, cleanup := testServer(t, &Server{User: "user", Password: "secret", Private: true})
+	defer cleanup()
+
+	hello := hashOf("hello")
+	blob := brotliStored([]byte("hello"))
+	assert.NoError(t, client("", true).(Uploader).Put(hello, bytes.NewReader(blob)))
+
+	_, err := client("", false).Get(hello)
+	if assert.IsType(t, &StatusError{}, err) {
+		assert.Equal(t, http.StatusUnauthorized, err.(*StatusError).Code)
+	}
+	body, err := client("", true).Get(hello)
+	if assert.NoError(t, err) {
+		body.Close()
+	}
+}
+
+func TestServerKeepsBlobs(t *testing.T) {
+	client, cleanup := testServer(t, &Server{NoVerify: true})
+	defer cleanup()
+
+	stor := client("", false)
+	hello := hashOf("hello")
+	blob := brotliStored([]byte("hello"))
+	assert.NoError(t, stor.(Uploader).Put(hello, bytes.NewReader(blob)))
+	// the blob stored isn't replaced
+	assert.NoError(t, stor.(Uploader).Put(hello, bytes.NewReader(brotliStored([]byte("other")))))
+
+	body, err := stor.Get(hello)
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(body)
+		body.Close()
+		assert.Equal(t, blob, data)
+	}
+}
+
+func TestSplitBlobPath(t *testing.T) {
+	for path, expected := range map[string][]string{
+		"/abcd":     {DefaultNamespace, "abcd"},
+		"/ns/abcd":  {"ns", "abcd"},
+		"/":         nil,
+		"/a/b/abcd": nil,
+		"/../abcd":  nil,
+		"/ns/.abcd": nil,
+	} {
+		namespace, hash, ok := splitBlobPath(path)
+		if expected == nil {
+			assert.False(t, ok, path)
+			continue
+		}
+		assert.True(t, ok, path)
+		assert.Equal(t, expected, []string{namespace, hash}, path)
+	}
+}
+
+func TestServerCodecs(t *testing.T) {
+	client, cleanup := testServer(t, &Server{})
+	defer cleanup()
+
+	stor := client("", false)
+	hello := hashOf("hello")
+	blob := codec.Encode(codec.Zstd, bytes.NewReader([]byte("hello")))
+	assert.NoError(t, stor.(Uploader).Put(hello, blob))
+
+	// the codec is found from the content type the server gives
+	body, err := stor.Get(hello)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer body.Close()
+	assert.Equal(t, "application/zstd", ContentType(body))
+
+	r, err := NewReader(body)
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		assert.Equal(t, "hello", string(data))
+	}
+}
+
+func TestServerNone(t *testing.T) {
+	server := &Server{}
+	client, cleanup := testServer(t, server)
+	defer cleanup()
+
+	stor := client("", false)
+	hello := hashOf("hello")
+	assert.NoError(t, stor.(Uploader).Put(hello, codec.Encode(codec.None, bytes.NewReader([]byte("hello")))))
+
+	// the blob is kept with its codec, and served with its content type
+	_, err := os.Stat(server.path(DefaultNamespace, hello) + ".none")
+	assert.NoError(t, err)
+	body, err := WithCodec(stor, codec.None).Get(hello)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "application/octet-stream", ContentType(body))
+		r, err := NewReader(body)
+		if assert.NoError(t, err) {
+			data, _ := ioutil.ReadAll(r)
+			r.Close()
+			assert.Equal(t, "hello", string(data))
+		}
+		body.Close()
+	}
+
+	// the blobs stored without their codec are brotli
+	other := hashOf("other")
+	name := server.path(DefaultNamespace, other)
+	os.MkdirAll(filepath.Dir(name), 0755)
+	if err := ioutil.WriteFile(name, brotliStored([]byte("other")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	body, err = stor.Get(other)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "application/brotli", ContentType(body))
+		body.Close()
+	}
+}
+
+func TestWithCodec(t *testing.T) {
+	stor := WithCodec(testStorage{"a": []byte("raw")}, codec.None)
+	store := NewScheduler(0).Store("stor", stor, 1)
+
+	body, err := store.For("/opt").Get("a")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer body.Close()
+
+	r, err := NewReader(body)
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(r)
+		assert.Equal(t, "raw", string(data))
+	}
+}
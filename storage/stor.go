@@ -12,3 +12,8 @@ var (
 type Storage interface {
 	Get(key string) (io.ReadCloser, error)
 }
+
+// Uploader is a Storage blobs can be uploaded to
+type Uploader interface {
+	Put(key string, blob io.Reader) error
+}
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// Authorized tells if the request has the basic auth user:password, any
+// request is authorized when user is empty
+func Authorized(r *http.Request, user, password string) bool {
+	if user == "" {
+		return true
+	}
+
+	u, p, ok := r.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+}
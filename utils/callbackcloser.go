@@ -10,7 +10,7 @@ type callbackCloser struct {
 	callback OnClose
 }
 
-func NewCallbackCloser(f io.ReadSeeker, path string, cb OnClose) io.ReadSeeker {
+func NewCallbackCloser(f io.ReadSeeker, path string, cb OnClose) ReadSeekCloser {
 	return &callbackCloser{
 		ReadSeeker: f,
 		path:       path,
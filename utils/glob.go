@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"path"
+	"strings"
+)
+
+func globSegments(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+func matchSegments(pattern, name []string, prefix bool) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if ok, err := matchSegments(pattern[1:], name[i:], prefix); err != nil || ok {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+
+		if len(name) == 0 {
+			return prefix, nil
+		}
+
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false, err
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0, nil
+}
+
+// MatchGlob reports whether the absolute path name matches the pattern. The
+// pattern is matched segment by segment with path.Match, and a "**" segment
+// matches any number of segments, including none.
+func MatchGlob(pattern, name string) (bool, error) {
+	return matchSegments(globSegments(pattern), globSegments(name), false)
+}
+
+// MatchGlobPrefix reports whether a path under the directory dir could match
+// the pattern.
+func MatchGlobPrefix(pattern, dir string) (bool, error) {
+	return matchSegments(globSegments(pattern), globSegments(dir), true)
+}
+
+// ValidateGlob returns an error if the pattern is malformed
+func ValidateGlob(pattern string) error {
+	for _, segment := range globSegments(pattern) {
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"/opt/app/**", "/opt/app", true},
+		{"/opt/app/**", "/opt/app/bin/run", true},
+		{"/opt/app/**", "/opt/other", false},
+		{"/usr/share/doc", "/usr/share/doc", true},
+		{"/usr/share/doc", "/usr/share/doc/x", false},
+		{"/usr/*/doc", "/usr/share/doc", true},
+		{"/**/*.pyc", "/opt/lib/x.pyc", true},
+		{"/**/*.pyc", "/x.pyc", true},
+		{"/**/*.pyc", "/opt/lib/x.py", false},
+		{"/**", "/", true},
+	}
+
+	for _, c := range cases {
+		ok, err := MatchGlob(c.pattern, c.name)
+		assert.NoError(t, err)
+		assert.Equal(t, c.match, ok, "%s ~ %s", c.pattern, c.name)
+	}
+}
+
+func TestMatchGlobPrefix(t *testing.T) {
+	ok, _ := MatchGlobPrefix("/opt/app/**", "/opt")
+	assert.True(t, ok)
+	ok, _ = MatchGlobPrefix("/opt/app/**", "/")
+	assert.True(t, ok)
+	ok, _ = MatchGlobPrefix("/opt/app/**", "/usr")
+	assert.False(t, ok)
+	ok, _ = MatchGlobPrefix("/opt/*/bin", "/opt/app")
+	assert.True(t, ok)
+}
+
+func TestValidateGlob(t *testing.T) {
+	assert.NoError(t, ValidateGlob("/opt/**/*.so"))
+	assert.Error(t, ValidateGlob("/opt/[a"))
+}
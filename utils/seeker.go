@@ -1,47 +1,224 @@
 package utils
 
 import (
-	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 )
 
+// DefaultSpoolSize is the size of a body kept in memory by NewReadSeeker, past
+// it the body is spooled to a temporary file
+const DefaultSpoolSize = 1024 * 1024
+
+// bodyReader makes a body seekable, the part of the body read is spooled to
+// be read again: in memory up to size bytes, then in a temporary file of dir.
+// Seeking forward doesn't spool, the body is skipped up to the offset at the
+// next Read and what was spooled before is dropped.
 type bodyReader struct {
-	body   io.ReadCloser
-	reader *bytes.Reader
+	body io.ReadCloser
+	dir  string
+	size int64
+
+	// the body is spooled from start to read, pos is the offset of the
+	// next Read
+	start int64
+	read  int64
+	pos   int64
+
+	buf  []byte
+	file *os.File
+	// err is the error reading the body, io.EOF at its end
+	err error
+}
+
+// ReadSeekCloser is a seekable reader to close once read
+type ReadSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
 }
 
-func NewReadSeeker(body io.ReadCloser) io.ReadSeeker {
+// NewReadSeeker returns a seekable reader of body, spooled to a temporary file
+// of dir past DefaultSpoolSize bytes, see NewReadSeekerSize
+func NewReadSeeker(body io.ReadCloser, dir string) ReadSeekCloser {
+	return NewReadSeekerSize(body, dir, DefaultSpoolSize)
+}
+
+// NewReadSeekerSize returns a seekable reader of body, kept in memory up to
+// size bytes and spooled to a temporary file of dir past it. Seeking before an
+// offset skipped by a forward seek is an error, and so is reading past what
+// was spooled once the body or the spooling failed. Closing the reader closes
+// the body and removes the temporary file.
+func NewReadSeekerSize(body io.ReadCloser, dir string, size int64) ReadSeekCloser {
 	return &bodyReader{
 		body: body,
+		dir:  dir,
+		size: size,
 	}
 }
 
-func (reader *bodyReader) fillBuffer() error {
-	if reader.reader == nil {
-		content, err := ioutil.ReadAll(reader.body)
-		if err != nil {
+func (reader *bodyReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if reader.pos < reader.read {
+		return reader.readSpool(p)
+	}
+
+	if err := reader.skip(); err != nil {
+		return 0, err
+	}
+	if reader.err != nil {
+		return 0, reader.err
+	}
+
+	n, err := reader.body.Read(p)
+	if n > 0 {
+		if serr := reader.spool(p[:n]); serr != nil {
+			// the data read is lost, the body can't be read further
+			reader.err = serr
+			return 0, serr
+		}
+		reader.read += int64(n)
+		reader.pos = reader.read
+	}
+	if err != nil {
+		reader.err = err
+		if n > 0 && err == io.EOF {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+// readSpool reads the spooled body at pos
+func (reader *bodyReader) readSpool(p []byte) (int, error) {
+	if max := reader.read - reader.pos; int64(len(p)) > max {
+		p = p[:max]
+	}
+
+	offset := reader.pos - reader.start
+	var n int
+	var err error
+	if reader.file != nil {
+		n, err = reader.file.ReadAt(p, offset)
+	} else {
+		n = copy(p, reader.buf[offset:])
+	}
+
+	reader.pos += int64(n)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+// skip discards the body up to pos after a forward seek, and starts spooling
+// there
+func (reader *bodyReader) skip() error {
+	if reader.pos <= reader.read || reader.err != nil {
+		return nil
+	}
+
+	n, err := io.CopyN(ioutil.Discard, reader.body, reader.pos-reader.read)
+	reader.read += n
+	reader.start = reader.read
+	reader.buf = reader.buf[:0]
+	if reader.file != nil {
+		if terr := reader.file.Truncate(0); terr != nil {
+			return terr
+		}
+	}
+
+	if err != nil {
+		reader.err = err
+		reader.pos = reader.read
+		if err != io.EOF {
 			return err
 		}
-		reader.reader = bytes.NewReader(content)
 	}
 	return nil
 }
 
-func (reader *bodyReader) Read(p []byte) (int, error) {
-	if err := reader.fillBuffer(); err != nil {
-		return 0, nil
+// spool keeps the data read from the body, in memory until it grows over size
+func (reader *bodyReader) spool(data []byte) error {
+	if reader.file == nil && int64(len(reader.buf)+len(data)) <= reader.size {
+		reader.buf = append(reader.buf, data...)
+		return nil
 	}
-	return reader.reader.Read(p)
-}
 
-func (reader *bodyReader) Close() error {
-	return reader.body.Close()
+	if reader.file == nil {
+		file, err := ioutil.TempFile(reader.dir, ".spool")
+		if err != nil {
+			return err
+		}
+		// the file is removed right away, it goes away when closed
+		os.Remove(file.Name())
+
+		// the buffer is kept until the file has it all
+		if _, err := file.Write(reader.buf); err != nil {
+			file.Close()
+			return err
+		}
+		reader.file = file
+		reader.buf = nil
+	}
+
+	_, err := reader.file.WriteAt(data, reader.read-reader.start)
+	return err
 }
 
 func (reader *bodyReader) Seek(offset int64, whence int) (int64, error) {
-	if err := reader.fillBuffer(); err != nil {
-		return 0, nil
+	var pos int64
+	switch whence {
+	case os.SEEK_SET:
+		pos = offset
+	case os.SEEK_CUR:
+		pos = reader.pos + offset
+	case os.SEEK_END:
+		if err := reader.readAll(); err != nil {
+			return reader.pos, err
+		}
+		pos = reader.read + offset
+	default:
+		return reader.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if pos < 0 {
+		return reader.pos, fmt.Errorf("invalid offset %d", pos)
+	}
+	if pos < reader.start {
+		return reader.pos, fmt.Errorf("can't seek to %d, the body was skipped up to %d", pos, reader.start)
+	}
+
+	reader.pos = pos
+	return pos, nil
+}
+
+// readAll spools the body to its end
+func (reader *bodyReader) readAll() error {
+	pos := reader.pos
+	reader.pos = reader.read
+	defer func() {
+		reader.pos = pos
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		if _, err := reader.Read(buf); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (reader *bodyReader) Close() error {
+	if reader.file != nil {
+		reader.file.Close()
+		reader.file = nil
 	}
-	return reader.reader.Seek(offset, whence)
+	reader.buf = nil
+	return reader.body.Close()
 }
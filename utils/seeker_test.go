@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testBody is a body failing with err at its end, and counting its reads
+type testBody struct {
+	io.Reader
+	err    error
+	read   int
+	closed bool
+}
+
+func newTestBody(content string, err error) *testBody {
+	return &testBody{Reader: strings.NewReader(content), err: err}
+}
+
+func (b *testBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.read += n
+	if err == io.EOF && b.err != nil {
+		err = b.err
+	}
+	return n, err
+}
+
+func (b *testBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func readAt(t *testing.T, r io.ReadSeeker, offset int64, n int) string {
+	_, err := r.Seek(offset, os.SEEK_SET)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	p := make([]byte, n)
+	n, err = io.ReadFull(r, p)
+	assert.NoError(t, err)
+	return string(p[:n])
+}
+
+func TestReadSeeker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := "0123456789abcdefghij"
+	for _, size := range []int64{100, 4} {
+		body := newTestBody(content, nil)
+		r := NewReadSeekerSize(body, dir, size)
+
+		assert.Equal(t, "0123", readAt(t, r, 0, 4), "size %d", size)
+		assert.Equal(t, "abc", readAt(t, r, 10, 3), "size %d", size)
+		// within what was read after the skip
+		assert.Equal(t, "bc", readAt(t, r, 11, 2), "size %d", size)
+		assert.Equal(t, 13, body.read, "size %d", size)
+
+		// before the skip
+		_, err := r.Seek(5, os.SEEK_SET)
+		assert.Error(t, err)
+
+		end, err := r.Seek(-2, os.SEEK_END)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(18), end)
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "ij", string(data))
+		assert.Equal(t, "defghij", readAt(t, r, 13, 7), "size %d", size)
+
+		// past the end
+		r.Seek(30, os.SEEK_SET)
+		n, err := r.Read(make([]byte, 1))
+		assert.Equal(t, 0, n)
+		assert.Equal(t, io.EOF, err)
+
+		assert.NoError(t, r.Close())
+		assert.True(t, body.closed)
+	}
+
+	// the spool files are removed
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+}
+
+func TestReadSeekerSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	r := NewReadSeekerSize(ioutil.NopCloser(bytes.NewReader(content)), dir, 1024)
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	reader := r.(*bodyReader)
+	assert.Nil(t, reader.buf)
+	if assert.NotNil(t, reader.file) {
+		info, err := reader.file.Stat()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), info.Size())
+	}
+
+	assert.Equal(t, "5678", readAt(t, r, 5005, 4))
+	r.Close()
+}
+
+func TestReadSeekerErrors(t *testing.T) {
+	failed := errors.New("connection reset")
+
+	r := NewReadSeekerSize(newTestBody("0123", failed), "", 100)
+	data, err := ioutil.ReadAll(r)
+	assert.Equal(t, failed, err)
+	assert.Equal(t, "0123", string(data))
+	// the error sticks, the part read is still there
+	_, err = r.Read(make([]byte, 1))
+	assert.Equal(t, failed, err)
+	assert.Equal(t, "12", readAt(t, r, 1, 2))
+
+	r = NewReadSeekerSize(newTestBody("0123", failed), "", 100)
+	_, err = r.Seek(0, os.SEEK_END)
+	assert.Equal(t, failed, err)
+
+	_, err = r.Seek(-1, os.SEEK_SET)
+	assert.Error(t, err)
+}
+
+func TestReadSeekerSpoolError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+
+	// the spool file can't be created in a missing dir
+	body := newTestBody("0123456789", nil)
+	r := NewReadSeekerSize(body, dir, 4)
+	defer r.Close()
+	assert.Equal(t, "0123", readAt(t, r, 0, 4))
+
+	_, err = r.Read(make([]byte, 4))
+	assert.Error(t, err)
+	// the error sticks, the part spooled is still there
+	_, err = r.Read(make([]byte, 4))
+	assert.Error(t, err)
+	_, err = r.Seek(0, os.SEEK_END)
+	assert.Error(t, err)
+	assert.Equal(t, "123", readAt(t, r, 1, 3))
+	assert.Equal(t, 8, body.read)
+}
+
+func TestReadSeekerCallbackCloser(t *testing.T) {
+	var closed string
+	body := newTestBody("content", nil)
+	r := NewCallbackCloser(NewReadSeeker(body, ""), "/file", func(path string, r io.ReadSeeker) {
+		r.Seek(0, os.SEEK_SET)
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		closed = path + ":" + string(data)
+	})
+
+	assert.Equal(t, "cont", readAt(t, r, 0, 4))
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "/file:content", closed)
+	assert.True(t, body.closed)
+}
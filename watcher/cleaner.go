@@ -1,59 +1,308 @@
 package watcher
 
 import (
-	"github.com/g8os/fs/config"
-	"github.com/g8os/fs/meta"
-	"github.com/op/go-logging"
-	"github.com/robfig/cron"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+
+	"github.com/g8os/fs/blobs"
+	"github.com/g8os/fs/config"
+	"github.com/g8os/fs/meta"
+	"github.com/op/go-logging"
 )
 
 var (
 	log = logging.MustGetLogger("watcher")
 )
 
-type backenCleaner struct {
+const (
+	defaultHighWatermark = 90
+	defaultLowWatermark  = 70
+)
+
+// CacheManager evicts the cached files of a backend. Files not accessed for
+// CleanupOlderThan hours are always evicted, and when the cache grows over
+// its high watermark files are evicted in the order of the policy until it's
+// under the low watermark. Modified, open and pinned files are never evicted,
+// and nothing is evicted while the mount is offline.
+//
+// The cached files linked to the shared blob cache are counted once, and
+// their space is freed only when the last link to their blob is evicted.
+type CacheManager struct {
 	backend *config.Backend
 	meta    meta.MetaStore
-	now     time.Time
+	usage   *Usage
+	pins    *Pins
+	blobs   *blobs.Cache
+	offline *Offline
+	policy  string
+	high    int64
+	low     int64
+
+	// one pass at a time
+	lock sync.Mutex
+}
+
+// cachedFile is a file of the backend that can be evicted
+type cachedFile struct {
+	name     string
+	path     string
+	size     int64
+	accessed time.Time
+	fetched  time.Time
+	count    uint64
+	inode    inode
+	links    uint64
+	// shared is true if the file is linked to from out of the backend
+	shared bool
+}
+
+// inode identifies the files linked together
+type inode struct {
+	dev uint64
+	ino uint64
 }
 
-func NewCleaner(meta meta.MetaStore, backend *config.Backend) cron.Job {
-	return &backenCleaner{
+// NewCleaner returns the cache manager of a backend, usage reports the files
+// opened through the mount and pins are its paths never evicted. blobs is the
+// blob cache the cached files are linked to, if any, and offline the offline
+// mode of the mount.
+func NewCleaner(meta meta.MetaStore, backend *config.Backend, usage *Usage, pins *Pins, blobs *blobs.Cache, offline *Offline) (*CacheManager, error) {
+	c := &CacheManager{
 		backend: backend,
+		meta:    meta,
+		usage:   usage,
+		pins:    pins,
+		blobs:   blobs,
+		offline: offline,
+		policy:  strings.ToLower(backend.CachePolicy),
+	}
+
+	switch c.policy {
+	case "":
+		c.policy = config.CacheLRU
+	case config.CacheLRU, config.CacheLFU, config.CacheTTL:
+	default:
+		return nil, fmt.Errorf("unknown cache policy '%s', expected lru, lfu or ttl", backend.CachePolicy)
+	}
+
+	high, low := backend.CacheHighWatermark, backend.CacheLowWatermark
+	if high == 0 {
+		high = defaultHighWatermark
+	}
+	if low == 0 {
+		low = defaultLowWatermark
+	}
+	if high > 100 || low < 0 || low > high {
+		return nil, fmt.Errorf("invalid cache watermarks %d%%-%d%%", low, high)
+	}
+
+	if backend.CacheSize < 0 {
+		return nil, fmt.Errorf("invalid cache size %d", backend.CacheSize)
+	}
+	size := int64(backend.CacheSize) * 1024 * 1024
+	c.high, c.low = size*int64(high)/100, size*int64(low)/100
+
+	return c, nil
+}
+
+// Loop runs the cache manager every interval, forever
+func (c *CacheManager) Loop(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.Run()
 	}
 }
 
-func (c *backenCleaner) Run() {
+func (c *CacheManager) Run() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.offline.On() {
+		log.Debugf("Cleaner: backend '%s' is offline, keeping its cache", c.backend.Path)
+		return
+	}
+
 	log.Debugf("Cleaner is awake, checking files to clean up...")
-	if err := filepath.Walk(c.backend.Path, c.walkFN); err != nil {
+	files, refs, total, err := c.scan()
+	if err != nil {
 		log.Errorf("Failed to walk backend '%s': %s", c.backend.Path, err)
+		return
 	}
-}
 
-func (c *backenCleaner) walkFN(name string, info os.FileInfo, err error) error {
-	if strings.HasSuffix(name, meta.MetaSuffix) || info.IsDir() || err != nil {
-		return nil
+	now := time.Now()
+	var kept []*cachedFile
+	for _, f := range files {
+		if c.expired(f, now) && c.evict(f) {
+			total -= c.freed(f, refs)
+			continue
+		}
+		kept = append(kept, f)
 	}
 
-	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
-		atime := time.Unix(sys.Atim.Unix())
-		if c.now.Sub(atime) > time.Duration(c.backend.CleanupOlderThan)*time.Hour {
-			if _, exists := c.meta.Get(name); !exists {
-				return nil
-			}
+	if c.high == 0 || total <= c.high {
+		return
+	}
+
+	sort.Sort(byPolicy{files: kept, policy: c.policy})
+	for _, f := range kept {
+		if total <= c.low {
+			break
+		}
+		if c.evict(f) {
+			total -= c.freed(f, refs)
+		}
+	}
 
-			log.Debugf("Cleaner: removing file '%s'", name)
-			err := os.Remove(name)
-			if err != nil {
-				log.Warning("Failed to clean up file '%s'", name)
+	if total > c.low {
+		log.Warningf("Cache of backend '%s' is %d bytes, over its low watermark (%d bytes) with nothing left to evict", c.backend.Path, total, c.low)
+	}
+}
+
+// scan returns the files of the backend that can be evicted, the number of
+// links to each inode in the backend, and the total size of the cache
+func (c *CacheManager) scan() ([]*cachedFile, map[inode]uint64, int64, error) {
+	var files []*cachedFile
+	refs := make(map[inode]uint64)
+	var total int64
+
+	err := filepath.Walk(c.backend.Path, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || strings.HasSuffix(name, meta.MetaSuffix) {
+			return nil
+		}
+
+		sys, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+
+		// the space used on disk, once for the files linked together
+		size := sys.Blocks * 512
+		id := inode{dev: uint64(sys.Dev), ino: uint64(sys.Ino)}
+		if refs[id] == 0 {
+			total += size
+		}
+		refs[id]++
+
+		rel, err := filepath.Rel(c.backend.Path, name)
+		if err != nil || c.pins.Match(rel) {
+			return nil
+		}
+
+		// files unknown to the meta and modified files are not a cache
+		m, exists := c.meta.Get(rel)
+		if !exists || m.Stat().Modified() {
+			return nil
+		}
+
+		f := &cachedFile{
+			name:     rel,
+			path:     name,
+			size:     size,
+			accessed: time.Unix(sys.Atim.Unix()),
+			fetched:  time.Unix(sys.Ctim.Unix()),
+			inode:    id,
+			links:    uint64(sys.Nlink),
+		}
+
+		if accessed, count, ok := c.usage.accesses(rel); ok {
+			if accessed.After(f.accessed) {
+				f.accessed = accessed
 			}
+			f.count = count
 		}
+
+		files = append(files, f)
+		return nil
+	})
+
+	for _, f := range files {
+		f.shared = f.links > refs[f.inode]
+	}
+
+	return files, refs, total, err
+}
+
+// freed returns the space freed by the eviction of f: none until the last
+// link to it in the backend is evicted, and then only if nothing else links
+// to it. The blob of a file is removed with its last link.
+func (c *CacheManager) freed(f *cachedFile, refs map[inode]uint64) int64 {
+	refs[f.inode]--
+	if refs[f.inode] > 0 {
+		return 0
+	}
+
+	if !f.shared {
+		return f.size
+	}
+
+	m, exists := c.meta.Get(f.name)
+	if !exists {
+		return 0
+	}
+	md, err := m.Load()
+	if err != nil || !c.blobs.Drop(md.Hash) {
+		return 0
+	}
+
+	log.Debugf("Cleaner: removed blob %s of '%s'", md.Hash, f.path)
+	return f.size
+}
+
+// expired returns true if the file wasn't used for CleanupOlderThan hours, or
+// was fetched that long ago with the ttl policy
+func (c *CacheManager) expired(f *cachedFile, now time.Time) bool {
+	if c.backend.CleanupOlderThan <= 0 {
+		return false
 	}
 
-	return nil
+	since := f.accessed
+	if c.policy == config.CacheTTL {
+		since = f.fetched
+	}
+
+	return now.Sub(since) > time.Duration(c.backend.CleanupOlderThan)*time.Hour
+}
+
+// evict removes a cached file unless it's open
+func (c *CacheManager) evict(f *cachedFile) bool {
+	evicted, err := c.usage.evict(f.name, func() error {
+		return os.Remove(f.path)
+	})
+
+	if err != nil {
+		log.Warningf("Failed to clean up file '%s': %s", f.path, err)
+		return false
+	}
+	if evicted {
+		log.Debugf("Cleaner: removing file '%s'", f.path)
+	}
+
+	return evicted
+}
+
+// byPolicy sorts the files in the eviction order of a policy
+type byPolicy struct {
+	files  []*cachedFile
+	policy string
+}
+
+func (s byPolicy) Len() int      { return len(s.files) }
+func (s byPolicy) Swap(i, j int) { s.files[i], s.files[j] = s.files[j], s.files[i] }
+
+func (s byPolicy) Less(i, j int) bool {
+	a, b := s.files[i], s.files[j]
+	switch s.policy {
+	case config.CacheLFU:
+		if a.count != b.count {
+			return a.count < b.count
+		}
+	case config.CacheTTL:
+		return a.fetched.Before(b.fetched)
+	}
+	return a.accessed.Before(b.accessed)
 }
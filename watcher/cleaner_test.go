@@ -0,0 +1,309 @@
+package watcher
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/g8os/fs/blobs"
+	"github.com/g8os/fs/config"
+	"github.com/g8os/fs/meta"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCache struct {
+	t       *testing.T
+	backend *config.Backend
+	meta    meta.MetaStore
+}
+
+func newTestCache(t *testing.T) (*testCache, func()) {
+	dir, err := ioutil.TempDir("", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCache{
+		t:       t,
+		backend: &config.Backend{Path: dir},
+		meta:    meta.NewMemoryMetaStore(),
+	}
+	return c, func() { os.RemoveAll(dir) }
+}
+
+// cache adds a cached file of size bytes, last accessed at atime
+func (c *testCache) cache(name string, size int, atime time.Time) meta.Meta {
+	m, err := c.meta.CreateFile(name)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	m.Save(&meta.MetaData{Filetype: syscall.S_IFREG, Size: uint64(size)})
+
+	path := filepath.Join(c.backend.Path, name)
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := os.Chtimes(path, atime, atime); err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+func (c *testCache) cached(name string) bool {
+	_, err := os.Stat(filepath.Join(c.backend.Path, name))
+	return err == nil
+}
+
+func TestCleanerExpired(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	c.backend.CleanupOlderThan = 1
+	old := time.Now().Add(-2 * time.Hour)
+
+	c.cache("old", 10, old)
+	c.cache("new", 10, time.Now())
+	m := c.cache("modified", 10, old)
+	m.SetStat(m.Stat().SetModified(true))
+	c.cache("pinned/file", 10, old)
+	c.cache("open", 10, old)
+	ioutil.WriteFile(filepath.Join(c.backend.Path, "unknown"), nil, 0644)
+
+	usage := NewUsage()
+	usage.Open("open")
+
+	pins, err := NewPins([]string{"/pinned"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cleaner, err := NewCleaner(c.meta, c.backend, usage, pins, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cleaner.Run()
+
+	assert.False(t, c.cached("old"))
+	for _, name := range []string{"new", "modified", "pinned/file", "open", "unknown"} {
+		assert.True(t, c.cached(name), name)
+	}
+
+	// a closed file was just used
+	usage.Close("open")
+	cleaner.Run()
+	assert.True(t, c.cached("open"))
+}
+
+func TestCleanerSize(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	// 4 files of 300KiB fill a 1MiB cache over its 90% high watermark,
+	// the 2 least recently used go to get under the 70% low watermark
+	c.backend.CacheSize = 1
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c", "d"} {
+		c.cache(name, 300*1024, now.Add(time.Duration(i)*time.Minute))
+	}
+
+	cleaner, err := NewCleaner(c.meta, c.backend, nil, nil, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cleaner.Run()
+
+	assert.False(t, c.cached("a"))
+	assert.False(t, c.cached("b"))
+	assert.True(t, c.cached("c"))
+	assert.True(t, c.cached("d"))
+}
+
+func TestCleanerLFU(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	c.backend.CacheSize = 1
+	c.backend.CachePolicy = "LFU"
+	usage := NewUsage()
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c", "d"} {
+		c.cache(name, 300*1024, now)
+		// a is the most used, d the least
+		for j := i; j < 4; j++ {
+			usage.Open(name)
+			usage.Close(name)
+		}
+	}
+
+	cleaner, err := NewCleaner(c.meta, c.backend, usage, nil, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cleaner.Run()
+
+	assert.True(t, c.cached("a"))
+	assert.True(t, c.cached("b"))
+	assert.False(t, c.cached("c"))
+	assert.False(t, c.cached("d"))
+}
+
+// link adds a cached file of size bytes filled with fill, linked to its blob
+// in cache, and returns the hash of the blob
+func (c *testCache) link(cache *blobs.Cache, name string, fill byte, size int, atime time.Time) string {
+	data := bytes.Repeat([]byte{fill}, size)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+
+	m, err := c.meta.CreateFile(name)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	m.Save(&meta.MetaData{Filetype: syscall.S_IFREG, Hash: hash, Size: uint64(size)})
+
+	path := filepath.Join(c.backend.Path, name)
+	err = cache.Fetch(hash, path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	os.Chtimes(path, atime, atime)
+	return hash
+}
+
+func TestCleanerBlobs(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := blobs.NewCache(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a and b share a blob and c shares one with another mount, so with d
+	// 3 files of 350KiB are over the 90% high watermark of a 1MiB cache
+	c.backend.CacheSize = 1
+	now := time.Now()
+	cccc := c.link(cache, "c", 'c', 350*1024, now)
+	aaaa := c.link(cache, "a", 'a', 350*1024, now.Add(time.Minute))
+	c.link(cache, "b", 'a', 350*1024, now.Add(2*time.Minute))
+	c.cache("d", 350*1024, now.Add(3*time.Minute))
+	assert.NoError(t, cache.Link(cccc, filepath.Join(dir, "other")))
+
+	cleaner, err := NewCleaner(c.meta, c.backend, nil, nil, cache, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cleaner.Run()
+
+	// evicting c and a frees nothing, b is the last link to its blob
+	for name, cached := range map[string]bool{"a": false, "b": false, "c": false, "d": true} {
+		assert.Equal(t, cached, c.cached(name), name)
+	}
+	_, err = os.Stat(cache.Path(aaaa))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(cache.Path(cccc))
+	assert.NoError(t, err)
+}
+
+func TestCleanerOffline(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	c.backend.CleanupOlderThan = 1
+	c.cache("old", 10, time.Now().Add(-2*time.Hour))
+
+	offline := NewOffline(nil, true)
+	cleaner, err := NewCleaner(c.meta, c.backend, nil, nil, nil, offline)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cleaner.Run()
+	assert.True(t, c.cached("old"))
+
+	offline.Set(false)
+	cleaner.Run()
+	assert.False(t, c.cached("old"))
+}
+
+func TestPolicyOrder(t *testing.T) {
+	now := time.Now()
+	files := []*cachedFile{
+		{name: "a", accessed: now, fetched: now.Add(-time.Hour), count: 1},
+		{name: "b", accessed: now.Add(-time.Hour), fetched: now, count: 2},
+	}
+
+	names := func(policy string) []string {
+		sort.Sort(byPolicy{files: files, policy: policy})
+		return []string{files[0].name, files[1].name}
+	}
+
+	assert.Equal(t, []string{"b", "a"}, names(config.CacheLRU))
+	assert.Equal(t, []string{"a", "b"}, names(config.CacheLFU))
+	assert.Equal(t, []string{"a", "b"}, names(config.CacheTTL))
+}
+
+func TestNewCleanerErrors(t *testing.T) {
+	store := meta.NewMemoryMetaStore()
+
+	for _, backend := range []config.Backend{
+		{CachePolicy: "mru"},
+		{CacheHighWatermark: 50, CacheLowWatermark: 60},
+		{CacheHighWatermark: 120},
+		{CacheSize: -1},
+	} {
+		_, err := NewCleaner(store, &backend, nil, nil, nil, nil)
+		assert.Error(t, err, "%+v", backend)
+	}
+}
+
+func TestUsageRename(t *testing.T) {
+	usage := NewUsage()
+	usage.Open("dir/file")
+	usage.Open("dirx")
+	usage.Rename("dir", "other")
+
+	_, _, ok := usage.accesses("dir/file")
+	assert.False(t, ok)
+	_, count, ok := usage.accesses("other/file")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), count)
+	_, _, ok = usage.accesses("dirx")
+	assert.True(t, ok)
+}
+
+func TestUsageForget(t *testing.T) {
+	usage := NewUsage()
+	usage.Open("a")
+	usage.Close("a")
+	usage.Open("b")
+
+	// an evicted file is forgotten, an open one is not evicted
+	evicted, err := usage.evict("a", func() error { return nil })
+	assert.True(t, evicted)
+	assert.NoError(t, err)
+	evicted, _ = usage.evict("b", func() error { return nil })
+	assert.False(t, evicted)
+
+	// a removed file is forgotten once closed
+	usage.Remove("b")
+	_, _, ok := usage.accesses("b")
+	assert.True(t, ok)
+	usage.Close("b")
+
+	assert.Empty(t, usage.files)
+}
@@ -0,0 +1,47 @@
+package watcher
+
+import (
+	"sync/atomic"
+
+	"github.com/g8os/fs/storage"
+)
+
+// Offline is the offline mode of a mount: switched on and off at runtime, and
+// on while the store of the mount is unhealthy. Offline, the files that are
+// not cached fail at once and the cache manager evicts nothing. A nil Offline
+// is never on.
+type Offline struct {
+	stor   storage.Storage
+	forced int32
+}
+
+// NewOffline returns the offline mode of a mount downloading from stor,
+// switched on if on is true
+func NewOffline(stor storage.Storage, on bool) *Offline {
+	o := &Offline{stor: stor}
+	o.Set(on)
+	return o
+}
+
+// Set switches the offline mode on or off
+func (o *Offline) Set(on bool) {
+	var forced int32
+	if on {
+		forced = 1
+	}
+	atomic.StoreInt32(&o.forced, forced)
+}
+
+// Forced returns true if the offline mode was switched on
+func (o *Offline) Forced() bool {
+	return o != nil && atomic.LoadInt32(&o.forced) == 1
+}
+
+// On returns true if the mount is offline, switched on or because its store
+// is unhealthy
+func (o *Offline) On() bool {
+	if o == nil {
+		return false
+	}
+	return o.Forced() || !storage.Healthy(o.stor)
+}
@@ -0,0 +1,179 @@
+package watcher
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/g8os/fs/utils"
+)
+
+// Pins are the globs of the mount paths kept in the cache: their files are
+// prefetched and never evicted. A pin matching a directory pins everything
+// under it. Pins come from the config, and can be added and removed at
+// runtime. A nil Pins pins nothing.
+type Pins struct {
+	lock    sync.RWMutex
+	config  []string
+	runtime []string
+}
+
+// NewPins returns the pins of the config
+func NewPins(patterns []string) (*Pins, error) {
+	for _, pattern := range patterns {
+		if err := validatePin(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Pins{
+		config: patterns,
+	}, nil
+}
+
+// ReadPinFile reads a list of pins, one path or glob per line. Empty lines and
+// lines starting with # are ignored.
+func ReadPinFile(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	return patterns, scanner.Err()
+}
+
+func validatePin(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("invalid pin '%s': not an absolute path", pattern)
+	}
+	if err := utils.ValidateGlob(pattern); err != nil {
+		return fmt.Errorf("invalid pin '%s': %s", pattern, err)
+	}
+	return nil
+}
+
+// Add pins pattern at runtime
+func (p *Pins) Add(pattern string) error {
+	if err := validatePin(pattern); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, pin := range p.runtime {
+		if pin == pattern {
+			return nil
+		}
+	}
+	p.runtime = append(p.runtime, pattern)
+	return nil
+}
+
+// Remove removes a pin added at runtime, the pins of the config can't be
+// removed
+func (p *Pins) Remove(pattern string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i, pin := range p.runtime {
+		if pin == pattern {
+			p.runtime = append(p.runtime[:i], p.runtime[i+1:]...)
+			return nil
+		}
+	}
+
+	for _, pin := range p.config {
+		if pin == pattern {
+			return fmt.Errorf("pin '%s' is set in the config", pattern)
+		}
+	}
+
+	return fmt.Errorf("pin '%s' not found", pattern)
+}
+
+// Config returns the pins of the config
+func (p *Pins) Config() []string {
+	if p == nil {
+		return nil
+	}
+	return append([]string{}, p.config...)
+}
+
+// Runtime returns the sorted pins added at runtime
+func (p *Pins) Runtime() []string {
+	if p == nil {
+		return nil
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	patterns := append([]string{}, p.runtime...)
+	sort.Strings(patterns)
+	return patterns
+}
+
+func (p *Pins) patterns() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return append(append([]string{}, p.config...), p.runtime...)
+}
+
+// Match returns true if name (relative to the mount) or one of its parent
+// directories is pinned
+func (p *Pins) Match(name string) bool {
+	if p == nil {
+		return false
+	}
+
+	patterns := p.patterns()
+	if len(patterns) == 0 {
+		return false
+	}
+
+	for dir := path.Clean("/" + name); ; dir = path.Dir(dir) {
+		for _, pattern := range patterns {
+			if ok, _ := utils.MatchGlob(pattern, dir); ok {
+				return true
+			}
+		}
+
+		if dir == "/" {
+			return false
+		}
+	}
+}
+
+// MatchUnder returns true if the directory dir, or something under it, may
+// be pinned
+func (p *Pins) MatchUnder(dir string) bool {
+	if p == nil {
+		return false
+	}
+
+	dir = path.Clean("/" + dir)
+	for _, pattern := range p.patterns() {
+		if ok, _ := utils.MatchGlobPrefix(pattern, dir); ok {
+			return true
+		}
+	}
+
+	return p.Match(dir)
+}
@@ -0,0 +1,61 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPins(t *testing.T) {
+	pins, err := NewPins([]string{"/usr/lib/python2.7/**/*.py", "/etc"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.True(t, pins.Match("usr/lib/python2.7/os.py"))
+	assert.True(t, pins.Match("usr/lib/python2.7/json/decoder.py"))
+	assert.False(t, pins.Match("usr/lib/python2.7/os.pyc"))
+	assert.True(t, pins.Match("etc/hosts"))
+	assert.False(t, pins.Match("bin/sh"))
+
+	assert.True(t, pins.MatchUnder("usr"))
+	assert.True(t, pins.MatchUnder("etc/ssl"))
+	assert.False(t, pins.MatchUnder("bin"))
+
+	assert.NoError(t, pins.Add("/bin/sh"))
+	assert.NoError(t, pins.Add("/bin/sh"))
+	assert.Equal(t, []string{"/bin/sh"}, pins.Runtime())
+	assert.True(t, pins.Match("bin/sh"))
+
+	assert.Error(t, pins.Add("bin/sh"))
+	assert.Error(t, pins.Add("/bin/["))
+	assert.Error(t, pins.Remove("/etc"))
+	assert.Error(t, pins.Remove("/missing"))
+	assert.NoError(t, pins.Remove("/bin/sh"))
+	assert.False(t, pins.Match("bin/sh"))
+
+	var none *Pins
+	assert.False(t, none.Match("etc"))
+	assert.False(t, none.MatchUnder("etc"))
+
+	_, err = NewPins([]string{"/a/["})
+	assert.Error(t, err)
+}
+
+func TestReadPinFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "pins")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("# interpreter\n/usr/bin/python2.7\n\n  /usr/lib/python2.7/**  \n")
+	file.Close()
+
+	patterns, err := ReadPinFile(file.Name())
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"/usr/bin/python2.7", "/usr/lib/python2.7/**"}, patterns)
+	}
+}
@@ -0,0 +1,152 @@
+package watcher
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage tracks the files opened through a mount: the cache manager never
+// evicts an open file, and orders the others by their accesses. A file is
+// tracked until it's evicted or removed, so only the cached files are. A nil
+// Usage tracks nothing.
+type Usage struct {
+	lock  sync.Mutex
+	files map[string]*fileUsage
+}
+
+type fileUsage struct {
+	open     int
+	accessed time.Time
+	count    uint64
+	// removed is set when the file is removed while open, it's forgotten
+	// once closed
+	removed bool
+}
+
+func NewUsage() *Usage {
+	return &Usage{
+		files: make(map[string]*fileUsage),
+	}
+}
+
+// Open records an open of name, it must be followed by a Close
+func (u *Usage) Open(name string) {
+	if u == nil {
+		return
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	f, ok := u.files[name]
+	if !ok {
+		f = &fileUsage{}
+		u.files[name] = f
+	}
+	f.removed = false
+	f.open++
+	f.count++
+	f.accessed = time.Now()
+}
+
+// Close records the close of name
+func (u *Usage) Close(name string) {
+	if u == nil {
+		return
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	f, ok := u.files[name]
+	if !ok || f.open == 0 {
+		return
+	}
+	f.open--
+	if f.open == 0 && f.removed {
+		delete(u.files, name)
+	}
+}
+
+// Remove forgets name once it's closed, it was deleted
+func (u *Usage) Remove(name string) {
+	if u == nil {
+		return
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	f, ok := u.files[name]
+	if !ok {
+		return
+	}
+	if f.open > 0 {
+		f.removed = true
+		return
+	}
+	delete(u.files, name)
+}
+
+// Rename moves the usage of oldName, and of the files under it if it's a
+// directory, to newName
+func (u *Usage) Rename(oldName, newName string) {
+	if u == nil {
+		return
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	moved := make(map[string]*fileUsage)
+	for name, f := range u.files {
+		if name == oldName || strings.HasPrefix(name, oldName+"/") {
+			moved[newName+strings.TrimPrefix(name, oldName)] = f
+			delete(u.files, name)
+		}
+	}
+
+	for name, f := range moved {
+		u.files[name] = f
+	}
+}
+
+// accesses returns the last access time and the number of opens of name
+// since the start, ok is false if it was never opened
+func (u *Usage) accesses(name string) (time.Time, uint64, bool) {
+	if u == nil {
+		return time.Time{}, 0, false
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	f, ok := u.files[name]
+	if !ok {
+		return time.Time{}, 0, false
+	}
+	return f.accessed, f.count, true
+}
+
+// evict calls remove unless name is open, holding the lock so it can't be
+// opened meanwhile. It returns false if the file is open.
+func (u *Usage) evict(name string, remove func() error) (bool, error) {
+	if u == nil {
+		return true, remove()
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if f, ok := u.files[name]; ok && f.open > 0 {
+		return false, nil
+	}
+	if err := remove(); err != nil {
+		return true, err
+	}
+
+	// the accesses of an evicted file start over once it's fetched again
+	delete(u.files, name)
+	return true, nil
+}